@@ -0,0 +1,506 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Address of the code started by the boot ROM and of the interrupts
+const entryPointAddress = 0x100
+
+var interruptVectors = []struct {
+	Address uint32
+	Name    string
+}{
+	{0x40, "VBlank interrupt"},
+	{0x48, "STAT interrupt"},
+	{0x50, "Timer interrupt"},
+	{0x58, "Serial interrupt"},
+	{0x60, "Joypad interrupt"},
+}
+
+// A CALL, RST or JP (tail call) from a routine to another, with the bytes pushed by the routine at
+// that point
+type CallEdge struct {
+	Kind   string
+	Site   uint32
+	Target uint32
+	Depth  int
+}
+
+type AnalyzedRoutine struct {
+	Address uint32
+	Name    string
+	// Deepest stack reached by the routine itself, and with the routines it calls
+	LocalDepth int
+	Depth      int
+	Calls      []CallEdge
+	Recursive  bool
+}
+
+type StackProblem struct {
+	Address uint32
+	Routine string
+	Message string
+	// Something that couldn't be analyzed, which isn't necessarily a bug
+	Warning bool
+}
+
+type EntryPoint struct {
+	Address uint32
+	Name    string
+}
+
+// Stack usage of a ROM, found by following every path of the code from the entry points. ROM
+// addresses include the bank, like the labels.
+type StackAnalysis struct {
+	ROM      []byte
+	Labels   Labels
+	Routines map[uint32]*AnalyzedRoutine
+	Entries  []EntryPoint
+	Problems []StackProblem
+	// Set by LD SP, n16 in the code started at $0100
+	StackTop uint16
+}
+
+// Name of the label at this ROM address, preferring labels that aren't relative
+func (analysis *StackAnalysis) name(address uint32) string {
+	names := []string{}
+	for label, value := range analysis.Labels {
+		if uint32(value) == address {
+			names = append(names, label)
+		}
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		if strings.Contains(a, ".") != strings.Contains(b, ".") {
+			if strings.Contains(a, ".") {
+				return 1
+			}
+			return -1
+		}
+		return strings.Compare(a, b)
+	})
+	if len(names) == 0 {
+		return formatROMAddress(uint(address))
+	}
+	return names[0]
+}
+
+// ROM address of a CPU address used by the code at from. The switchable bank is the bank of the code
+// itself or, from bank 0, the only bank with a label at this address.
+func (analysis *StackAnalysis) resolve(from uint32, target uint16) (uint32, error) {
+	switch {
+	case target < 0x4000:
+		return uint32(target), nil
+	case target >= 0x8000:
+		return 0, fmt.Errorf("$%04x is not in the ROM", target)
+	case from >= 0x4000:
+		return from/0x4000*0x4000 + uint32(target) - 0x4000, nil
+	}
+
+	banks := (len(analysis.ROM) + 0x3fff) / 0x4000
+	if banks <= 2 {
+		return uint32(target), nil
+	}
+	candidates := []uint32{}
+	for bank := 1; bank < banks; bank++ {
+		address := uint32(bank)*0x4000 + uint32(target) - 0x4000
+		if analysis.name(address) != formatROMAddress(uint(address)) {
+			candidates = append(candidates, address)
+		}
+	}
+	if len(candidates) != 1 {
+		return 0, fmt.Errorf("the bank of $%04x is not known", target)
+	}
+	return candidates[0], nil
+}
+
+type walkPosition struct {
+	Address uint32
+	Depth   int
+}
+
+// Follows every path of a routine until it returns. The JP to other routines are tail calls.
+func (analysis *StackAnalysis) walk(start uint32, routines map[uint32]bool) (*AnalyzedRoutine, []StackProblem) {
+	routine := &AnalyzedRoutine{Address: start, Name: analysis.name(start)}
+	problems := []StackProblem{}
+	report := func(address uint32, warning bool, format string, args ...any) {
+		problems = append(problems, StackProblem{address, routine.Name, fmt.Sprintf(format, args...), warning})
+	}
+
+	visited := make(map[uint32]int)
+	mismatches := make(map[uint32]bool)
+	queue := []walkPosition{{start, 0}}
+	for len(queue) > 0 {
+		position := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		address, depth := position.Address, position.Depth
+
+		if previous, ok := visited[address]; ok {
+			if previous != depth && !mismatches[address] {
+				mismatches[address] = true
+				report(address, false, "Reached with %d and %d bytes pushed by different paths", previous, depth)
+			}
+			continue
+		}
+		visited[address] = depth
+		routine.LocalDepth = max(routine.LocalDepth, depth)
+
+		if int(address) >= len(analysis.ROM) {
+			report(address, false, "Runs past the end of the ROM")
+			continue
+		}
+		code := analysis.ROM[address:]
+		opcode := code[0]
+		length, err := decodeInstruction(code)
+		if err != nil {
+			report(address, false, "Executes data: %s", err.Error())
+			continue
+		}
+		next := address + uint32(length)
+		operand := uint16(0)
+		if length == 3 {
+			operand = uint16(code[1]) | uint16(code[2])<<8
+		}
+
+		jump := func(kind string, target uint32) {
+			if routines[target] && target != start {
+				if depth != 0 {
+					report(address, false, "Jumps to %s with %d bytes pushed", analysis.name(target), depth)
+				}
+				routine.Calls = append(routine.Calls, CallEdge{kind, address, target, depth})
+				return
+			}
+			queue = append(queue, walkPosition{target, depth})
+		}
+		call := func(kind string, target uint16) {
+			resolved, err := analysis.resolve(address, target)
+			if err != nil {
+				report(address, true, "%s not followed: %s", kind, err.Error())
+				return
+			}
+			routine.Calls = append(routine.Calls, CallEdge{kind, address, resolved, depth})
+		}
+		ret := func() {
+			if depth != 0 {
+				report(address, false, "Returns with %d bytes pushed", depth)
+			}
+		}
+
+		switch {
+		case opcode&0xcf == 0xc5:
+			queue = append(queue, walkPosition{next, depth + 2})
+		case opcode&0xcf == 0xc1:
+			if depth < 2 {
+				report(address, false, "POP without a matching PUSH")
+			}
+			queue = append(queue, walkPosition{next, depth - 2})
+		case opcode == 0xcd || opcode&0xe7 == 0xc4:
+			call("CALL", operand)
+			queue = append(queue, walkPosition{next, depth})
+		case opcode&0xc7 == 0xc7:
+			call("RST", uint16(opcode&0x38))
+			queue = append(queue, walkPosition{next, depth})
+		case opcode == 0xc3 || opcode&0xe7 == 0xc2:
+			target, err := analysis.resolve(address, operand)
+			if err != nil {
+				report(address, true, "JP not followed: %s", err.Error())
+			} else {
+				jump("JP", target)
+			}
+			if opcode != 0xc3 {
+				queue = append(queue, walkPosition{next, depth})
+			}
+		case opcode == 0x18 || opcode&0xe7 == 0x20:
+			jump("JR", uint32(int(next)+int(int8(code[1]))))
+			if opcode != 0x18 {
+				queue = append(queue, walkPosition{next, depth})
+			}
+		case opcode == 0xe9:
+			report(address, true, "JP HL not followed")
+		case opcode == 0xc9 || opcode == 0xd9:
+			ret()
+		case opcode&0xe7 == 0xc0:
+			ret()
+			queue = append(queue, walkPosition{next, depth})
+		case opcode == 0x31:
+			// The stack starts again
+			if start == entryPointAddress && analysis.StackTop == 0 {
+				analysis.StackTop = operand
+			}
+			queue = append(queue, walkPosition{next, 0})
+		case opcode == 0xf9:
+			report(address, true, "LD SP, HL: the bytes pushed before are not counted after it")
+			queue = append(queue, walkPosition{next, 0})
+		case opcode == 0xe8:
+			queue = append(queue, walkPosition{next, depth - int(int8(code[1]))})
+		case opcode == 0x33:
+			queue = append(queue, walkPosition{next, depth - 1})
+		case opcode == 0x3b:
+			queue = append(queue, walkPosition{next, depth + 1})
+		default:
+			queue = append(queue, walkPosition{next, depth})
+		}
+	}
+
+	return routine, problems
+}
+
+// Deepest stack of a routine with the routines it calls. A routine calling itself, directly or not,
+// is recursive and its calls to itself are not counted.
+func (analysis *StackAnalysis) depth(address uint32, visiting []uint32) int {
+	routine := analysis.Routines[address]
+	if routine.Depth >= 0 {
+		return routine.Depth
+	}
+
+	depth := routine.LocalDepth
+	visiting = append(visiting, address)
+	for _, edge := range routine.Calls {
+		if i := slices.Index(visiting, edge.Target); i >= 0 {
+			names := []string{}
+			for _, v := range append(visiting[i:], edge.Target) {
+				names = append(names, analysis.Routines[v].Name)
+			}
+			routine.Recursive = true
+			analysis.Problems = append(analysis.Problems, StackProblem{
+				edge.Site,
+				routine.Name,
+				fmt.Sprintf("Recursion: %s", strings.Join(names, " -> ")),
+				false,
+			})
+			continue
+		}
+
+		calleeDepth := analysis.depth(edge.Target, visiting)
+		if edge.Kind != "JP" && edge.Kind != "JR" {
+			// The return address
+			calleeDepth += 2
+		}
+		depth = max(depth, edge.Depth+calleeDepth)
+	}
+
+	routine.Depth = depth
+	return depth
+}
+
+func analyzeStack(rom []byte, labels Labels) *StackAnalysis {
+	analysis := &StackAnalysis{ROM: rom, Labels: labels, Routines: make(map[uint32]*AnalyzedRoutine)}
+
+	analysis.Entries = []EntryPoint{{entryPointAddress, "Start"}}
+	for _, vector := range interruptVectors {
+		// Unused vectors are usually filled with $00 or $ff
+		if int(vector.Address) < len(rom) && rom[vector.Address] != 0x00 && rom[vector.Address] != 0xff {
+			analysis.Entries = append(analysis.Entries, EntryPoint{vector.Address, vector.Name})
+		}
+	}
+
+	// The routines are the entry points and every routine called, which can only be known by
+	// following the code
+	routines := make(map[uint32]bool)
+	for _, entry := range analysis.Entries {
+		routines[entry.Address] = true
+	}
+	for {
+		analysis.Routines = make(map[uint32]*AnalyzedRoutine)
+		analysis.Problems = []StackProblem{}
+		found := false
+		for _, address := range slices.Sorted(maps.Keys(routines)) {
+			routine, problems := analysis.walk(address, routines)
+			routine.Depth = -1
+			analysis.Routines[address] = routine
+			analysis.Problems = append(analysis.Problems, problems...)
+			for _, edge := range routine.Calls {
+				if !routines[edge.Target] {
+					routines[edge.Target] = true
+					found = true
+				}
+			}
+		}
+		if !found {
+			break
+		}
+	}
+
+	for _, entry := range analysis.Entries {
+		analysis.depth(entry.Address, nil)
+	}
+	if analysis.StackTop == 0 {
+		analysis.StackTop = 0xfffe
+	}
+	return analysis
+}
+
+// Deepest stack of the program: the code started at $0100 interrupted by the deepest interrupt
+// (which pushes the return address). Interrupts are supposed not to interrupt each other.
+func (analysis *StackAnalysis) WorstDepth() int {
+	interrupt := 0
+	for _, entry := range analysis.Entries[1:] {
+		interrupt = max(interrupt, analysis.Routines[entry.Address].Depth+2)
+	}
+	return analysis.Routines[entryPointAddress].Depth + interrupt
+}
+
+func (analysis *StackAnalysis) Errors() int {
+	errors := 0
+	for _, problem := range analysis.Problems {
+		if !problem.Warning {
+			errors += 1
+		}
+	}
+	return errors
+}
+
+func (analysis *StackAnalysis) PrintReport() {
+	fmt.Printf("Entry points:\n")
+	for _, entry := range analysis.Entries {
+		routine := analysis.Routines[entry.Address]
+		fmt.Printf("\t%s %-20s %s, %d bytes of stack\n", formatROMAddress(uint(entry.Address)), entry.Name, routine.Name, routine.Depth)
+	}
+
+	worst := analysis.WorstDepth()
+	fmt.Printf(
+		"Worst case: %d bytes, the stack goes from $%04x down to $%04x\n",
+		worst,
+		analysis.StackTop,
+		int(analysis.StackTop)-worst,
+	)
+
+	fmt.Printf("Routines:\n")
+	addresses := slices.Sorted(maps.Keys(analysis.Routines))
+	for _, address := range addresses {
+		routine := analysis.Routines[address]
+		callees := []string{}
+		for _, edge := range routine.Calls {
+			name := analysis.Routines[edge.Target].Name
+			if !slices.Contains(callees, name) {
+				callees = append(callees, name)
+			}
+		}
+		fmt.Printf("\t%s %s: %d bytes (%d itself)", formatROMAddress(uint(address)), routine.Name, routine.Depth, routine.LocalDepth)
+		if len(callees) > 0 {
+			fmt.Printf(", calls %s", strings.Join(callees, ", "))
+		}
+		fmt.Printf("\n")
+	}
+
+	for _, problem := range analysis.Problems {
+		kind := "Error"
+		if problem.Warning {
+			kind = "Warning"
+		}
+		fmt.Printf("%s: %s (in %s): %s\n", kind, formatROMAddress(uint(problem.Address)), problem.Routine, problem.Message)
+	}
+}
+
+// The call graph in the Graphviz DOT format. The entry points have a double border, the tail calls
+// are dashed, the RST are dotted and the recursive routines are red.
+func (analysis *StackAnalysis) WriteDOT(fileName string) error {
+	output := strings.Builder{}
+	fmt.Fprintf(&output, "digraph calls {\n\tnode [shape=box];\n")
+
+	entries := make(map[uint32]bool)
+	for _, entry := range analysis.Entries {
+		entries[entry.Address] = true
+	}
+
+	addresses := slices.Sorted(maps.Keys(analysis.Routines))
+	for _, address := range addresses {
+		routine := analysis.Routines[address]
+		attributes := fmt.Sprintf("label=\"%s\\n%d bytes\"", routine.Name, routine.Depth)
+		if entries[address] {
+			attributes += ", peripheries=2"
+		}
+		if routine.Recursive {
+			attributes += ", color=red"
+		}
+		fmt.Fprintf(&output, "\t\"%s\" [%s];\n", formatROMAddress(uint(address)), attributes)
+	}
+
+	for _, address := range addresses {
+		for _, edge := range analysis.Routines[address].Calls {
+			style := "solid"
+			switch edge.Kind {
+			case "JP", "JR":
+				style = "dashed"
+			case "RST":
+				style = "dotted"
+			}
+			fmt.Fprintf(
+				&output,
+				"\t\"%s\" -> \"%s\" [label=\"%s\", style=%s];\n",
+				formatROMAddress(uint(address)),
+				formatROMAddress(uint(edge.Target)),
+				edge.Kind,
+				style,
+			)
+		}
+	}
+
+	fmt.Fprintf(&output, "}\n")
+	return os.WriteFile(fileName, []byte(output.String()), 0o644)
+}
+
+func analyzeMain(args []string) {
+	flags := flag.NewFlagSet("analyze", flag.ExitOnError)
+	options := Options{}
+	addAssemblerFlags(flags, &options, nil)
+	dotFileName := flags.String("dot", "", "Write the call graph in the Graphviz DOT format in this file")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gbasm analyze [-relax] [-I dir]... [-list listing_file] [-map map_file] [-v] [-max-fill bank=percent]... [-dot dot_file] [input_file]\n")
+		fmt.Fprintf(os.Stderr, "Assembles the input file and prints the stack used by each routine\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	options.Sources = &SourceFiles{}
+	options.Quiet = true
+	labels := Labels{}
+	options.Symbols = &labels
+
+	rom, err := assembleROM(flags.Arg(0), options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	analysis := analyzeStack(rom, labels)
+	analysis.PrintReport()
+
+	if *dotFileName != "" {
+		err = analysis.WriteDOT(*dotFileName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error while writing the DOT file: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if analysis.Errors() > 0 {
+		os.Exit(1)
+	}
+}
+
+// Size of the instruction at the start of code, or an error when code doesn't start with an
+// instruction
+func decodeInstruction(code []byte) (int, error) {
+	opcode := code[0]
+	switch opcode {
+	case 0xdb, 0xdd, 0xe3, 0xe4, 0xeb, 0xec, 0xed, 0xf4, 0xfc, 0xfd:
+		return 0, fmt.Errorf("$%02x is not an instruction", opcode)
+	}
+
+	length := instructionLength(opcode)
+	if len(code) < length {
+		return 0, fmt.Errorf("The instruction $%02x is cut", opcode)
+	}
+	return length, nil
+}
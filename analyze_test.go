@@ -0,0 +1,157 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Assembles the source and analyzes the stack of the ROM with its labels
+func analyzeTestSource(t *testing.T, source string) *StackAnalysis {
+	t.Helper()
+	labels := Labels{}
+	rom, err := parseFile(filepath.Join(t.TempDir(), "main.gbasm"), []byte(source), 0, Options{
+		Quiet:    true,
+		Sources:  &SourceFiles{},
+		Warnings: &[]LintWarning{},
+		Symbols:  &labels,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return analyzeStack(rom, labels)
+}
+
+// The messages of the problems found in a routine
+func routineProblems(analysis *StackAnalysis, routine string) []string {
+	messages := []string{}
+	for _, problem := range analysis.Problems {
+		if problem.Routine == routine {
+			messages = append(messages, problem.Message)
+		}
+	}
+	return messages
+}
+
+func TestStackUnbalanced(t *testing.T) {
+	analysis := analyzeTestSource(t, `.PADTO $100
+Start:
+	LD SP, $d000
+	CALL =Balanced
+	CALL =Unbalanced
+	CALL =Unmatched
+	.loop:
+		JR =.loop
+Balanced:
+	PUSH BC
+	PUSH DE
+	CALL =Unmatched
+	POP DE
+	POP BC
+	RET
+Unbalanced:
+	PUSH AF
+	RET
+Unmatched:
+	POP HL
+	RET
+`)
+
+	if problems := routineProblems(analysis, "BALANCED"); len(problems) != 0 {
+		t.Errorf("Problems found in a balanced routine: %v", problems)
+	}
+	if problems := routineProblems(analysis, "UNBALANCED"); strings.Join(problems, ", ") != "Returns with 2 bytes pushed" {
+		t.Errorf("Got the problems %v for the PUSH without a POP", problems)
+	}
+	if problems := routineProblems(analysis, "UNMATCHED"); len(problems) == 0 || problems[0] != "POP without a matching PUSH" {
+		t.Errorf("Got the problems %v for the POP without a PUSH", problems)
+	}
+	if analysis.Errors() == 0 {
+		t.Error("The unbalanced routines are not errors")
+	}
+
+	// 4 bytes pushed by Balanced and the return address of its call to Unmatched
+	balanced := analysis.Routines[uint32(analysis.Labels["BALANCED"])]
+	if balanced.LocalDepth != 4 || balanced.Depth != 6 {
+		t.Errorf("Balanced uses %d bytes (%d itself) instead of 6 (4 itself)", balanced.Depth, balanced.LocalDepth)
+	}
+	if analysis.StackTop != 0xd000 || analysis.WorstDepth() != 8 {
+		t.Errorf("The stack goes down %d bytes from $%04x instead of 8 from $d000", analysis.WorstDepth(), analysis.StackTop)
+	}
+}
+
+const recursiveSource = `.PADTO $08
+Reset:
+	RET
+.PADTO $100
+Start:
+	CALL =Even
+	RST 1
+	JP =Even
+.PADTO $140
+Even:
+	DEC A
+	RET Z
+	PUSH BC
+	CALL =Odd
+	POP BC
+	RET
+Odd:
+	DEC A
+	RET Z
+	JP =Even
+`
+
+func TestStackRecursion(t *testing.T) {
+	analysis := analyzeTestSource(t, recursiveSource)
+
+	even := analysis.Routines[uint32(analysis.Labels["EVEN"])]
+	odd := analysis.Routines[uint32(analysis.Labels["ODD"])]
+	// The routine calling back is the one marked
+	if even.Recursive || !odd.Recursive {
+		t.Errorf("Even recursive: %v, Odd recursive: %v", even.Recursive, odd.Recursive)
+	}
+	recursions := []string{}
+	for _, problem := range analysis.Problems {
+		if strings.HasPrefix(problem.Message, "Recursion: ") {
+			recursions = append(recursions, problem.Message)
+		}
+	}
+	if strings.Join(recursions, ", ") != "Recursion: EVEN -> ODD -> EVEN" {
+		t.Errorf("Got the recursions %v", recursions)
+	}
+	// The call back to Even is not counted: its PUSH and the return address of the CALL to Odd
+	if even.Depth != 4 {
+		t.Errorf("Even uses %d bytes instead of 4", even.Depth)
+	}
+}
+
+func TestStackDOT(t *testing.T) {
+	analysis := analyzeTestSource(t, recursiveSource)
+	path := filepath.Join(t.TempDir(), "calls.dot")
+	if err := analysis.WriteDOT(path); err != nil {
+		t.Fatal(err)
+	}
+	dot, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"digraph calls {\n",
+		"\"00:0100\" [label=\"START\\n6 bytes\", peripheries=2];",
+		"\"00:0140\" [label=\"EVEN\\n4 bytes\"];",
+		"\"00:0148\" [label=\"ODD\\n0 bytes\", color=red];",
+		"\"00:0100\" -> \"00:0140\" [label=\"CALL\", style=solid];",
+		"\"00:0100\" -> \"00:0008\" [label=\"RST\", style=dotted];",
+		"\"00:0100\" -> \"00:0140\" [label=\"JP\", style=dashed];",
+		"\"00:0140\" -> \"00:0148\" [label=\"CALL\", style=solid];",
+		"\"00:0148\" -> \"00:0140\" [label=\"JP\", style=dashed];",
+	}
+	for _, line := range expected {
+		if !strings.Contains(string(dot), line) {
+			t.Errorf("%q not found in\n%s", line, dot)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// The wave RAM of channel 3 holds 32 samples of 4 bits
+const waveRAMSamples = 32
+
+type WaveOptions struct {
+	// Sample rate of the stream, or 0 for a single wave RAM pattern
+	Rate      int
+	Normalize bool
+	Dither    bool
+	SizeName  string
+}
+
+func parseWaveOptions(filePath string, parameters []string) (WaveOptions, error) {
+	options := WaveOptions{SizeName: constantNameFromFile(filePath, "SIZE")}
+
+	for _, parameter := range parameters {
+		key, value, hasValue := strings.Cut(strings.ToUpper(parameter), "=")
+		switch {
+		case key == "NORMALIZE" && !hasValue:
+			options.Normalize = true
+		case key == "DITHER" && !hasValue:
+			options.Dither = true
+		case key == "RATE" && hasValue:
+			rate, err := strconv.ParseUint(value, 0, 32)
+			if err != nil || rate == 0 {
+				return options, fmt.Errorf("RATE must be a sample rate in Hz, not \"%s\"", value)
+			}
+			options.Rate = int(rate)
+		case key == "SIZE" && hasValue:
+			options.SizeName = value
+		default:
+			return options, fmt.Errorf(
+				"Unknown wave option \"%s\" (expected RATE=hz, NORMALIZE, DITHER or SIZE=name)",
+				parameter,
+			)
+		}
+	}
+
+	return options, nil
+}
+
+// Reads the samples of a PCM WAV file (8, 16, 24 or 32 bits integers or 32 bits floats), with the
+// channels mixed together, between -1 and 1
+func decodeWAV(filePath string, content []byte) ([]float64, int, error) {
+	if len(content) < 12 || string(content[0:4]) != "RIFF" || string(content[8:12]) != "WAVE" {
+		return nil, 0, fmt.Errorf("%s is not a WAV file", filePath)
+	}
+
+	var format, channels, bits uint16
+	var rate uint32
+	var data []byte
+	hasFormat := false
+
+	for chunk := content[12:]; len(chunk) >= 8; {
+		id := string(chunk[0:4])
+		// Files written while recording can announce more data than there is
+		size := min(uint64(binary.LittleEndian.Uint32(chunk[4:8])), uint64(len(chunk)-8))
+		body := chunk[8 : 8+size]
+
+		switch id {
+		case "fmt ":
+			if len(body) < 16 {
+				return nil, 0, fmt.Errorf("The format chunk of %s is too short", filePath)
+			}
+			format = binary.LittleEndian.Uint16(body[0:2])
+			channels = binary.LittleEndian.Uint16(body[2:4])
+			rate = binary.LittleEndian.Uint32(body[4:8])
+			bits = binary.LittleEndian.Uint16(body[14:16])
+			// WAVE_FORMAT_EXTENSIBLE stores the real format at the start of the sub format
+			if format == 0xfffe && len(body) >= 26 {
+				format = binary.LittleEndian.Uint16(body[24:26])
+			}
+			hasFormat = true
+		case "data":
+			data = body
+		}
+
+		// Chunks are padded to an even size
+		next := 8 + size + size%2
+		if next > uint64(len(chunk)) {
+			break
+		}
+		chunk = chunk[next:]
+	}
+
+	if !hasFormat || data == nil {
+		return nil, 0, fmt.Errorf("%s doesn't have a format and a data chunk", filePath)
+	}
+	if channels == 0 || rate == 0 {
+		return nil, 0, fmt.Errorf("%s doesn't have any channel or has a sample rate of 0", filePath)
+	}
+
+	var sample func(b []byte) float64
+	switch {
+	case format == 1 && bits == 8:
+		sample = func(b []byte) float64 { return (float64(b[0]) - 128) / 128 }
+	case format == 1 && bits == 16:
+		sample = func(b []byte) float64 { return float64(int16(binary.LittleEndian.Uint16(b))) / (1 << 15) }
+	case format == 1 && bits == 24:
+		sample = func(b []byte) float64 {
+			return float64(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24)>>8) / (1 << 23)
+		}
+	case format == 1 && bits == 32:
+		sample = func(b []byte) float64 { return float64(int32(binary.LittleEndian.Uint32(b))) / (1 << 31) }
+	case format == 3 && bits == 32:
+		sample = func(b []byte) float64 { return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))) }
+	default:
+		return nil, 0, fmt.Errorf(
+			"%s uses an unsupported sample format (%d bits, format %d): only PCM and 32 bits float are supported",
+			filePath,
+			bits,
+			format,
+		)
+	}
+
+	frameSize := int(bits/8) * int(channels)
+	samples := make([]float64, len(data)/frameSize)
+	for i := range samples {
+		frame := data[i*frameSize : (i+1)*frameSize]
+		for channel := 0; channel < int(channels); channel++ {
+			samples[i] += sample(frame[channel*int(bits/8):])
+		}
+		samples[i] /= float64(channels)
+	}
+	return samples, int(rate), nil
+}
+
+// Resamples to length samples. When there are less output samples than input samples, each output
+// sample is the average of the input samples it covers, otherwise the input is interpolated.
+func resample(samples []float64, length int) []float64 {
+	result := make([]float64, length)
+	if len(samples) == 0 {
+		return result
+	}
+
+	step := float64(len(samples)) / float64(length)
+	for i := range result {
+		if step > 1 {
+			start := int(float64(i) * step)
+			end := max(int(float64(i+1)*step), start+1)
+			sum := 0.0
+			for _, s := range samples[start:min(end, len(samples))] {
+				sum += s
+			}
+			result[i] = sum / float64(min(end, len(samples))-start)
+			continue
+		}
+
+		position := float64(i) * step
+		index := int(position)
+		next := min(index+1, len(samples)-1)
+		fraction := position - float64(index)
+		result[i] = samples[index]*(1-fraction) + samples[next]*fraction
+	}
+	return result
+}
+
+// Converts samples between -1 and 1 to 4 bits samples packed 2 per byte, the first one in the high
+// nibble like in the wave RAM
+func packSamples(samples []float64, dither bool) []byte {
+	// The noise is always the same, so the ROM doesn't change between assemblies
+	random := rand.New(rand.NewSource(1))
+
+	nibbles := make([]uint8, len(samples))
+	for i, s := range samples {
+		v := (s + 1) / 2 * 15
+		if dither {
+			// Triangular noise of 1 step
+			v += random.Float64() - random.Float64()
+		}
+		nibbles[i] = uint8(min(max(math.Round(v), 0), 15))
+	}
+
+	// An odd number of samples is completed by silence
+	if len(nibbles)%2 != 0 {
+		nibbles = append(nibbles, 8)
+	}
+
+	result := make([]byte, len(nibbles)/2)
+	for i := range result {
+		result[i] = nibbles[i*2]<<4 | nibbles[i*2+1]
+	}
+	return result
+}
+
+// Reads a WAV file (.INCWAVE) and converts it to a wave RAM pattern (the whole file is one period
+// of the wave) or, with RATE, to a stream of 4 bits samples
+func includeWave(state *ProgramState, arguments string) ([]byte, error) {
+	filePath, parameters, err := parseFileArguments(arguments)
+	if err != nil {
+		return nil, err
+	}
+
+	options, err := parseWaveOptions(filePath, parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	filePath, err = resolveInclude(state, filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := state.Sources.Read(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	samples, rate, err := decodeWAV(filePath, content)
+	if err != nil {
+		return nil, err
+	}
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("%s doesn't have any sample", filePath)
+	}
+
+	length := waveRAMSamples
+	if options.Rate != 0 {
+		length = max(int(int64(len(samples))*int64(options.Rate)/int64(rate)), 1)
+	}
+	samples = resample(samples, length)
+
+	if options.Normalize {
+		peak := 0.0
+		for _, s := range samples {
+			peak = max(peak, math.Abs(s))
+		}
+		if peak > 0 {
+			for i := range samples {
+				samples[i] /= peak
+			}
+		}
+	}
+
+	result := packSamples(samples, options.Dither)
+	if options.Rate != 0 {
+		err = defineConstant(state, options.SizeName, len(result))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
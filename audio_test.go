@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+)
+
+// A WAV file with a format chunk and a data chunk, after the other chunks given
+func wavFile(format uint16, channels uint16, rate uint32, bits uint16, data []byte, chunks ...[]byte) []byte {
+	body := []byte("WAVE")
+	formatChunk := binary.LittleEndian.AppendUint16(nil, format)
+	formatChunk = binary.LittleEndian.AppendUint16(formatChunk, channels)
+	formatChunk = binary.LittleEndian.AppendUint32(formatChunk, rate)
+	formatChunk = binary.LittleEndian.AppendUint32(formatChunk, rate*uint32(channels*bits/8))
+	formatChunk = binary.LittleEndian.AppendUint16(formatChunk, channels*bits/8)
+	formatChunk = binary.LittleEndian.AppendUint16(formatChunk, bits)
+
+	for _, chunk := range append(chunks, wavChunk("fmt ", formatChunk), wavChunk("data", data)) {
+		body = append(body, chunk...)
+	}
+	header := binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(len(body)))
+	return append(header, body...)
+}
+
+func wavChunk(id string, body []byte) []byte {
+	chunk := binary.LittleEndian.AppendUint32([]byte(id), uint32(len(body)))
+	chunk = append(chunk, body...)
+	if len(body)%2 != 0 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+// The samples as 16 bits little endian integers
+func pcm16(samples ...int16) []byte {
+	data := []byte{}
+	for _, s := range samples {
+		data = binary.LittleEndian.AppendUint16(data, uint16(s))
+	}
+	return data
+}
+
+func TestDecodeWAV(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     []byte
+		expected []float64
+	}{
+		{"8 bits mono", wavFile(1, 1, 8000, 8, []byte{0x80, 0xc0, 0x00}), []float64{0, 0.5, -1}},
+		{"16 bits mono", wavFile(1, 1, 8000, 16, pcm16(0, 0x4000, -0x8000)), []float64{0, 0.5, -1}},
+		{"8 bits stereo", wavFile(1, 2, 8000, 8, []byte{0xc0, 0x40, 0xc0, 0x80}), []float64{0, 0.25}},
+		{"16 bits stereo", wavFile(1, 2, 8000, 16, pcm16(0x4000, 0x4000, -0x8000, 0)), []float64{0.5, -0.5}},
+		{
+			"32 bits float",
+			wavFile(3, 1, 8000, 32, binary.LittleEndian.AppendUint32(nil, math.Float32bits(-0.25))),
+			[]float64{-0.25},
+		},
+		{
+			"odd sized chunk before the format",
+			wavFile(1, 1, 8000, 8, []byte{0xc0}, wavChunk("LIST", []byte{1, 2, 3})),
+			[]float64{0.5},
+		},
+	}
+	for _, test := range tests {
+		samples, rate, err := decodeWAV("test.wav", test.file)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if rate != 8000 {
+			t.Errorf("%s: sample rate %d instead of 8000", test.name, rate)
+		}
+		if len(samples) != len(test.expected) {
+			t.Errorf("%s: got %v, expected %v", test.name, samples, test.expected)
+			continue
+		}
+		for i := range samples {
+			if math.Abs(samples[i]-test.expected[i]) > 1e-9 {
+				t.Errorf("%s: got %v, expected %v", test.name, samples, test.expected)
+				break
+			}
+		}
+	}
+
+	// A data chunk announcing more bytes than the file has, like a file still being recorded
+	file := wavFile(1, 1, 8000, 8, []byte{0xc0, 0x40})
+	binary.LittleEndian.PutUint32(file[len(file)-6:], 100)
+	if samples, _, err := decodeWAV("test.wav", file); err != nil || len(samples) != 2 {
+		t.Errorf("Truncated file: got %v, %v, expected 2 samples", samples, err)
+	}
+
+	errors := []struct {
+		file []byte
+		err  string
+	}{
+		{[]byte("RIFF\x00\x00\x00\x00AVI "), "is not a WAV file"},
+		{wavFile(1, 1, 8000, 12, []byte{0, 0}), "unsupported sample format (12 bits, format 1)"},
+		{wavFile(1, 0, 8000, 8, []byte{0}), "doesn't have any channel"},
+		{append([]byte("RIFF\x04\x00\x00\x00WAVE"), wavChunk("data", []byte{0})...), "doesn't have a format and a data chunk"},
+	}
+	for _, test := range errors {
+		_, _, err := decodeWAV("test.wav", test.file)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Expected an error containing %q, got %v", test.err, err)
+		}
+	}
+}
+
+func TestResample(t *testing.T) {
+	tests := []struct {
+		samples  []float64
+		length   int
+		expected []float64
+	}{
+		// Fewer samples: the average of the samples covered
+		{[]float64{1, 0, -1, -1}, 2, []float64{0.5, -1}},
+		{[]float64{1, 1, 1}, 2, []float64{1, 1}},
+		// More samples: interpolated
+		{[]float64{0, 1}, 4, []float64{0, 0.5, 1, 1}},
+		{[]float64{0.5}, 3, []float64{0.5, 0.5, 0.5}},
+		{[]float64{}, 2, []float64{0, 0}},
+	}
+	for _, test := range tests {
+		result := resample(test.samples, test.length)
+		if len(result) != len(test.expected) {
+			t.Errorf("resample(%v, %d) = %v, expected %v", test.samples, test.length, result, test.expected)
+			continue
+		}
+		for i := range result {
+			if math.Abs(result[i]-test.expected[i]) > 1e-9 {
+				t.Errorf("resample(%v, %d) = %v, expected %v", test.samples, test.length, result, test.expected)
+				break
+			}
+		}
+	}
+}
+
+func TestPackSamples(t *testing.T) {
+	// -1 is 0, 1 is 15 and an odd number of samples is completed by silence (8)
+	result := packSamples([]float64{-1, 1, 0, 0.5, -0.5}, false)
+	expected := []byte{0x0f, 0x8b, 0x48}
+	if !bytes.Equal(result, expected) {
+		t.Errorf("Got % x, expected % x", result, expected)
+	}
+
+	silence := make([]float64, 64)
+	dithered := packSamples(silence, true)
+	if !bytes.Equal(dithered, packSamples(silence, true)) {
+		t.Errorf("The dithering changes between 2 conversions")
+	}
+	if bytes.Equal(dithered, packSamples(silence, false)) {
+		t.Errorf("The dithering didn't add any noise")
+	}
+	for _, b := range dithered {
+		for _, nibble := range []uint8{b >> 4, b & 0xf} {
+			// Triangular noise of 1 step around 7.5
+			if nibble < 7 || nibble > 9 {
+				t.Errorf("Dithered silence contains %d: % x", nibble, dithered)
+			}
+		}
+	}
+
+	// The noise doesn't go past the limits
+	for _, b := range packSamples([]float64{-1, -1, 1, 1}, true) {
+		if b != 0x00 && b != 0x01 && b != 0x10 && b != 0x11 && b != 0xff && b != 0xef && b != 0xfe && b != 0xee {
+			t.Errorf("Dithered limits became $%02x", b)
+		}
+	}
+}
+
+func TestIncludeWave(t *testing.T) {
+	// A square wave of 64 samples: one period, loud or quiet
+	loud, quiet := []byte{}, []int16{}
+	for i := 0; i < 64; i++ {
+		// quiet is stereo, with the same samples on both channels
+		if i < 32 {
+			loud = append(loud, 0xff)
+			quiet = append(quiet, 0x4000, 0x4000)
+		} else {
+			loud = append(loud, 0x00)
+			quiet = append(quiet, -0x4000, -0x4000)
+		}
+	}
+	files := map[string][]byte{
+		"loud.wav":   wavFile(1, 1, 8000, 8, loud),
+		"quiet.wav":  wavFile(1, 2, 8000, 16, pcm16(quiet...)),
+		"stream.wav": wavFile(1, 1, 8000, 8, []byte{0x00, 0x00, 0xff, 0xff, 0x00, 0x00, 0xff, 0xff, 0x00, 0x00}),
+	}
+	square := append(bytes.Repeat([]byte{0xff}, 8), bytes.Repeat([]byte{0x00}, 8)...)
+
+	tests := []struct {
+		source   string
+		expected []byte
+	}{
+		// The whole file is resampled to the 32 samples of the wave RAM
+		{".INCWAVE \"loud.wav\"\n", square},
+		{".INCWAVE \"quiet.wav\"\n", append(bytes.Repeat([]byte{0xbb}, 8), bytes.Repeat([]byte{0x44}, 8)...)},
+		{".INCWAVE \"quiet.wav\", NORMALIZE\n", square},
+		// A stream of 10 samples at 8000 Hz is 5 samples at 4000 Hz, completed by silence
+		{".INCWAVE \"stream.wav\", RATE=4000, SIZE=LENGTH\n\tLD A, $LENGTH\n", []byte{0x0f, 0x0f, 0x08, 0x3e, 0x03}},
+		{".INCWAVE \"stream.wav\", RATE=8000\n\tLD A, $STREAM_SIZE\n", []byte{0x00, 0xff, 0x00, 0xff, 0x00, 0x3e, 0x05}},
+	}
+	for _, test := range tests {
+		result, err := assembleTestFile(t, test.source, files)
+		if err != nil {
+			t.Errorf("%q: %v", test.source, err)
+		} else if !bytes.Equal(result, test.expected) {
+			t.Errorf("%q: got % x, expected % x", test.source, result, test.expected)
+		}
+	}
+
+	for _, parameter := range []string{"RATE=0", "LOOP"} {
+		_, err := assembleTestFile(t, ".INCWAVE \"loud.wav\", "+parameter+"\n", files)
+		if err == nil {
+			t.Errorf("Expected an error for %s", parameter)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A maximum number of bytes for a bank or for the code and data starting at a label, declared by
+// .BUDGET
+type FillBudget struct {
+	File string
+	Line int
+	// ROMn or the label given to .BUDGET
+	Region string
+	// The bank of ROMn, -1 for a label
+	Bank    int
+	Address uint
+	Max     uint
+	// Only warn when the budget is exceeded
+	Warn bool
+}
+
+type FillBudgets struct {
+	Budgets []FillBudget
+}
+
+// The maximum fill of a bank in percent, given by -max-fill or -warn-fill
+type FillLimit struct {
+	Bank    int
+	Percent uint
+}
+
+type FillLimits []FillLimit
+
+func (limits *FillLimits) String() string {
+	parts := []string{}
+	for _, limit := range *limits {
+		parts = append(parts, fmt.Sprintf("%d=%d", limit.Bank, limit.Percent))
+	}
+	return strings.Join(parts, ",")
+}
+
+// bank=percent, like 0=90. The bank can also be written ROMn.
+func (limits *FillLimits) Set(value string) error {
+	bankName, percentName, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("expected bank=percent, like 0=90")
+	}
+	bank, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(bankName), "ROM"), 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid bank \"%s\"", bankName)
+	}
+	percent, err := strconv.ParseUint(strings.TrimSuffix(percentName, "%"), 10, 8)
+	if err != nil || percent > 100 {
+		return fmt.Errorf("invalid percentage \"%s\"", percentName)
+	}
+	*limits = append(*limits, FillLimit{int(bank), uint(percent)})
+	return nil
+}
+
+// .BUDGET ROMn|=LABEL, max[, WARN]
+func declareFillBudget(state *ProgramState, arguments string, lineNb int, lastAbsoluteLabel string) error {
+	parts := strings.Split(arguments, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	if len(parts) < 2 || len(parts) > 3 {
+		return fmt.Errorf(".BUDGET takes a bank (ROM0, ROM1, ...) or a label, the maximum number of bytes and optionally WARN")
+	}
+
+	budget := FillBudget{
+		File:   state.IncludeStack[len(state.IncludeStack)-1],
+		Line:   lineNb + 1,
+		Region: parts[0],
+		Bank:   -1,
+	}
+
+	region := strings.ToUpper(parts[0])
+	if strings.HasPrefix(region, "=") {
+		address, err := ROMAddress(&state.Labels, lastAbsoluteLabel, &state.Defs, 0, region)
+		if err != nil {
+			return err
+		}
+		budget.Address = uint(address)
+	} else {
+		bank, err := strconv.ParseUint(strings.TrimPrefix(region, "ROM"), 10, 16)
+		if !strings.HasPrefix(region, "ROM") || err != nil {
+			return fmt.Errorf("Invalid .BUDGET region \"%s\" (expected ROM0, ROM1, ... or a label)", parts[0])
+		}
+		budget.Bank = int(bank)
+	}
+
+	value, err := Raw16(&state.Labels, lastAbsoluteLabel, &state.Defs, 0, strings.ToUpper(parts[1]))
+	if err != nil {
+		return err
+	}
+	budget.Max = uint(value)
+
+	if len(parts) == 3 {
+		if strings.ToUpper(parts[2]) != "WARN" {
+			return fmt.Errorf("Unknown .BUDGET option \"%s\" (expected WARN)", parts[2])
+		}
+		budget.Warn = true
+	}
+
+	if state.FillBudgets != nil {
+		state.FillBudgets.Budgets = append(state.FillBudgets.Budgets, budget)
+	}
+	return nil
+}
+
+// Number of bytes from the address to the next label (without a "."), the next padding or the end of
+// the data of its bank
+func (memoryMap *MemoryMap) RegionSize(rom []byte, labels Labels, address uint) uint {
+	end := min(address/bankSize*bankSize+bankSize, uint(len(rom)))
+	for name, labelAddress := range labels {
+		if !strings.Contains(name, ".") && labelAddress > address {
+			end = min(end, labelAddress)
+		}
+	}
+	for _, padding := range memoryMap.Padding {
+		if padding.Address > address && padding.Size > 0 {
+			end = min(end, padding.Address)
+		}
+	}
+	return max(end, address) - address
+}
+
+// Checks the .BUDGET of the program and the limits of -max-fill (errors) and -warn-fill (warnings)
+func checkFillBudgets(
+	budgets *FillBudgets,
+	maxFill FillLimits,
+	warnFill FillLimits,
+	memoryMap *MemoryMap,
+	rom []byte,
+	labels Labels,
+) error {
+	banks := memoryMap.Banks(rom)
+	used := func(bank int) uint {
+		if bank < len(banks) {
+			return banks[bank].Used
+		}
+		return 0
+	}
+
+	errors := []string{}
+	for _, budget := range budgets.Budgets {
+		size := uint(0)
+		name := ""
+		if budget.Bank >= 0 {
+			size = used(budget.Bank)
+			name = fmt.Sprintf("Bank %02x", budget.Bank)
+		} else {
+			size = memoryMap.RegionSize(rom, labels, budget.Address)
+			name = fmt.Sprintf("%s (%s)", budget.Region, formatROMAddress(budget.Address))
+		}
+		if size <= budget.Max {
+			continue
+		}
+
+		message := fmt.Sprintf(
+			"File %s, line %d: %s uses %d bytes, more than the %d of .BUDGET",
+			budget.File,
+			budget.Line,
+			name,
+			size,
+			budget.Max,
+		)
+		if budget.Warn {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", message)
+		} else {
+			errors = append(errors, message)
+		}
+	}
+
+	for _, limits := range []struct {
+		Limits FillLimits
+		Flag   string
+		Warn   bool
+	}{{maxFill, "-max-fill", false}, {warnFill, "-warn-fill", true}} {
+		for _, limit := range limits.Limits {
+			size := used(limit.Bank)
+			if size*100 <= limit.Percent*bankSize {
+				continue
+			}
+
+			message := fmt.Sprintf(
+				"Bank %02x is %.1f%% full (%d bytes), more than the %d%% of %s",
+				limit.Bank,
+				float64(size*100)/bankSize,
+				size,
+				limit.Percent,
+				limits.Flag,
+			)
+			if limits.Warn {
+				fmt.Fprintf(os.Stderr, "Warning: %s\n", message)
+			} else {
+				errors = append(errors, message)
+			}
+		}
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const budgetSource = `.BUDGET ROM0, $ROM0_MAX
+.BUDGET =Routine, $ROUTINE_MAX
+Routine:
+	NOP
+	NOP
+	.loop:
+		DEC A
+		JR NZ, =.loop
+Data:
+	.DB 1, 2, 3, 4, 5
+`
+
+func TestBudgets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "main.gbasm")
+	assemble := func(rom0 string, routine string) error {
+		defines := ".DEFINE ROM0_MAX " + rom0 + "\n.DEFINE ROUTINE_MAX " + routine + "\n"
+		_, err := parseFile(path, []byte(defines+budgetSource), 0, Options{
+			Quiet:    true,
+			Sources:  &SourceFiles{},
+			Warnings: &[]LintWarning{},
+		})
+		return err
+	}
+
+	// Routine goes up to Data, with its local label
+	if err := assemble("10", "5"); err != nil {
+		t.Errorf("Budgets of exactly the size used: %v", err)
+	}
+
+	err := assemble("9", "4")
+	expected := "File " + path + ", line 3: Bank 00 uses 10 bytes, more than the 9 of .BUDGET\n" +
+		"File " + path + ", line 4: =Routine (00:0000) uses 5 bytes, more than the 4 of .BUDGET"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Got the error\n%v\nexpected\n%s", err, expected)
+	}
+
+	for _, arguments := range []string{"ROM0", "WRAM, 4", "ROM0, 4, ERROR"} {
+		_, err := assembleTestFile(t, ".BUDGET "+arguments+"\n", nil)
+		if err == nil {
+			t.Errorf("Expected an error for .BUDGET %s", arguments)
+		}
+	}
+}
+
+func TestMaxFill(t *testing.T) {
+	dir := t.TempDir()
+	// 75% of bank 0
+	writeTestFiles(t, dir, map[string]string{
+		"main.gbasm": ".INCLUDEBIN \"data.bin\"\n.ALIGN\n\tNOP\n",
+		"data.bin":   strings.Repeat("\x01", 0x3000),
+	})
+
+	tests := []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"-max-fill", "0=75"}, ""},
+		{[]string{"-max-fill", "ROM1=1", "-max-fill", "0=74%"}, "Bank 00 is 75.0% full (12288 bytes), more than the 74% of -max-fill"},
+		{[]string{"-max-fill", "1=0"}, "Bank 01 is 0.0% full (1 bytes), more than the 0% of -max-fill"},
+		// A bank past the end of the ROM is empty
+		{[]string{"-max-fill", "2=0"}, ""},
+	}
+	for _, test := range tests {
+		flags := flag.NewFlagSet("build", flag.ContinueOnError)
+		options := Options{Quiet: true, Sources: &SourceFiles{}, Warnings: &[]LintWarning{}}
+		addAssemblerFlags(flags, &options, nil)
+		if err := flags.Parse(test.args); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := assembleROM(filepath.Join(dir, "main.gbasm"), options)
+		if test.err == "" && err != nil {
+			t.Errorf("%v: %v", test.args, err)
+		} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%v: expected the error %q, got %v", test.args, test.err, err)
+		}
+	}
+
+	for _, value := range []string{"90", "RAM0=90", "0=101"} {
+		limits := FillLimits{}
+		if limits.Set(value) == nil {
+			t.Errorf("-max-fill %s was accepted", value)
+		}
+	}
+}
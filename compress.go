@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// LZ format: a control byte followed by its data, until a control byte of 0.
+//   - $01 to $7f: that many bytes follow and are copied as is
+//   - $80 to $ff: (control & $7f) + 3 bytes are copied from earlier in the output. The distance
+//     back is stored negated on 2 bytes (little endian) after the control byte.
+const (
+	lzMinMatch    = 3
+	lzMaxMatch    = 0x7f + lzMinMatch
+	lzMaxLiterals = 0x7f
+	lzMaxDistance = 0xffff
+	// Number of earlier positions tried for each match, to keep large files fast to compress
+	lzMaxCandidates = 256
+)
+
+// RLE format: a control byte followed by its data, until a control byte of 0.
+//   - $01 to $7f: that many bytes follow and are copied as is
+//   - $81 to $ff: the next byte is repeated (control & $7f) times
+const (
+	rleMinRun     = 3
+	rleMaxRun     = 0x7f
+	rleMaxLiteral = 0x7f
+)
+
+func appendLiterals(result []byte, literals []byte, maxLiterals int) []byte {
+	for len(literals) > 0 {
+		n := min(len(literals), maxLiterals)
+		result = append(result, uint8(n))
+		result = append(result, literals[:n]...)
+		literals = literals[n:]
+	}
+	return result
+}
+
+// Greedy LZ77: each position takes the longest match among the last positions starting with the
+// same 3 bytes
+func compressLZ(data []byte) []byte {
+	result := []byte{}
+	positions := make(map[[3]byte][]int)
+	literalsStart := 0
+
+	addPosition := func(i int) {
+		if i+lzMinMatch <= len(data) {
+			key := [3]byte{data[i], data[i+1], data[i+2]}
+			positions[key] = append(positions[key], i)
+		}
+	}
+
+	for i := 0; i < len(data); {
+		bestLength, bestDistance := 0, 0
+		if i+lzMinMatch <= len(data) {
+			candidates := positions[[3]byte{data[i], data[i+1], data[i+2]}]
+			for c := len(candidates) - 1; c >= 0 && c >= len(candidates)-lzMaxCandidates; c-- {
+				start := candidates[c]
+				if i-start > lzMaxDistance {
+					break
+				}
+
+				length := 0
+				for length < lzMaxMatch && i+length < len(data) && data[start+length] == data[i+length] {
+					length++
+				}
+				if length > bestLength {
+					bestLength, bestDistance = length, i-start
+				}
+			}
+		}
+
+		// A match of 3 bytes is as long as the literals and would split the literal run
+		if bestLength <= lzMinMatch {
+			addPosition(i)
+			i++
+			continue
+		}
+
+		result = appendLiterals(result, data[literalsStart:i], lzMaxLiterals)
+		negated := uint16(-bestDistance)
+		result = append(result, 0x80|uint8(bestLength-lzMinMatch), uint8(negated&0xff), uint8(negated>>8))
+		for j := i; j < i+bestLength; j++ {
+			addPosition(j)
+		}
+		i += bestLength
+		literalsStart = i
+	}
+
+	result = appendLiterals(result, data[literalsStart:], lzMaxLiterals)
+	return append(result, 0)
+}
+
+func compressRLE(data []byte) []byte {
+	result := []byte{}
+	literalsStart := 0
+	for i := 0; i < len(data); {
+		run := 1
+		for run < rleMaxRun && i+run < len(data) && data[i+run] == data[i] {
+			run++
+		}
+
+		if run < rleMinRun {
+			i += run
+			continue
+		}
+
+		result = appendLiterals(result, data[literalsStart:i], rleMaxLiteral)
+		result = append(result, 0x80|uint8(run), data[i])
+		i += run
+		literalsStart = i
+	}
+
+	result = appendLiterals(result, data[literalsStart:], rleMaxLiteral)
+	return append(result, 0)
+}
+
+func compress(method string, data []byte) ([]byte, error) {
+	switch method {
+	case "LZ":
+		return compressLZ(data), nil
+	case "RLE":
+		return compressRLE(data), nil
+	}
+	return nil, fmt.Errorf("Unknown compression \"%s\" (expected LZ or RLE)", method)
+}
+
+type compressedData struct {
+	Name       string
+	Method     string
+	Size       int
+	Compressed int
+}
+
+// Sizes of the data compressed during the second pass
+type CompressionReport struct {
+	Entries []compressedData
+}
+
+func (report *CompressionReport) Add(name string, method string, size int, compressed int) {
+	report.Entries = append(report.Entries, compressedData{name, method, size, compressed})
+}
+
+func (report *CompressionReport) PrintReport() {
+	total, totalCompressed := 0, 0
+	for _, entry := range report.Entries {
+		fmt.Printf(
+			"Compression: %s (%s) %d -> %d bytes (%d%%)\n",
+			entry.Name,
+			entry.Method,
+			entry.Size,
+			entry.Compressed,
+			entry.Compressed*100/max(entry.Size, 1),
+		)
+		total += entry.Size
+		totalCompressed += entry.Compressed
+	}
+	fmt.Printf("Compression: %d bytes saved in total\n", total-totalCompressed)
+}
+
+// Options of .INCLZ, .INCRLE and .COMPRESS: the name of the constant defined as the size of the
+// data before compression
+func parseCompressionOptions(defaultSizeName string, parameters []string) (string, error) {
+	sizeName := defaultSizeName
+	for _, parameter := range parameters {
+		key, value, hasValue := strings.Cut(strings.ToUpper(parameter), "=")
+		if key != "SIZE" || !hasValue {
+			return "", fmt.Errorf("Unknown compression option \"%s\" (expected SIZE=name)", parameter)
+		}
+		sizeName = value
+	}
+	return sizeName, nil
+}
+
+// Compresses a file (.INCLZ and .INCRLE)
+func includeCompressed(state *ProgramState, method string, arguments string, isFirstPass bool) ([]byte, error) {
+	filePath, parameters, err := parseFileArguments(arguments)
+	if err != nil {
+		return nil, err
+	}
+
+	sizeName, err := parseCompressionOptions(constantNameFromFile(filePath, "SIZE"), parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	filePath, err = resolveInclude(state, filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := state.Sources.Read(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return compressData(state, method, filePath, sizeName, content, isFirstPass)
+}
+
+// Compresses the .DB lines of a .COMPRESS block. lineNb is moved to the .END line.
+func compressBlock(
+	state *ProgramState,
+	arguments string,
+	lines []string,
+	lineNb *int,
+	currentAddress uint32,
+	lastAbsoluteLabel string,
+	isFirstPass bool,
+) ([]byte, error) {
+	parameters := strings.Split(arguments, ",")
+	for i := range parameters {
+		parameters[i] = strings.TrimSpace(parameters[i])
+	}
+	method := strings.ToUpper(parameters[0])
+
+	sizeName, err := parseCompressionOptions("", parameters[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	// The whole block is read before the .DB lines are assembled, so an error doesn't stop in the
+	// middle of it
+	blockLines := []int{}
+	startLine := *lineNb
+	for {
+		*lineNb += 1
+		if *lineNb >= len(lines) {
+			return nil, fmt.Errorf(".COMPRESS started on line %d is never closed by .END", startLine+1)
+		}
+
+		line := strings.TrimSpace(strings.Split(lines[*lineNb], ";")[0])
+		if line == ".END" {
+			break
+		}
+		if line != "" {
+			blockLines = append(blockLines, *lineNb)
+		}
+	}
+
+	data := []byte{}
+	for _, blockLine := range blockLines {
+		line := strings.TrimSpace(strings.Split(lines[blockLine], ";")[0])
+		if !strings.HasPrefix(line, ".DB ") {
+			return nil, fmt.Errorf("Line %d: .COMPRESS blocks can only contain .DB, not \"%s\"", blockLine+1, line)
+		}
+
+		// The labels of the previous pass are used in the first pass too, as the compressed size
+		// depends on the values
+		bytes, err := MacroInstructions.Parse(
+			&state.Labels,
+			&state.Defs,
+			state.IsMacro,
+			false,
+			currentAddress,
+			lastAbsoluteLabel,
+			line,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %w", blockLine+1, err)
+		}
+		data = append(data, bytes...)
+	}
+
+	name := fmt.Sprintf(".COMPRESS block on line %d", startLine+1)
+	return compressData(state, method, name, sizeName, data, isFirstPass)
+}
+
+func compressData(
+	state *ProgramState,
+	method string,
+	name string,
+	sizeName string,
+	data []byte,
+	isFirstPass bool,
+) ([]byte, error) {
+	compressed, err := compress(method, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if sizeName != "" {
+		err = defineConstant(state, sizeName, len(data))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !isFirstPass && state.Compression != nil {
+		state.Compression.Add(name, method, len(data), len(compressed))
+	}
+	return compressed, nil
+}
+
+// Source of the decompression routine inserted by .DECOMPRESSOR
+func decompressorSource(method string) (string, []byte, error) {
+	fileName := "lib/" + strings.ToLower(method) + ".gbasm"
+	source, err := libraries.ReadFile(fileName)
+	if err != nil {
+		return "", nil, fmt.Errorf("Unknown decompressor \"%s\" (expected LZ or RLE)", method)
+	}
+	return fileName, source, nil
+}
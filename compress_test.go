@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// Decompresses data with the routine of .DECOMPRESSOR, run by the emulator
+func runDecompressor(t *testing.T, method string, compressed []byte) []byte {
+	t.Helper()
+	routine, err := assembleTestFile(t, ".DECOMPRESSOR "+method+"\n", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const dataAddress, destination = 0x1000, 0xc000
+	rom := make([]byte, 0x8000)
+	copy(rom, routine)
+	// CALL $0000 then HALT, with the interrupts disabled
+	copy(rom[0x0100:], []byte{0xcd, 0x00, 0x00, 0x76})
+	copy(rom[dataAddress:], compressed)
+
+	cpu := NewCPU(NewMemory(rom))
+	cpu.SetHL(dataAddress)
+	cpu.SetDE(destination)
+	reason, err := cpu.Run(10_000_000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason != StopHalt {
+		t.Fatalf("%s_DECOMPRESS stopped with %s", method, reason)
+	}
+	if cpu.HL() != uint16(dataAddress+len(compressed)) {
+		t.Errorf("HL = $%04x, expected the end of the compressed data", cpu.HL())
+	}
+
+	result := []byte{}
+	for address := uint16(destination); address < cpu.DE(); address++ {
+		result = append(result, cpu.Memory.Read(address))
+	}
+	return result
+}
+
+func TestDecompressorsRoundTrip(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	noise := make([]byte, 300)
+	random.Read(noise)
+
+	inputs := map[string][]byte{
+		"empty":           {},
+		"single byte":     {0x42},
+		"long run":        bytes.Repeat([]byte{0xaa}, 300),
+		"long literals":   noise,
+		"overlapping":     bytes.Repeat([]byte("abc"), 100),
+		"mixed":           append(append(append([]byte("header"), noise[:40]...), make([]byte, 200)...), noise[:40]...),
+		"run at the end":  append([]byte{1, 2}, bytes.Repeat([]byte{9}, 0x7f+1)...),
+		"short repeats":   []byte("aabbaabbccaabbcc"),
+		"longest matches": bytes.Repeat(noise[:20], 30),
+	}
+
+	for _, method := range []string{"LZ", "RLE"} {
+		for name, input := range inputs {
+			compressed, err := compress(method, input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result := runDecompressor(t, method, compressed)
+			if !bytes.Equal(result, input) {
+				t.Errorf("%s, %s: decompressed to % x, expected % x", method, name, result, input)
+			}
+		}
+	}
+}
+
+func TestCompressLZOverlappingMatch(t *testing.T) {
+	// A single match 3 bytes back copies the bytes it is writing
+	compressed := compressLZ(bytes.Repeat([]byte("abc"), 20))
+	expected := []byte{0x03, 'a', 'b', 'c', 0x80 | (57 - lzMinMatch), 0xfd, 0xff, 0x00}
+	if !bytes.Equal(compressed, expected) {
+		t.Errorf("Got % x, expected % x", compressed, expected)
+	}
+}
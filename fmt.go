@@ -0,0 +1,303 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Maximum width of the lines of .DB, with tabs of 8 columns
+const defaultFormatWidth = 100
+
+// The directives written at the start of the line, like the labels. The others insert code or data
+// and are indented like the instructions.
+var unindentedDirectives = []string{
+	".ALIGN", ".BUDGET", ".COMPRESS", ".CYCLES_MAX", ".DEFINE", ".END", ".ENDCYCLES", ".ENDTEST",
+	".INCLUDE", ".MACRODEF", ".MBC_WRITE", ".PADTO", ".TEST", ".TILE",
+}
+
+var formatRegisters = []string{
+	"A", "B", "C", "D", "E", "H", "L", "AF", "BC", "DE", "HL", "SP",
+	"(HL)", "(BC)", "(DE)", "(HL+)", "(HL-)", "(C)", "NZ", "Z", "NC",
+}
+
+var hexLiteralRegexp = regexp.MustCompile(`^(\(?)(\$|0[xX])([0-9a-fA-F]+)(\)?)$`)
+
+// A line of the formatted file. The trailing comments of consecutive lines are aligned.
+type formatLine struct {
+	Code    string
+	Comment string
+}
+
+// Splits the comment starting with a ";" outside of quotes
+func splitComment(line string) (string, string) {
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ';':
+			return line[:i], strings.TrimRight(line[i:], " \t")
+		}
+	}
+	return line, ""
+}
+
+// Uppercase registers and conditions, $ hex literals in lowercase, separated by ", "
+func formatOperands(operands string) string {
+	words := strings.Fields(strings.ReplaceAll(operands, ",", " "))
+	for i, word := range words {
+		if slices.Contains(formatRegisters, strings.ToUpper(word)) {
+			words[i] = strings.ToUpper(word)
+		} else if match := hexLiteralRegexp.FindStringSubmatch(word); match != nil {
+			words[i] = match[1] + "$" + strings.ToLower(match[3]) + match[4]
+		}
+	}
+	return strings.Join(words, ", ")
+}
+
+// Whether the value is parsed as 8 bits by .DB. When one value of a .DB is 16 bits, all of them are
+// inserted as 16 bits, so the line cannot be split.
+func isByteLiteral(value string) bool {
+	if match := hexLiteralRegexp.FindStringSubmatch(value); match != nil && match[1] == "" {
+		return len(match[3]) <= 2
+	}
+	v, err := strconv.ParseUint(value, 10, 8)
+	return err == nil && v <= 0xff
+}
+
+func displayWidth(text string) int {
+	width := 0
+	for _, c := range text {
+		if c == '\t' {
+			width += 8 - width%8
+		} else {
+			width += 1
+		}
+	}
+	return width
+}
+
+// Splits the values of a .DB into lines of at most width columns
+func wrapBytes(values []string, width int) []string {
+	lines := []string{}
+	current := ""
+	for _, value := range values {
+		candidate := value
+		if current != "" {
+			candidate = current + ", " + value
+		}
+		if current != "" && displayWidth("\t.DB "+candidate) > width {
+			lines = append(lines, "\t.DB "+current)
+			candidate = value
+		}
+		current = candidate
+	}
+	return append(lines, "\t.DB "+current)
+}
+
+// Formats an instruction or a directive, without its labels and comment
+func formatStatement(statement string, width int) []string {
+	name, arguments, _ := strings.Cut(strings.TrimSpace(strings.ReplaceAll(statement, "\t", " ")), " ")
+	arguments = strings.TrimSpace(arguments)
+	upper := strings.ToUpper(name)
+
+	if !strings.HasPrefix(name, ".") {
+		if _, ok := Instructions[upper]; ok {
+			name = upper
+		}
+		if arguments == "" {
+			return []string{"\t" + name}
+		}
+		return []string{"\t" + name + " " + formatOperands(arguments)}
+	}
+
+	indent := "\t"
+	if slices.Contains(unindentedDirectives, upper) {
+		indent = ""
+	}
+	switch {
+	case arguments == "":
+		return []string{indent + upper}
+	case upper == ".DB":
+		values := strings.Split(formatOperands(arguments), ", ")
+		for _, value := range values {
+			if !isByteLiteral(value) {
+				return []string{"\t.DB " + strings.Join(values, ", ")}
+			}
+		}
+		return wrapBytes(values, width)
+	case upper == ".ASSERT":
+		return []string{indent + upper + " " + formatOperands(arguments)}
+	}
+	return []string{indent + upper + " " + arguments}
+}
+
+// Rewrites a source file in the canonical style. The bytes assembled from it don't change.
+func formatSource(source string, width int) string {
+	lines := []formatLine{}
+	// The rows of .TILE and the statements of .TEST are kept as they are
+	verbatimEnd := ""
+
+	for _, line := range strings.Split(strings.ReplaceAll(source, "\r\n", "\n"), "\n") {
+		line = strings.TrimRight(line, " \t")
+		code, comment := splitComment(line)
+
+		if verbatimEnd != "" {
+			if strings.ToUpper(strings.TrimSpace(code)) != verbatimEnd {
+				lines = append(lines, formatLine{Code: line})
+				continue
+			}
+			verbatimEnd = ""
+		}
+
+		if strings.TrimSpace(code) == "" {
+			if comment != "" && line[0] != ';' {
+				comment = "\t" + comment
+			}
+			lines = append(lines, formatLine{Code: comment})
+			continue
+		}
+
+		// Like the assembler, everything before the last ":" is labels if there is no space before the first one
+		isLabelDefined := strings.Contains(code, ":") && !strings.Contains(strings.Split(code, ":")[0], " ")
+		if !isLabelDefined && strings.Contains(strings.Fields(code)[0], ":") {
+			// A label indented with spaces, which the assembler rejects: it is left as it is
+			lines = append(lines, formatLine{Code: line})
+			continue
+		}
+		if isLabelDefined {
+			parts := strings.Split(code, ":")
+			for _, label := range parts[:len(parts)-1] {
+				lines = append(lines, formatLine{Code: strings.TrimSpace(label) + ":"})
+			}
+			code = parts[len(parts)-1]
+			if strings.TrimSpace(code) == "" {
+				lines[len(lines)-1].Comment = comment
+				continue
+			}
+		}
+
+		statements := formatStatement(code, width)
+		for i, statement := range statements {
+			lines = append(lines, formatLine{Code: statement})
+			if i == 0 {
+				lines[len(lines)-1].Comment = comment
+			}
+		}
+
+		switch strings.ToUpper(strings.Fields(code)[0]) {
+		case ".TILE":
+			verbatimEnd = ".END"
+		case ".TEST":
+			verbatimEnd = ".ENDTEST"
+		}
+	}
+
+	// Aligns the comments of consecutive lines one space after the longest code
+	for start := 0; start < len(lines); {
+		end := start
+		codeWidth := 0
+		for end < len(lines) && lines[end].Comment != "" {
+			codeWidth = max(codeWidth, displayWidth(lines[end].Code))
+			end++
+		}
+		for i := start; i < end; i++ {
+			padding := codeWidth - displayWidth(lines[i].Code) + 1
+			lines[i].Code += strings.Repeat(" ", padding) + lines[i].Comment
+		}
+		start = max(end, start+1)
+	}
+
+	output := strings.Builder{}
+	blank := false
+	for i, line := range lines {
+		if line.Code == "" {
+			// At most one empty line, and none at the end
+			if blank || i == len(lines)-1 {
+				continue
+			}
+			blank = true
+		} else {
+			blank = false
+		}
+		output.WriteString(line.Code + "\n")
+	}
+	return strings.TrimRight(output.String(), "\n") + "\n"
+}
+
+func fmtMain(args []string) {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	check := flags.Bool("check", false, "Don't rewrite the files, list the files that aren't formatted and fail if there is any")
+	width := flags.Int("width", defaultFormatWidth, "Maximum width of the .DB lines (tabs are 8 columns)")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gbasm fmt [-check] [-width n] file_or_directory...\n")
+		fmt.Fprintf(os.Stderr, "Rewrites the .gbasm files (and the .gbasm files of the directories) in the canonical style\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	files := []string{}
+	for _, arg := range flags.Args() {
+		err := filepath.WalkDir(arg, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if path == arg || !entry.IsDir() && filepath.Ext(path) == ".gbasm" {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	unformatted := 0
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		source, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		formatted := formatSource(string(source), *width)
+		if formatted == string(source) {
+			continue
+		}
+		unformatted += 1
+		if *check {
+			fmt.Println(file)
+			continue
+		}
+		err = os.WriteFile(file, []byte(formatted), info.Mode())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if *check && unformatted > 0 {
+		os.Exit(1)
+	}
+}
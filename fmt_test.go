@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestFormatSourceGolden(t *testing.T) {
+	input, err := os.ReadFile("testdata/format.in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := os.ReadFile("testdata/format.golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	formatted := formatSource(string(input), defaultFormatWidth)
+	if formatted != string(expected) {
+		t.Errorf("Got\n%s\nexpected\n%s", formatted, expected)
+	}
+	if again := formatSource(formatted, defaultFormatWidth); again != formatted {
+		t.Errorf("Formatting again changed the file:\n%s", again)
+	}
+
+	before, err := assembleTestFile(t, string(input), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := assembleTestFile(t, formatted, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Errorf("The formatted file assembles to\n% x\ninstead of\n% x", after, before)
+	}
+}
+
+func TestFormatSourceStyle(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"\tStart: nop\n", "Start:\n\tNOP\n"},
+		{"    Start:\n\tnop\n", "    Start:\n\tNOP\n"},
+		{"  Start: nop ; entry\n", "  Start: nop ; entry\n"},
+		{"\tld a,(hl)\n", "\tLD A, (HL)\n"},
+		{".padto 0x100\n.db $AB\n", ".PADTO 0x100\n\t.DB $ab\n"},
+		{"\tNOP\n\n\n\n\tNOP\n\n", "\tNOP\n\n\tNOP\n"},
+		{"\tJP =Start ; far\n\tNOP ; near\n", "\tJP =Start ; far\n\tNOP       ; near\n"},
+		{"\t.DB \"a;b\" ; text\n", "\t.DB \"a;b\" ; text\n"},
+	}
+	for _, test := range tests {
+		formatted := formatSource(test.input, defaultFormatWidth)
+		if formatted != test.expected {
+			t.Errorf("formatSource(%q) = %q, expected %q", test.input, formatted, test.expected)
+		}
+		if again := formatSource(formatted, defaultFormatWidth); again != formatted {
+			t.Errorf("formatSource(%q) is not stable: %q", formatted, again)
+		}
+	}
+}
@@ -0,0 +1,639 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Colour numbers (0 to 3) of the 64 pixels of an 8x8 tile, row by row
+type Tile [64]uint8
+
+type GfxOptions struct {
+	Sprites8x16 bool
+	OneBPP      bool
+	// Colour number of each shade (from the lightest to the darkest) or of each palette index for
+	// indexed images
+	Shades    [4]uint8
+	CountName string
+	// The palette of the indexed image is made of CGB palettes of 4 colours
+	CGB bool
+}
+
+func parseGfxOptions(filePath string, parameters []string) (GfxOptions, error) {
+	options := GfxOptions{
+		Shades:    [4]uint8{0, 1, 2, 3},
+		CountName: constantNameFromFile(filePath, "TILES"),
+	}
+
+	for _, parameter := range parameters {
+		key, value, hasValue := strings.Cut(strings.ToUpper(parameter), "=")
+		switch {
+		case key == "8X16" && !hasValue:
+			options.Sprites8x16 = true
+		case key == "1BPP" && !hasValue:
+			options.OneBPP = true
+		case key == "SHADES" && hasValue:
+			shades, err := parseShades(value)
+			if err != nil {
+				return options, err
+			}
+			options.Shades = shades
+		case key == "COUNT" && hasValue:
+			options.CountName = value
+		case key == "CGB" && !hasValue:
+			options.CGB = true
+		default:
+			return options, fmt.Errorf("Unknown graphics option \"%s\" (expected 8X16, 1BPP, CGB, SHADES=xxxx or COUNT=name)", parameter)
+		}
+	}
+
+	return options, nil
+}
+
+// Uppercase name of a file without its extension, usable as a label or a .DEFINE name
+func nameFromFile(filePath string) string {
+	base := filepath.Base(filePath)
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+
+	name := []byte(strings.ToUpper(base))
+	for i, c := range name {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			name[i] = '_'
+		}
+	}
+	return string(name)
+}
+
+func constantNameFromFile(filePath string, suffix string) string {
+	return nameFromFile(filePath) + "_" + suffix
+}
+
+func parseShades(value string) ([4]uint8, error) {
+	shades := [4]uint8{}
+	if len(value) != 4 {
+		return shades, fmt.Errorf("SHADES must be 4 colour numbers (like SHADES=0123), not \"%s\"", value)
+	}
+	for i, c := range value {
+		if c < '0' || c > '3' {
+			return shades, fmt.Errorf("SHADES must be 4 colour numbers between 0 and 3, not \"%s\"", value)
+		}
+		shades[i] = uint8(c - '0')
+	}
+	return shades, nil
+}
+
+func decodePNG(filePath string, content []byte) (image.Image, error) {
+	img, err := png.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't decode %s as a PNG: %w", filePath, err)
+	}
+
+	bounds := img.Bounds()
+	if bounds.Dx()%8 != 0 || bounds.Dy()%8 != 0 {
+		return nil, fmt.Errorf(
+			"The size of %s (%dx%d) is not a multiple of 8x8 tiles",
+			filePath,
+			bounds.Dx(),
+			bounds.Dy(),
+		)
+	}
+	return img, nil
+}
+
+// Shade of a pixel, from 0 (lightest) to 3 (darkest). For indexed images, the palette index modulo 4
+// is used instead (see checkPaletteIndexes).
+func pixelShade(img image.Image, x int, y int) uint8 {
+	if paletted, ok := img.(*image.Paletted); ok {
+		return paletted.ColorIndexAt(x, y) % 4
+	}
+
+	c := img.At(x, y)
+	if _, _, _, a := c.RGBA(); a == 0 {
+		return 0
+	}
+	gray := color.GrayModel.Convert(c).(color.Gray).Y
+	return 3 - uint8((uint(gray)*3+127)/255)
+}
+
+// The palette indexes of an indexed image are the shades, so they must be between 0 and 3. With
+// cgbPalettes, the palette of the image is made of CGB palettes of 4 colours instead (see .INCPAL)
+// and any index can be used.
+func checkPaletteIndexes(img image.Image, cgbPalettes bool) error {
+	paletted, ok := img.(*image.Paletted)
+	if !ok || cgbPalettes {
+		return nil
+	}
+
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if index := paletted.ColorIndexAt(x, y); index > 3 {
+				return fmt.Errorf(
+					"Pixel (%d, %d) uses palette index %d but only indexes 0 to 3 are allowed without CGB",
+					x,
+					y,
+					index,
+				)
+			}
+		}
+	}
+	return nil
+}
+
+// The pixels of a tile of an indexed image must all use the same palette of 4 colours
+func checkTilePalette(img image.Image, tileX int, tileY int) error {
+	paletted, ok := img.(*image.Paletted)
+	if !ok {
+		return nil
+	}
+
+	palette := paletted.ColorIndexAt(tileX, tileY) / 4
+	for y := tileY; y < tileY+8; y++ {
+		for x := tileX; x < tileX+8; x++ {
+			if paletted.ColorIndexAt(x, y)/4 != palette {
+				return fmt.Errorf(
+					"The tile at (%d, %d) uses colours of both palette %d and palette %d (palette indexes %d to %d and %d to %d)",
+					tileX,
+					tileY,
+					palette,
+					paletted.ColorIndexAt(x, y)/4,
+					palette*4,
+					palette*4+3,
+					paletted.ColorIndexAt(x, y)/4*4,
+					paletted.ColorIndexAt(x, y)/4*4+3,
+				)
+			}
+		}
+	}
+	return nil
+}
+
+// CGB palette of a pixel of an indexed image made of CGB palettes of 4 colours (see
+// checkPaletteIndexes), 0 for the other images
+func pixelPalette(img image.Image, x int, y int, cgbPalettes bool) (uint8, error) {
+	paletted, ok := img.(*image.Paletted)
+	if !ok || !cgbPalettes {
+		return 0, nil
+	}
+
+	palette := paletted.ColorIndexAt(x, y) / paletteColours
+	if palette >= maxPalettes {
+		return 0, fmt.Errorf(
+			"Pixel (%d, %d) uses palette index %d but there are only %d CGB palettes of %d colours",
+			x,
+			y,
+			paletted.ColorIndexAt(x, y),
+			maxPalettes,
+			paletteColours,
+		)
+	}
+	return palette, nil
+}
+
+// Cuts the image into 8x8 tiles, from left to right and top to bottom. With sprites8x16, the tiles
+// are ordered by 8x16 blocks: the top tile of a block is directly followed by its bottom tile.
+// cgbPalettes is explained by checkPaletteIndexes, and the CGB palette of each tile is returned
+// with the tiles (always 0 without cgbPalettes).
+func imageTiles(img image.Image, shades [4]uint8, sprites8x16 bool, cgbPalettes bool) ([]Tile, []uint8, error) {
+	err := checkPaletteIndexes(img, cgbPalettes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bounds := img.Bounds()
+	blockHeight := 8
+	if sprites8x16 {
+		blockHeight = 16
+		if bounds.Dy()%16 != 0 {
+			return nil, nil, fmt.Errorf("The height of the image (%d) is not a multiple of 16 for 8x16 sprites", bounds.Dy())
+		}
+	}
+
+	tiles := []Tile{}
+	palettes := []uint8{}
+	for blockY := 0; blockY < bounds.Dy(); blockY += blockHeight {
+		for tileX := 0; tileX < bounds.Dx(); tileX += 8 {
+			for tileY := blockY; tileY < blockY+blockHeight; tileY += 8 {
+				err := checkTilePalette(img, bounds.Min.X+tileX, bounds.Min.Y+tileY)
+				if err != nil {
+					return nil, nil, err
+				}
+				palette, err := pixelPalette(img, bounds.Min.X+tileX, bounds.Min.Y+tileY, cgbPalettes)
+				if err != nil {
+					return nil, nil, err
+				}
+
+				var tile Tile
+				for y := 0; y < 8; y++ {
+					for x := 0; x < 8; x++ {
+						shade := pixelShade(img, bounds.Min.X+tileX+x, bounds.Min.Y+tileY+y)
+						tile[y*8+x] = shades[shade]
+					}
+				}
+				tiles = append(tiles, tile)
+				palettes = append(palettes, palette)
+			}
+		}
+	}
+	return tiles, palettes, nil
+}
+
+// 2 bytes per row: the low bits of the 8 pixels, then the high bits. The leftmost pixel is bit 7.
+func (tile Tile) Encode2bpp() []byte {
+	result := make([]byte, 16)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			colour := tile[y*8+x]
+			result[y*2] |= (colour & 1) << (7 - x)
+			result[y*2+1] |= (colour >> 1) << (7 - x)
+		}
+	}
+	return result
+}
+
+// 1 byte per row, a bit is set for every pixel that isn't colour 0
+func (tile Tile) Encode1bpp() []byte {
+	result := make([]byte, 8)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if tile[y*8+x] != 0 {
+				result[y] |= 1 << (7 - x)
+			}
+		}
+	}
+	return result
+}
+
+// Reads the image of a graphics directive (.INCGFX) and converts it to tile data
+func includeGraphics(state *ProgramState, arguments string) ([]byte, error) {
+	filePath, parameters, err := parseFileArguments(arguments)
+	if err != nil {
+		return nil, err
+	}
+
+	options, err := parseGfxOptions(filePath, parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	filePath, err = resolveInclude(state, filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := state.Sources.Read(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := decodePNG(filePath, content)
+	if err != nil {
+		return nil, err
+	}
+
+	tiles, _, err := imageTiles(img, options.Shades, options.Sprites8x16, options.CGB)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	}
+
+	result := []byte{}
+	for _, tile := range tiles {
+		if options.OneBPP {
+			result = append(result, tile.Encode1bpp()...)
+		} else {
+			result = append(result, tile.Encode2bpp()...)
+		}
+	}
+
+	err = defineConstant(state, options.CountName, len(tiles))
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Defines a constant computed by a directive, as a Raw8b if it fits
+func defineConstant(state *ProgramState, name string, value int) error {
+	name = strings.ToUpper(name)
+	if _, err := strconv.ParseUint(name, 16, 16); err == nil {
+		return fmt.Errorf("Defined variable \"%s\" is also valid hexadecimal", name)
+	}
+
+	if value > 0xffff {
+		return fmt.Errorf("$%s doesn't fit in 16 bits (%d > 0xffff)", name, value)
+	} else if value > 0xff {
+		state.Defs[name] = Raw16b(value)
+	} else {
+		state.Defs[name] = Raw8b(value)
+	}
+	return nil
+}
+
+type TilemapOptions struct {
+	Shades [4]uint8
+	// Tile number of the first tile in VRAM
+	Base uint32
+	// Also merge the tiles that are the flipped version of another one (CGB only)
+	Flip bool
+	Name string
+	// The palette of the indexed image is made of CGB palettes of 4 colours, which are written in the
+	// attribute map
+	CGB bool
+}
+
+func parseTilemapOptions(filePath string, parameters []string) (TilemapOptions, error) {
+	options := TilemapOptions{
+		Shades: [4]uint8{0, 1, 2, 3},
+		Name:   nameFromFile(filePath),
+	}
+
+	for _, parameter := range parameters {
+		key, value, hasValue := strings.Cut(strings.ToUpper(parameter), "=")
+		switch {
+		case key == "FLIP" && !hasValue:
+			options.Flip = true
+		case key == "CGB" && !hasValue:
+			options.CGB = true
+		case key == "SHADES" && hasValue:
+			shades, err := parseShades(value)
+			if err != nil {
+				return options, err
+			}
+			options.Shades = shades
+		case key == "BASE" && hasValue:
+			base, err := Raw8(nil, "", &Definitions{}, 0, value)
+			if err != nil {
+				return options, fmt.Errorf("Invalid BASE tile number \"%s\": %w", value, err)
+			}
+			options.Base = base
+		case key == "NAME" && hasValue:
+			options.Name = value
+		default:
+			return options, fmt.Errorf(
+				"Unknown tilemap option \"%s\" (expected FLIP, CGB, SHADES=xxxx, BASE=xx or NAME=name)",
+				parameter,
+			)
+		}
+	}
+
+	return options, nil
+}
+
+func (tile Tile) FlipX() Tile {
+	var result Tile
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			result[y*8+x] = tile[y*8+7-x]
+		}
+	}
+	return result
+}
+
+func (tile Tile) FlipY() Tile {
+	var result Tile
+	for y := 0; y < 8; y++ {
+		copy(result[y*8:y*8+8], tile[(7-y)*8:(7-y)*8+8])
+	}
+	return result
+}
+
+// CGB background attributes
+const (
+	attributeFlipX = 1 << 5
+	attributeFlipY = 1 << 6
+)
+
+type tileVariant struct {
+	tile       Tile
+	attributes uint8
+}
+
+// A tile and its CGB palette: the same pixels in another palette are another tile
+type paletteTile struct {
+	tile    Tile
+	palette uint8
+}
+
+// Keeps one copy of every tile of each palette. Each entry of the map is the index of its tile in
+// the unique tiles and its attributes: the palette of the tile and, when flips are allowed, the
+// flips to apply to it.
+func deduplicateTiles(tiles []Tile, palettes []uint8, flip bool) ([]Tile, []int, []uint8) {
+	unique := []Tile{}
+	indexes := make(map[paletteTile]int)
+	tileMap := make([]int, len(tiles))
+	attributes := make([]uint8, len(tiles))
+
+	for i, tile := range tiles {
+		variants := []tileVariant{{tile, 0}}
+		if flip {
+			variants = append(
+				variants,
+				tileVariant{tile.FlipX(), attributeFlipX},
+				tileVariant{tile.FlipY(), attributeFlipY},
+				tileVariant{tile.FlipX().FlipY(), attributeFlipX | attributeFlipY},
+			)
+		}
+
+		found := false
+		for _, variant := range variants {
+			if index, ok := indexes[paletteTile{variant.tile, palettes[i]}]; ok {
+				tileMap[i] = index
+				attributes[i] = variant.attributes | palettes[i]
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			indexes[paletteTile{tile, palettes[i]}] = len(unique)
+			attributes[i] = palettes[i]
+			tileMap[i] = len(unique)
+			unique = append(unique, tile)
+		}
+	}
+
+	return unique, tileMap, attributes
+}
+
+// Reads the image of a .INCTILEMAP and converts it to its unique tiles followed by its tilemap (32
+// tiles per row) and, with FLIP or CGB, its CGB attribute map. Labels are defined at the start of each part.
+func includeTilemap(state *ProgramState, arguments string, currentAddress uint32, isFirstPass bool) ([]byte, error) {
+	filePath, parameters, err := parseFileArguments(arguments)
+	if err != nil {
+		return nil, err
+	}
+
+	options, err := parseTilemapOptions(filePath, parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	filePath, err = resolveInclude(state, filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := state.Sources.Read(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := decodePNG(filePath, content)
+	if err != nil {
+		return nil, err
+	}
+
+	width, height := img.Bounds().Dx()/8, img.Bounds().Dy()/8
+	if width > 32 {
+		return nil, fmt.Errorf("%s is %d tiles wide but a tilemap is only 32 tiles wide", filePath, width)
+	}
+	if height > 32 {
+		return nil, fmt.Errorf("%s is %d tiles high but a tilemap is only 32 tiles high", filePath, height)
+	}
+
+	tiles, palettes, err := imageTiles(img, options.Shades, false, options.CGB)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	}
+
+	unique, tileMap, attributes := deduplicateTiles(tiles, palettes, options.Flip)
+	if options.Base+uint32(len(unique)) > 0x100 {
+		return nil, fmt.Errorf(
+			"%s has %d different tiles, which don't fit after the base tile $%02x",
+			filePath,
+			len(unique),
+			options.Base,
+		)
+	}
+
+	result := []byte{}
+	for _, tile := range unique {
+		result = append(result, tile.Encode2bpp()...)
+	}
+
+	mapAddress := currentAddress + uint32(len(result))
+	for y := 0; y < height; y++ {
+		row := make([]byte, 32)
+		for x := range row {
+			row[x] = uint8(options.Base)
+			if x < width {
+				row[x] = uint8(options.Base + uint32(tileMap[y*width+x]))
+			}
+		}
+		result = append(result, row...)
+	}
+
+	attributesAddress := currentAddress + uint32(len(result))
+	hasAttributes := options.Flip || options.CGB
+	if hasAttributes {
+		for y := 0; y < height; y++ {
+			row := make([]byte, 32)
+			for x := 0; x < width; x++ {
+				row[x] = attributes[y*width+x]
+			}
+			result = append(result, row...)
+		}
+	}
+
+	name := strings.ToUpper(options.Name)
+	labels := map[string]uint32{name + ".TILES": currentAddress, name + ".MAP": mapAddress}
+	if hasAttributes {
+		labels[name+".ATTRS"] = attributesAddress
+	}
+	for label, address := range labels {
+		err = defineDirectiveLabel(state, label, address, isFirstPass)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for suffix, value := range map[string]int{"TILES": len(unique), "WIDTH": width, "HEIGHT": height} {
+		err = defineConstant(state, name+"_"+suffix, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Characters of the colours 0 to 3 in a .TILE block (the digits 0 to 3 can always be used too)
+const defaultTileCharacters = ".-=#"
+
+// Converts the rows of a .TILE block to 2bpp tiles. Each row is 8 pixels wide and every 8 rows
+// make one tile. lineNb is moved to the .END line.
+func assembleTileBlock(arguments string, lines []string, lineNb *int) ([]byte, error) {
+	characters := defaultTileCharacters
+	arguments = strings.TrimSpace(arguments)
+	if arguments != "" {
+		characters = strings.Trim(arguments, "\"'")
+		if len([]rune(characters)) != 4 {
+			return nil, fmt.Errorf(
+				".TILE takes the 4 characters of the colours 0 to 3 between quotes (like \"%s\"), not %s",
+				defaultTileCharacters,
+				arguments,
+			)
+		}
+	}
+
+	colours := map[rune]uint8{'0': 0, '1': 1, '2': 2, '3': 3}
+	for i, c := range []rune(characters) {
+		colours[c] = uint8(i)
+	}
+
+	rows := [][]uint8{}
+	startLine := *lineNb
+	for {
+		*lineNb += 1
+		if *lineNb >= len(lines) {
+			return nil, fmt.Errorf(".TILE started on line %d is never closed by .END", startLine+1)
+		}
+
+		row := strings.TrimSpace(strings.Split(lines[*lineNb], ";")[0])
+		if row == ".END" {
+			break
+		}
+		if row == "" {
+			continue
+		}
+
+		pixels := []rune(row)
+		if len(pixels) != 8 {
+			return nil, fmt.Errorf("Line %d: a .TILE row must be 8 pixels wide, \"%s\" is %d", *lineNb+1, row, len(pixels))
+		}
+
+		colourRow := make([]uint8, 8)
+		for x, c := range pixels {
+			colour, ok := colours[c]
+			if !ok {
+				return nil, fmt.Errorf(
+					"Line %d: unknown pixel '%c' (expected one of \"%s\" or a digit from 0 to 3)",
+					*lineNb+1,
+					c,
+					characters,
+				)
+			}
+			colourRow[x] = colour
+		}
+		rows = append(rows, colourRow)
+	}
+
+	if len(rows) == 0 || len(rows)%8 != 0 {
+		return nil, fmt.Errorf(".TILE blocks must have a multiple of 8 rows (got %d)", len(rows))
+	}
+
+	result := []byte{}
+	for start := 0; start < len(rows); start += 8 {
+		var tile Tile
+		for y := 0; y < 8; y++ {
+			copy(tile[y*8:y*8+8], rows[start+y])
+		}
+		result = append(result, tile.Encode2bpp()...)
+	}
+	return result, nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// An 8x8 indexed image of 8 colours where every pixel uses the palette index index
+func indexedTile(t *testing.T, index uint8) []byte {
+	t.Helper()
+	return indexedImage(t, 8, 8, func(_ int, _ int) uint8 { return index })
+}
+
+// An indexed image of 16 colours (4 CGB palettes) where each pixel uses the palette index given by
+// index
+func indexedImage(t *testing.T, width int, height int, index func(x int, y int) uint8) []byte {
+	t.Helper()
+	palette := color.Palette{}
+	for i := 0; i < 16; i++ {
+		palette = append(palette, color.Gray{Y: uint8(255 - i*16)})
+	}
+	img := image.NewPaletted(image.Rect(0, 0, width, height), palette)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetColorIndex(x, y, index(x, y))
+		}
+	}
+
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, img); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestIndexedImageWithoutCGB(t *testing.T) {
+	files := map[string][]byte{"low.png": indexedTile(t, 2), "high.png": indexedTile(t, 6)}
+
+	result, err := assembleTestFile(t, ".INCGFX \"low.png\"\n", files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := bytes.Repeat([]byte{0x00, 0xff}, 8)
+	if !bytes.Equal(result, expected) {
+		t.Errorf("Got % x, expected % x", result, expected)
+	}
+
+	for _, directive := range []string{".INCGFX", ".INCTILEMAP"} {
+		_, err = assembleTestFile(t, directive+" \"high.png\"\n", files)
+		if err == nil || !strings.Contains(err.Error(), "palette index 6") {
+			t.Errorf("%s: expected an error for the palette index 6, got %v", directive, err)
+		}
+	}
+}
+
+func TestIndexedImageWithCGB(t *testing.T) {
+	files := map[string][]byte{"high.png": indexedTile(t, 6)}
+
+	// The index 6 is the colour 2 of the second CGB palette
+	result, err := assembleTestFile(t, ".INCGFX \"high.png\", CGB\n", files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := bytes.Repeat([]byte{0x00, 0xff}, 8)
+	if !bytes.Equal(result, expected) {
+		t.Errorf("Got % x, expected % x", result, expected)
+	}
+
+	_, err = assembleTestFile(t, ".INCTILEMAP \"high.png\", CGB\n", files)
+	if err != nil {
+		t.Errorf(".INCTILEMAP with CGB: %v", err)
+	}
+}
+
+func TestTilemapCGBPalettes(t *testing.T) {
+	// The same pixels (colour 2) in palettes 0, 1 and 0
+	indexes := []uint8{2, 6, 2}
+	files := map[string][]byte{
+		"map.png": indexedImage(t, 24, 8, func(x int, _ int) uint8 { return indexes[x/8] }),
+	}
+
+	result, err := assembleTestFile(t, ".INCTILEMAP \"map.png\", CGB\n\tLD HL, =MAP.ATTRS\n", files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tile := bytes.Repeat([]byte{0x00, 0xff}, 8)
+	expected := append(bytes.Clone(tile), tile...)
+	// The tile of each palette is kept
+	expected = append(expected, append([]byte{0, 1, 0}, make([]byte, 29)...)...)
+	// The attribute map is inserted with CGB, even without FLIP
+	expected = append(expected, append([]byte{0, 1, 0}, make([]byte, 29)...)...)
+	expected = append(expected, 0x21, 0x40, 0x00)
+	if !bytes.Equal(result, expected) {
+		t.Errorf("Got\n% x\nexpected\n% x", result, expected)
+	}
+}
+
+func TestMetaspriteCGBPalettes(t *testing.T) {
+	sheet := `{
+		"frames": [{"frame": {"x": 0, "y": 0, "w": 16, "h": 8}, "spriteSourceSize": {"x": 0, "y": 0, "w": 16, "h": 8}}],
+		"meta": {"image": "sprite.png"}
+	}`
+	tests := []struct {
+		name string
+		// Palette index of the pixels of each object
+		index func(x int, y int) uint8
+		// Number of tiles before the entries
+		tiles    int
+		expected []byte
+		err      string
+	}{
+		{
+			name: "same pixels in 2 palettes",
+			index: func(x int, _ int) uint8 {
+				return []uint8{6, 2}[x/8]
+			},
+			tiles: 2,
+			expected: []byte{
+				0, 0, 0, 1, // palette 1
+				0, 8, 1, 0, // palette 0
+				metaspriteEnd,
+			},
+		},
+		{
+			name: "transparent pixels of another palette",
+			index: func(x int, _ int) uint8 {
+				return []uint8{6, 6, 6, 6, 6, 6, 6, 0}[x%8]
+			},
+			tiles: 1,
+			expected: []byte{
+				0, 0, 0, 1,
+				0, 8, 0, 1,
+				metaspriteEnd,
+			},
+		},
+		{
+			name: "object in 2 palettes",
+			index: func(x int, _ int) uint8 {
+				return []uint8{6, 2}[x%2]
+			},
+			err: "uses colours of both palette 1 and palette 0",
+		},
+	}
+	for _, test := range tests {
+		files := map[string][]byte{
+			"sprite.json": []byte(sheet),
+			"sprite.png":  indexedImage(t, 16, 8, test.index),
+		}
+		result, err := assembleTestFile(t, ".INCMETASPRITE \"sprite.json\", CGB\n", files)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected an error containing %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		// The entries are followed by the pointer to them
+		if len(result) != test.tiles*16+len(test.expected)+2 {
+			t.Errorf("%s: %d bytes instead of %d tiles, the entries and a pointer", test.name, len(result), test.tiles)
+			continue
+		}
+		entries := result[test.tiles*16 : len(result)-2]
+		if !bytes.Equal(entries, test.expected) {
+			t.Errorf("%s: got the entries\n% x\nexpected\n% x", test.name, entries, test.expected)
+		}
+	}
+}
+
+func TestTilemapSize(t *testing.T) {
+	tests := []struct {
+		width, height int
+		err           string
+	}{
+		{256, 256, ""},
+		{264, 8, "is 33 tiles wide but a tilemap is only 32 tiles wide"},
+		{8, 264, "is 33 tiles high but a tilemap is only 32 tiles high"},
+	}
+	for _, test := range tests {
+		files := map[string][]byte{
+			"map.png": indexedImage(t, test.width, test.height, func(x int, y int) uint8 { return uint8((x/8 + y/8) % 4) }),
+		}
+		result, err := assembleTestFile(t, ".INCTILEMAP \"map.png\"\n", files)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%dx%d: expected an error containing %q, got %v", test.width, test.height, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%dx%d: %v", test.width, test.height, err)
+		} else if len(result) != 4*16+32*32 {
+			t.Errorf("%dx%d: %d bytes instead of 4 tiles and the 32x32 tilemap", test.width, test.height, len(result))
+		}
+	}
+}
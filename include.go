@@ -0,0 +1,201 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The SM83 routines of lib/, inserted in the ROM by directives like .DECOMPRESSOR
+//
+//go:embed lib/*.gbasm
+var libraries embed.FS
+
+type IncludePaths []string
+
+func (paths *IncludePaths) String() string {
+	return strings.Join(*paths, ":")
+}
+
+func (paths *IncludePaths) Set(path string) error {
+	*paths = append(*paths, path)
+	return nil
+}
+
+// Finds the file included by the last file of the include stack. The path is relative to the
+// including file first, then to each of the include paths and finally to the current directory.
+func resolveInclude(state *ProgramState, path string) (string, error) {
+	if filepath.IsAbs(path) {
+		if !isRegularFile(path) {
+			state.Sources.AddMissing(path)
+			return "", fmt.Errorf("File \"%s\" not found", path)
+		}
+		return path, nil
+	}
+
+	searched := []string{}
+	if len(state.IncludeStack) > 0 {
+		searched = append(searched, filepath.Dir(state.IncludeStack[len(state.IncludeStack)-1]))
+	}
+	searched = append(searched, state.IncludePaths...)
+	searched = append(searched, ".")
+
+	for _, dir := range searched {
+		candidate := filepath.Join(dir, path)
+		if isRegularFile(candidate) {
+			return candidate, nil
+		}
+	}
+	for _, dir := range searched {
+		state.Sources.AddMissing(filepath.Join(dir, path))
+	}
+
+	return "", fmt.Errorf(
+		"File \"%s\" not found. Searched in:\n\t%s",
+		path,
+		strings.Join(searched, "\n\t"),
+	)
+}
+
+// Splits the arguments of a directive reading a file: a path (between quotes if it contains
+// spaces or commas) followed by comma separated parameters.
+func parseFileArguments(arguments string) (string, []string, error) {
+	arguments = strings.TrimSpace(arguments)
+	if arguments == "" {
+		return "", nil, fmt.Errorf("Missing file path")
+	}
+
+	var path, rest string
+	if arguments[0] == '"' || arguments[0] == '\'' {
+		end := strings.IndexByte(arguments[1:], arguments[0])
+		if end < 0 {
+			return "", nil, fmt.Errorf("Missing closing quote in %s", arguments)
+		}
+		path = arguments[1 : end+1]
+		rest = strings.TrimSpace(arguments[end+2:])
+	} else {
+		path, rest, _ = strings.Cut(arguments, ",")
+		path = strings.TrimSpace(path)
+		rest = "," + rest
+	}
+
+	if rest == "" || rest == "," {
+		return path, []string{}, nil
+	}
+	if rest[0] != ',' {
+		return "", nil, fmt.Errorf("Expected a comma after the file path (in %s)", arguments)
+	}
+
+	parameters := strings.Split(rest[1:], ",")
+	for i := range parameters {
+		parameters[i] = strings.TrimSpace(parameters[i])
+	}
+	return path, parameters, nil
+}
+
+func isRegularFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// Returns an error if the file is already being included
+func checkIncludeCycle(state *ProgramState, path string) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	for i, included := range state.IncludeStack {
+		absIncluded, err := filepath.Abs(included)
+		if err != nil {
+			return err
+		}
+
+		if absIncluded == absPath {
+			cycle := append(slices.Clone(state.IncludeStack[i:]), path)
+			return fmt.Errorf("Include cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+	return nil
+}
+
+// Reads the files needed by the program and keeps the list of them (for the dependency file and
+// the watch mode). When cache is set, the content of the files that didn't change since they were
+// last read is reused.
+type SourceFiles struct {
+	Paths []string
+	// Where the included files that weren't found were searched, so that the watch mode notices
+	// when they are created
+	Missing []string
+	cache   map[string]cachedFile
+}
+
+func (sources *SourceFiles) AddMissing(path string) {
+	if sources != nil && !slices.Contains(sources.Missing, path) {
+		sources.Missing = append(sources.Missing, path)
+	}
+}
+
+type cachedFile struct {
+	modTime time.Time
+	size    int64
+	content []byte
+}
+
+func (sources *SourceFiles) Read(path string) ([]byte, error) {
+	if sources != nil && !slices.Contains(sources.Paths, path) {
+		sources.Paths = append(sources.Paths, path)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error while opening file %s", path)
+	}
+
+	if sources != nil && sources.cache != nil {
+		cached, ok := sources.cache[path]
+		if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+			return cached.content, nil
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error while opening file %s", path)
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("Error while reading file %s", path)
+	}
+
+	if sources != nil && sources.cache != nil {
+		sources.cache[path] = cachedFile{modTime: info.ModTime(), size: info.Size(), content: content}
+	}
+	return content, nil
+}
+
+// Writes a Makefile rule making the output depend on every file read. Every file also gets an
+// empty rule so make doesn't fail when one of them is removed.
+func (sources *SourceFiles) WriteDependencies(dependencyFileName string, outputFileName string) error {
+	escape := func(path string) string {
+		return strings.ReplaceAll(strings.ReplaceAll(path, "$", "$$"), " ", "\\ ")
+	}
+
+	rule := escape(outputFileName) + ":"
+	for _, path := range sources.Paths {
+		rule += " \\\n\t" + escape(path)
+	}
+	rule += "\n"
+	for _, path := range sources.Paths {
+		rule += "\n" + escape(path) + ":\n"
+	}
+
+	return os.WriteFile(dependencyFileName, []byte(rule), 0o644)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Writes the files (whose names can contain directories) under dir
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, []byte(content), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Runs the test from dir, which the includes can be relative to
+func chdirTest(t *testing.T, dir string) {
+	t.Helper()
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(previous) })
+}
+
+func TestIncludeResolutionOrder(t *testing.T) {
+	project, library, cwd := t.TempDir(), t.TempDir(), t.TempDir()
+	// The includer's directory comes first, then the include paths and then the current directory
+	writeTestFiles(t, project, map[string]string{
+		"main.gbasm":     ".INCLUDE \"src/game.gbasm\"\n",
+		"src/game.gbasm": ".INCLUDE \"near.gbasm\"\n.INCLUDE \"lib.gbasm\"\n.INCLUDE \"cwd.gbasm\"\n",
+		"src/near.gbasm": ".DB $01\n",
+	})
+	writeTestFiles(t, library, map[string]string{
+		"near.gbasm": ".DB $f1\n",
+		"lib.gbasm":  ".DB $02\n",
+	})
+	writeTestFiles(t, cwd, map[string]string{
+		"near.gbasm": ".DB $e1\n",
+		"lib.gbasm":  ".DB $e2\n",
+		"cwd.gbasm":  ".DB $03\n",
+	})
+	chdirTest(t, cwd)
+
+	options := Options{Quiet: true, Sources: &SourceFiles{}, IncludePaths: IncludePaths{library}}
+	result, err := assembleROM(filepath.Join(project, "main.gbasm"), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0x01, 0x02, 0x03}
+	if !bytes.Equal(result, expected) {
+		t.Errorf("Got % x, expected % x", result, expected)
+	}
+
+	_, err = assembleTestFile(t, ".INCLUDE \"missing.gbasm\"\n", nil)
+	if err == nil || !strings.Contains(err.Error(), "File \"missing.gbasm\" not found. Searched in:") {
+		t.Errorf("Expected the directories searched for missing.gbasm, got %v", err)
+	}
+}
+
+func TestIncludeCycle(t *testing.T) {
+	files := map[string][]byte{
+		"a.gbasm": []byte(".DB $01\n.INCLUDE \"b.gbasm\"\n"),
+		"b.gbasm": []byte(".INCLUDE \"a.gbasm\"\n"),
+		"c.gbasm": []byte(".DB $02\n"),
+	}
+
+	_, err := assembleTestFile(t, ".INCLUDE \"a.gbasm\"\n", files)
+	if err == nil || !strings.Contains(err.Error(), "Include cycle: ") {
+		t.Fatalf("Expected an include cycle, got %v", err)
+	}
+	cycle := err.Error()[strings.Index(err.Error(), "Include cycle: "):]
+	names := []string{}
+	for _, path := range strings.Split(strings.TrimPrefix(cycle, "Include cycle: "), " -> ") {
+		names = append(names, filepath.Base(path))
+	}
+	if strings.Join(names, " -> ") != "a.gbasm -> b.gbasm -> a.gbasm" {
+		t.Errorf("Got the cycle %s", cycle)
+	}
+
+	// Including the same file twice isn't a cycle
+	result, err := assembleTestFile(t, ".INCLUDE \"c.gbasm\"\n.INCLUDE \"c.gbasm\"\n", files)
+	if err != nil || !bytes.Equal(result, []byte{0x02, 0x02}) {
+		t.Errorf("Got % x (%v), expected 02 02", result, err)
+	}
+}
+
+func TestDependencyFile(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{
+		"main.gbasm":   ".INCLUDE \"lib.gbasm\"\n.INCLUDEBIN \"my data.bin\"\n.INCLUDE \"lib.gbasm\"\n",
+		"lib.gbasm":    ".INCLUDEBIN \"$1.bin\"\n",
+		"my data.bin":  "\x02",
+		"$1.bin":       "\x01",
+		"unused.gbasm": ".DB $03\n",
+	})
+	chdirTest(t, dir)
+
+	options := Options{Quiet: true, Sources: &SourceFiles{}}
+	err := assemble("main.gbasm", "out.gb", options, "out.d")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rule, err := os.ReadFile("out.d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every file read once, in order, with the spaces and dollars escaped, and an empty rule for each
+	// of them
+	expected := "out.gb: \\\n\tmain.gbasm \\\n\tlib.gbasm \\\n\t$$1.bin \\\n\tmy\\ data.bin\n" +
+		"\nmain.gbasm:\n\nlib.gbasm:\n\n$$1.bin:\n\nmy\\ data.bin:\n"
+	if string(rule) != expected {
+		t.Errorf("Got\n%s\nexpected\n%s", rule, expected)
+	}
+}
+
+func TestIncludeBinary(t *testing.T) {
+	files := map[string][]byte{"data.bin": {0, 1, 2, 3, 4, 5, 6, 7}}
+	tests := []struct {
+		source   string
+		expected []byte
+		err      string
+	}{
+		{".INCLUDEBIN \"data.bin\"\n", []byte{0, 1, 2, 3, 4, 5, 6, 7}, ""},
+		{".INCLUDEBIN \"data.bin\", 6\n", []byte{6, 7}, ""},
+		{".INCLUDEBIN \"data.bin\", 2, 3\n", []byte{2, 3, 4}, ""},
+		{".INCLUDEBIN \"data.bin\", $8, 0\n", []byte{}, ""},
+		{".DEFINE START 5\n.INCLUDEBIN \"data.bin\", $START, 1\n", []byte{5}, ""},
+		{".DEFINE SIZE sizeof_file(\"data.bin\")\n\tLD A, $SIZE\n", []byte{0x3e, 0x08}, ""},
+		{".INCLUDEBIN \"data.bin\", 9\n", nil, "Offset $9 is past the end of"},
+		{".INCLUDEBIN \"data.bin\", 6, 3\n", nil, "Cannot include 3 bytes from offset $6"},
+		{".INCLUDEBIN \"data.bin\", 0, 1, 2\n", nil, "takes a file path, an optional offset and an optional length"},
+		{".PADTO $3ffe\n.INCLUDEBIN \"data.bin\", 0, 4\n", nil, "($4 bytes) doesn't fit in bank 0"},
+		{".DEFINE SIZE sizeof_file(\"data.bin\", 1)\n", nil, "sizeof_file only takes a file path"},
+		{".DEFINE SIZE sizeof_file(\"missing.bin\")\n", nil, "File \"missing.bin\" not found"},
+	}
+	for _, test := range tests {
+		result, err := assembleTestFile(t, test.source, files)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: expected an error containing %q, got %v", test.source, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.source, err)
+		} else if !bytes.Equal(result, test.expected) {
+			t.Errorf("%q: got % x, expected % x", test.source, result, test.expected)
+		}
+	}
+
+	// A whole file can span several banks
+	result, err := assembleTestFile(t, ".PADTO $3ffe\n.INCLUDEBIN \"data.bin\"\n", files)
+	if err != nil || len(result) != 0x4006 {
+		t.Errorf("Got %d bytes (%v) instead of $4006", len(result), err)
+	}
+}
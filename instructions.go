@@ -10,10 +10,33 @@ type ParamType func(labels *Labels, lastAbsoluteLabel string, defs *Definitions,
 type InstructionParams struct {
 	Types            []ParamType
 	Assembler        func(currentAddress uint32, args []uint32) ([]uint8, error)
+	// Used instead of Assembler by the macros defined by .MACRODEF, which also return the cost of
+	// their expansion
+	TimedAssembler   func(currentAddress uint32, args []uint32) ([]uint8, InstructionTiming, error)
 	Wildcard         bool
 	MacroForbidden   bool
+	// The parameters are resolved during the first pass too, with the labels already defined in
+	// this pass and the ones found by the previous pass (instead of 0 for every label)
 	LabelsBeforeOnly bool
 	SkipFirstPass    bool
+	// Cost in M-cycles (4 clock cycles). The conditional branches cost TakenCycles when they are
+	// taken and HLCycles replaces Cycles when a register parameter is (HL).
+	Cycles      int
+	TakenCycles int
+	HLCycles    int
+}
+
+func (params InstructionParams) timing(arguments []string) InstructionTiming {
+	cycles := params.Cycles
+	for _, argument := range arguments {
+		if params.HLCycles != 0 && strings.EqualFold(argument, "(HL)") {
+			cycles = params.HLCycles
+		}
+	}
+	if params.TakenCycles != 0 {
+		return InstructionTiming{cycles, params.TakenCycles}
+	}
+	return InstructionTiming{cycles, cycles}
 }
 
 type InstructionSet map[string][]InstructionParams
@@ -26,7 +49,7 @@ func absoluteJPValueToRelative(baseAddress uint32, absoluteAddress uint32) (uint
 		baseAddressAfterBanking = (baseAddress % 0x4000 + 0x4000)
 	}
 	newAddress := (int32(absoluteAddress) - int32(baseAddressAfterBanking) - 2)
-	if newAddress < -127 || newAddress > 128 {
+	if newAddress < -128 || newAddress > 127 {
 		return 0, fmt.Errorf(
 			"Address 0x%04x and 0x%04x are too far apart to use JR. Please use JP instead",
 			baseAddressAfterBanking,
@@ -47,6 +70,8 @@ func InstructionSetNew() InstructionSet {
 					0b01000000 | (uint8(uint8(args[0])) << 3) | uint8(uint8(args[1])),
 				}, nil
 			},
+			Cycles:   1,
+			HLCycles: 2,
 		},
 		// {
 		// 	Types:     []ParamType{HL, Raw8Indirect},
@@ -57,42 +82,52 @@ func InstructionSetNew() InstructionSet {
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) {
 				return []byte{0b00000110 | (uint8(args[0]) << 3), uint8(args[1])}, nil
 			},
+			Cycles:   2,
+			HLCycles: 3,
 		},
 		{
 			Types:     []ParamType{A, Raw8Indirect},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b11110000, uint8(args[1])}, nil },
+			Cycles:    3,
 		},
 		{
 			Types:     []ParamType{Raw8Indirect, A},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b11100000, uint8(args[0])}, nil },
+			Cycles:    3,
 		},
 		{
 			Types:     []ParamType{A, Reg16Indirect},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b00001010 | uint8(args[1])<<4}, nil },
+			Cycles:    2,
 		},
 		{
 			Types:     []ParamType{Reg16Indirect, A},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b00000010 | uint8(args[0])<<4}, nil },
+			Cycles:    2,
 		},
 		{
 			Types: []ParamType{A, Raw16Indirect},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) {
 				return []byte{0b11111010, uint8(args[1]) & 0xff, uint8(args[1] >> 8)}, nil
 			},
+			Cycles: 4,
 		},
 		{
 			Types: []ParamType{Raw16Indirect, A},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) {
 				return []byte{0b11101010, uint8(args[0]) & 0xff, uint8(args[0] >> 8)}, nil
 			},
+			Cycles: 4,
 		},
 		{
 			Types:     []ParamType{A, IndirectC},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b11110010}, nil },
+			Cycles:    2,
 		},
 		{
 			Types:     []ParamType{IndirectC, A},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b11100010}, nil },
+			Cycles:    2,
 		},
 		{
 			Types: []ParamType{Reg16, Raw16},
@@ -103,162 +138,203 @@ func InstructionSetNew() InstructionSet {
 					uint8(args[1] >> 8),
 				}, nil
 			},
+			Cycles: 3,
 		},
 		{
 			Types: []ParamType{Raw16Indirect, SP},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) {
 				return []byte{0b00001000, uint8(args[0]) & 0xff, uint8(args[0] >> 8)}, nil
 			},
+			Cycles: 5,
 		},
 		{
 			Types:     []ParamType{SP, HL},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b11111001}, nil },
+			Cycles:    2,
 		},
 	}
 	result["PUSH"] = []InstructionParams{
 		{
 			Types:     []ParamType{Reg16},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b11000101 | (uint8(args[0]) << 4)}, nil },
+			Cycles:    4,
 		},
 	}
 	result["POP"] = []InstructionParams{
 		{
 			Types:     []ParamType{Reg16},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b11000001 | (uint8(args[0]) << 4)}, nil },
+			Cycles:    3,
 		},
 	}
 	result["ADD"] = []InstructionParams{
 		{
 			Types:     []ParamType{Reg8},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b10000000 | (uint8(args[0]))}, nil },
+			Cycles:    1,
+			HLCycles:  2,
 		},
 		{
 			Types:     []ParamType{Raw8},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b11000110, uint8(args[0])}, nil },
+			Cycles:    2,
 		},
 		{
 			Types:     []ParamType{SP, Raw8},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b11101000, uint8(args[1])}, nil },
+			Cycles:    4,
 		},
 		{
 			Types:     []ParamType{HL, Reg16},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b00001001 | (uint8(args[1] << 4))}, nil },
+			Cycles:    2,
 		},
 	}
 	result["ADC"] = []InstructionParams{
 		{
 			Types:     []ParamType{Reg8},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b10001000 | uint8(args[0])}, nil },
+			Cycles:    1,
+			HLCycles:  2,
 		},
 		{
 			Types:     []ParamType{Raw8},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b11001110, uint8(args[0])}, nil },
+			Cycles:    2,
 		},
 	}
 	result["SUB"] = []InstructionParams{
 		{
 			Types:     []ParamType{Reg8},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b10010000 | (uint8(args[0]))}, nil },
+			Cycles:    1,
+			HLCycles:  2,
 		},
 		{
 			Types:     []ParamType{Raw8},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b11010110, uint8(args[0])}, nil },
+			Cycles:    2,
 		},
 	}
 	result["SBC"] = []InstructionParams{
 		{
 			Types:     []ParamType{Reg8},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b10011000 | uint8(args[0])}, nil },
+			Cycles:    1,
+			HLCycles:  2,
 		},
 		{
 			Types:     []ParamType{Raw8},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b11011110, uint8(args[0])}, nil },
+			Cycles:    2,
 		},
 	}
 	result["CP"] = []InstructionParams{
 		{
 			Types:     []ParamType{Reg8},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b10111000 | (uint8(args[0]))}, nil },
+			Cycles:    1,
+			HLCycles:  2,
 		},
 		{
 			Types:     []ParamType{Raw8},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b11111110, uint8(args[0])}, nil },
+			Cycles:    2,
 		},
 	}
 	result["INC"] = []InstructionParams{
 		{
 			Types:     []ParamType{Reg8},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b00000100 | (uint8(args[0]) << 3)}, nil },
+			Cycles:    1,
+			HLCycles:  3,
 		},
 
 		{
 			Types:     []ParamType{Reg16},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b00000011 | (uint8(args[0]) << 4)}, nil },
+			Cycles:    2,
 		},
 	}
 	result["DEC"] = []InstructionParams{
 		{
 			Types:     []ParamType{Reg8},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b00000101 | (uint8(args[0]) << 3)}, nil },
+			Cycles:    1,
+			HLCycles:  3,
 		},
 
 		{
 			Types:     []ParamType{Reg16},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b00001011 | (uint8(args[0]) << 4)}, nil },
+			Cycles:    2,
 		},
 	}
 	result["AND"] = []InstructionParams{
 		{
 			Types:     []ParamType{Reg8},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b10100000 | (uint8(args[0]))}, nil },
+			Cycles:    1,
+			HLCycles:  2,
 		},
 		{
 			Types:     []ParamType{Raw8},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b11100110, uint8(args[0])}, nil },
+			Cycles:    2,
 		},
 	}
 	result["OR"] = []InstructionParams{
 		{
 			Types:     []ParamType{Reg8},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b10110000 | (uint8(args[0]))}, nil },
+			Cycles:    1,
+			HLCycles:  2,
 		},
 		{
 			Types:     []ParamType{Raw8},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b11110110, uint8(args[0])}, nil },
+			Cycles:    2,
 		},
 	}
 	result["XOR"] = []InstructionParams{
 		{
 			Types:     []ParamType{Reg8},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b10101000 | (uint8(args[0]))}, nil },
+			Cycles:    1,
+			HLCycles:  2,
 		},
 		{
 			Types:     []ParamType{Raw8},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b11101110, uint8(args[0])}, nil },
+			Cycles:    2,
 		},
 	}
 	result["CCF"] = []InstructionParams{
 		{
 			Types:     []ParamType{},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b00111111}, nil },
+			Cycles:    1,
 		},
 	}
 	result["SCF"] = []InstructionParams{
 		{
 			Types:     []ParamType{},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b00110111}, nil },
+			Cycles:    1,
 		},
 	}
 	result["DAA"] = []InstructionParams{
 		{
 			Types:     []ParamType{},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b00100111}, nil },
+			Cycles:    1,
 		},
 	}
 	result["CPL"] = []InstructionParams{
 		{
 			Types:     []ParamType{},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b00101111}, nil },
+			Cycles:    1,
 		},
 	}
 	result["JP"] = []InstructionParams{
@@ -267,10 +343,12 @@ func InstructionSetNew() InstructionSet {
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) {
 				return []byte{0b11000011, uint8(args[0]) & 0xff, uint8(args[0] >> 8)}, nil
 			},
+			Cycles: 4,
 		},
 		{
 			Types:     []ParamType{HL},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b11101001}, nil },
+			Cycles:    1,
 		},
 		{
 			Types: []ParamType{Condition, Raw16},
@@ -281,18 +359,23 @@ func InstructionSetNew() InstructionSet {
 					uint8(args[1] >> 8),
 				}, nil
 			},
+			Cycles:      3,
+			TakenCycles: 4,
 		},
 	}
 	result["JR"] = []InstructionParams{
 		{
 			Types:     []ParamType{Raw8},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b00011000, uint8(args[0])}, nil },
+			Cycles:    3,
 		},
 		{
 			Types: []ParamType{Condition, Raw8},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) {
 				return []byte{0b00100000 | (uint8(args[0]) << 3), uint8(args[1])}, nil
 			},
+			Cycles:      2,
+			TakenCycles: 3,
 		},
 		{
 			Types: []ParamType{Raw16},
@@ -303,6 +386,7 @@ func InstructionSetNew() InstructionSet {
 				}
 				return []byte{0b00011000, relativeAddress}, nil
 			},
+			Cycles: 3,
 		},
 		{
 			Types: []ParamType{Condition, Raw16},
@@ -313,6 +397,8 @@ func InstructionSetNew() InstructionSet {
 				}
 				return []byte{0b00100000 | (uint8(args[0]) << 3), relativeAddress}, nil
 			},
+			Cycles:      2,
+			TakenCycles: 3,
 		},
 	}
 	result["CALL"] = []InstructionParams{
@@ -321,6 +407,7 @@ func InstructionSetNew() InstructionSet {
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) {
 				return []byte{0b11001101, uint8(args[0]) & 0xff, uint8(args[0] >> 8)}, nil
 			},
+			Cycles: 6,
 		},
 		{
 			Types: []ParamType{Condition, Raw16},
@@ -331,82 +418,98 @@ func InstructionSetNew() InstructionSet {
 					uint8(args[1] >> 8),
 				}, nil
 			},
+			Cycles:      3,
+			TakenCycles: 6,
 		},
 	}
 	result["RET"] = []InstructionParams{
 		{
 			Types:     []ParamType{},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b11001001}, nil },
+			Cycles:    4,
 		},
 		{
-			Types:     []ParamType{Condition},
-			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b11000000 | (uint8(args[0]) << 3)}, nil },
+			Types:       []ParamType{Condition},
+			Assembler:   func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b11000000 | (uint8(args[0]) << 3)}, nil },
+			Cycles:      2,
+			TakenCycles: 5,
 		},
 	}
 	result["RETI"] = []InstructionParams{
 		{
 			Types:     []ParamType{},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b11011001}, nil },
+			Cycles:    4,
 		},
 	}
 	result["RST"] = []InstructionParams{
 		{
 			Types:     []ParamType{BitOrdinal},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b11000111 | (uint8(args[0]) << 3)}, nil },
+			Cycles:    4,
 		},
 	}
 	result["DI"] = []InstructionParams{
 		{
 			Types:     []ParamType{},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b11110011}, nil },
+			Cycles:    1,
 		},
 	}
 	result["EI"] = []InstructionParams{
 		{
 			Types:     []ParamType{},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b11111011}, nil },
+			Cycles:    1,
 		},
 	}
 	result["NOP"] = []InstructionParams{
 		{
 			Types:     []ParamType{},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b00000000}, nil },
+			Cycles:    1,
 		},
 	}
 	result["HALT"] = []InstructionParams{
 		{
 			Types:     []ParamType{},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b01110110}, nil },
+			Cycles:    1,
 		},
 	}
 	result["STOP"] = []InstructionParams{
 		{
 			Types:     []ParamType{},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b00010000, 0b00000000}, nil },
+			Cycles:    1,
 		},
 	}
 	result["RLCA"] = []InstructionParams{
 		{
 			Types:     []ParamType{},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b00000111}, nil },
+			Cycles:    1,
 		},
 	}
 	result["RLA"] = []InstructionParams{
 		{
 			Types:     []ParamType{},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b00010111}, nil },
+			Cycles:    1,
 		},
 	}
 	result["RRCA"] = []InstructionParams{
 		{
 			Types:     []ParamType{},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b00001111}, nil },
+			Cycles:    1,
 		},
 	}
 	result["RRA"] = []InstructionParams{
 		{
 			Types:     []ParamType{},
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) { return []byte{0b00011111}, nil },
+			Cycles:    1,
 		},
 	}
 	result["BIT"] = []InstructionParams{
@@ -415,6 +518,8 @@ func InstructionSetNew() InstructionSet {
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) {
 				return []byte{0b11001011, 0b01000000 | (uint8(args[0]) << 3) | uint8(args[1])}, nil
 			},
+			Cycles:   2,
+			HLCycles: 3,
 		},
 	}
 	result["SET"] = []InstructionParams{
@@ -423,6 +528,8 @@ func InstructionSetNew() InstructionSet {
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) {
 				return []byte{0b11001011, 0b11000000 | (uint8(args[0]) << 3) | uint8(args[1])}, nil
 			},
+			Cycles:   2,
+			HLCycles: 4,
 		},
 	}
 	result["RES"] = []InstructionParams{
@@ -431,6 +538,8 @@ func InstructionSetNew() InstructionSet {
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) {
 				return []byte{0b11001011, 0b10000000 | (uint8(args[0]) << 3) | uint8(args[1])}, nil
 			},
+			Cycles:   2,
+			HLCycles: 4,
 		},
 	}
 	result["RLC"] = []InstructionParams{
@@ -439,6 +548,8 @@ func InstructionSetNew() InstructionSet {
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) {
 				return []byte{0b11001011, 0b00000000 | uint8(args[0])}, nil
 			},
+			Cycles:   2,
+			HLCycles: 4,
 		},
 	}
 	result["RL"] = []InstructionParams{
@@ -447,6 +558,8 @@ func InstructionSetNew() InstructionSet {
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) {
 				return []byte{0b11001011, 0b00010000 | uint8(args[0])}, nil
 			},
+			Cycles:   2,
+			HLCycles: 4,
 		},
 	}
 	result["RRC"] = []InstructionParams{
@@ -455,6 +568,8 @@ func InstructionSetNew() InstructionSet {
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) {
 				return []byte{0b11001011, 0b00001000 | uint8(args[0])}, nil
 			},
+			Cycles:   2,
+			HLCycles: 4,
 		},
 	}
 	result["RR"] = []InstructionParams{
@@ -463,6 +578,8 @@ func InstructionSetNew() InstructionSet {
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) {
 				return []byte{0b11001011, 0b00011000 | uint8(args[0])}, nil
 			},
+			Cycles:   2,
+			HLCycles: 4,
 		},
 	}
 	result["SLA"] = []InstructionParams{
@@ -471,6 +588,8 @@ func InstructionSetNew() InstructionSet {
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) {
 				return []byte{0b11001011, 0b00100000 | uint8(args[0])}, nil
 			},
+			Cycles:   2,
+			HLCycles: 4,
 		},
 	}
 	result["SWAP"] = []InstructionParams{
@@ -479,6 +598,8 @@ func InstructionSetNew() InstructionSet {
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) {
 				return []byte{0b11001011, 0b00110000 | uint8(args[0])}, nil
 			},
+			Cycles:   2,
+			HLCycles: 4,
 		},
 	}
 	result["SRA"] = []InstructionParams{
@@ -487,6 +608,8 @@ func InstructionSetNew() InstructionSet {
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) {
 				return []byte{0b11001011, 0b00101000 | uint8(args[0])}, nil
 			},
+			Cycles:   2,
+			HLCycles: 4,
 		},
 	}
 	result["SRL"] = []InstructionParams{
@@ -495,6 +618,8 @@ func InstructionSetNew() InstructionSet {
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) {
 				return []byte{0b11001011, 0b00111000 | uint8(args[0])}, nil
 			},
+			Cycles:   2,
+			HLCycles: 4,
 		},
 	}
 	result["DBG"] = []InstructionParams{
@@ -503,6 +628,7 @@ func InstructionSetNew() InstructionSet {
 			Assembler: func(_ uint32, args []uint32) ([]byte, error) {
 				return []byte{0b11010011}, nil
 			},
+			Cycles: 1,
 		},
 	}
 
@@ -518,15 +644,29 @@ func (set InstructionSet) Parse(
 	lastAbsoluteLabel string,
 	line string,
 ) ([]byte, error) {
+	result, _, err := set.ParseTimed(labels, defs, isMacro, isFirstPass, currentAddress, lastAbsoluteLabel, line)
+	return result, err
+}
+
+// Parse, also returning the cost of the instruction
+func (set InstructionSet) ParseTimed(
+	labels *Labels,
+	defs *Definitions,
+	isMacro bool,
+	isFirstPass bool,
+	currentAddress uint32,
+	lastAbsoluteLabel string,
+	line string,
+) ([]byte, InstructionTiming, error) {
 	words := strings.Fields(strings.ReplaceAll(strings.Trim(line, " \t\n"), ",", " "))
 
 	if len(words) < 1 {
-		return []uint8{}, nil
+		return []uint8{}, InstructionTiming{}, nil
 	}
 
 	instruction, ok := set[words[0]]
 	if !ok {
-		return nil, fmt.Errorf("Unknown instruction \"%s\"", words[0])
+		return nil, InstructionTiming{}, fmt.Errorf("Unknown instruction \"%s\"", words[0])
 	}
 
 	params := words[1:]
@@ -535,7 +675,7 @@ func (set InstructionSet) Parse(
 instruction_param_loop:
 	for _, instrParam := range instruction {
 		if instrParam.SkipFirstPass && isFirstPass {
-			return []byte{}, nil
+			return []byte{}, InstructionTiming{}, nil
 		}
 
 		if !instrParam.Wildcard && len(instrParam.Types) != len(params) {
@@ -581,9 +721,13 @@ instruction_param_loop:
 			// return nil, fmt.Errorf("")
 		}
 
-		return instrParam.Assembler(currentAddress, parsed_params)
+		if instrParam.TimedAssembler != nil {
+			return instrParam.TimedAssembler(currentAddress, parsed_params)
+		}
+		result, err := instrParam.Assembler(currentAddress, parsed_params)
+		return result, instrParam.timing(params), err
 	}
-	return nil, fmt.Errorf(
+	return nil, InstructionTiming{}, fmt.Errorf(
 		"Instruction \"%s\" doesn't have a parameter set that can parse \"%s\"\n%w",
 		words[0],
 		line,
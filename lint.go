@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+type MemoryRegion struct {
+	Start uint16
+	End   uint16
+	Name  string
+}
+
+var memoryRegions = []MemoryRegion{
+	{0x0000, 0x7fff, "ROM"},
+	{0x8000, 0x9fff, "VRAM"},
+	{0xa000, 0xbfff, "cartridge RAM"},
+	{0xc000, 0xdfff, "WRAM"},
+	{0xe000, 0xfdff, "echo RAM"},
+	{0xfe00, 0xfe9f, "OAM"},
+	{0xfea0, 0xfeff, "unusable memory"},
+	{0xff00, 0xff7f, "IO registers"},
+	{0xff80, 0xfffe, "HRAM"},
+	{0xffff, 0xffff, "IE"},
+}
+
+func memoryRegion(address uint16) MemoryRegion {
+	for _, region := range memoryRegions {
+		if address >= region.Start && address <= region.End {
+			return region
+		}
+	}
+	return MemoryRegion{}
+}
+
+// The IO registers of the DMG and the CGB. The other addresses from $ff00 to $ff7f do nothing.
+var ioRegisters = map[uint16]string{
+	0xff00: "P1", 0xff01: "SB", 0xff02: "SC", 0xff04: "DIV", 0xff05: "TIMA", 0xff06: "TMA", 0xff07: "TAC",
+	0xff0f: "IF",
+	0xff10: "NR10", 0xff11: "NR11", 0xff12: "NR12", 0xff13: "NR13", 0xff14: "NR14",
+	0xff16: "NR21", 0xff17: "NR22", 0xff18: "NR23", 0xff19: "NR24",
+	0xff1a: "NR30", 0xff1b: "NR31", 0xff1c: "NR32", 0xff1d: "NR33", 0xff1e: "NR34",
+	0xff20: "NR41", 0xff21: "NR42", 0xff22: "NR43", 0xff23: "NR44",
+	0xff24: "NR50", 0xff25: "NR51", 0xff26: "NR52",
+	0xff40: "LCDC", 0xff41: "STAT", 0xff42: "SCY", 0xff43: "SCX", 0xff44: "LY", 0xff45: "LYC",
+	0xff46: "DMA", 0xff47: "BGP", 0xff48: "OBP0", 0xff49: "OBP1", 0xff4a: "WY", 0xff4b: "WX",
+	0xff4d: "KEY1", 0xff4f: "VBK", 0xff50: "BANK",
+	0xff51: "HDMA1", 0xff52: "HDMA2", 0xff53: "HDMA3", 0xff54: "HDMA4", 0xff55: "HDMA5", 0xff56: "RP",
+	0xff68: "BCPS", 0xff69: "BCPD", 0xff6a: "OCPS", 0xff6b: "OCPD", 0xff6c: "OPRI", 0xff70: "SVBK",
+}
+
+var readOnlyRegisters = map[uint16]bool{0xff44: true}
+
+// Reading them gives $ff
+var writeOnlyRegisters = map[uint16]bool{
+	0xff13: true, 0xff18: true, 0xff1b: true, 0xff1d: true, 0xff20: true,
+	0xff51: true, 0xff52: true, 0xff53: true, 0xff54: true,
+}
+
+func ioRegisterName(address uint16) string {
+	if address >= 0xff30 && address <= 0xff3f {
+		return "the wave RAM"
+	}
+	return fmt.Sprintf("%s ($%04x)", ioRegisters[address], address)
+}
+
+type LintWarning struct {
+	File    string
+	Line    int
+	Message string
+	// Writes to the ROM are only reported if the address isn't declared by .MBC_WRITE
+	ROMWrite   bool
+	ROMAddress uint16
+}
+
+// Accesses to constant addresses that are probably mistakes, and instructions hitting known
+// hardware quirks
+type Lint struct {
+	Warnings []LintWarning
+	// Addresses of the ROM written to control the MBC, declared by .MBC_WRITE
+	MBCWrites map[uint16]bool
+	// The opcode of the previous instruction, -1 after data
+	previous int
+}
+
+func NewLint() *Lint {
+	return &Lint{MBCWrites: map[uint16]bool{}, previous: -1}
+}
+
+func (lint *Lint) warn(file string, line int, format string, args ...any) {
+	lint.Warnings = append(lint.Warnings, LintWarning{File: file, Line: line, Message: fmt.Sprintf(format, args...)})
+}
+
+// Checks the instructions assembled from a line
+func (lint *Lint) Check(file string, line int, code []byte) {
+	for len(code) > 0 {
+		opcode := code[0]
+		length := instructionLength(opcode)
+		if len(code) < length {
+			return
+		}
+
+		switch opcode {
+		case 0xea, 0x08:
+			// LD (n16), A and LD (n16), SP
+			lint.checkAccess(file, line, uint16(code[1])|uint16(code[2])<<8, true)
+		case 0xfa:
+			lint.checkAccess(file, line, uint16(code[1])|uint16(code[2])<<8, false)
+		case 0xe0:
+			lint.checkAccess(file, line, 0xff00|uint16(code[1]), true)
+		case 0xf0:
+			lint.checkAccess(file, line, 0xff00|uint16(code[1]), false)
+		case 0x76:
+			if lint.previous == 0xf3 {
+				lint.warn(
+					file,
+					line,
+					"HALT right after DI only ends when an interrupt is requested, without calling it, and if one is already requested, the HALT bug runs the next byte twice",
+				)
+			}
+		}
+
+		lint.previous = int(opcode)
+		code = code[length:]
+	}
+}
+
+// Data was inserted between two instructions
+func (lint *Lint) Data() {
+	lint.previous = -1
+}
+
+func (lint *Lint) checkAccess(file string, line int, address uint16, write bool) {
+	region := memoryRegion(address)
+	switch region.Name {
+	case "ROM":
+		if write {
+			lint.Warnings = append(lint.Warnings, LintWarning{
+				File:       file,
+				Line:       line,
+				Message:    fmt.Sprintf("Writes to $%04x in the ROM, which sets a register of the MBC (declare it with .MBC_WRITE if it is on purpose)", address),
+				ROMWrite:   true,
+				ROMAddress: address,
+			})
+		}
+	case "echo RAM":
+		lint.warn(file, line, "Accesses $%04x in the echo RAM, a mirror of $%04x in WRAM", address, address-0x2000)
+	case "unusable memory":
+		lint.warn(file, line, "Accesses $%04x in the unusable memory from $fea0 to $feff", address)
+	case "IO registers":
+		_, isRegister := ioRegisters[address]
+		isWaveRAM := address >= 0xff30 && address <= 0xff3f
+		switch {
+		case !isRegister && !isWaveRAM:
+			lint.warn(file, line, "$%04x is not an IO register", address)
+		case write && readOnlyRegisters[address]:
+			lint.warn(file, line, "Writes to %s, which is read only", ioRegisterName(address))
+		case !write && writeOnlyRegisters[address]:
+			lint.warn(file, line, "Reads %s, which is write only and always reads $ff", ioRegisterName(address))
+		}
+	}
+}
+
+// The warnings left once the intended writes to the MBC are known
+func (lint *Lint) Reported() []LintWarning {
+	reported := []LintWarning{}
+	for _, warning := range lint.Warnings {
+		if warning.ROMWrite && lint.MBCWrites[warning.ROMAddress] {
+			continue
+		}
+		reported = append(reported, warning)
+	}
+	return reported
+}
+
+func (lint *Lint) PrintWarnings() {
+	for _, warning := range lint.Reported() {
+		fmt.Fprintf(os.Stderr, "Warning: File %s, line %d: %s\n", warning.File, warning.Line, warning.Message)
+	}
+}
+
+// .MBC_WRITE addr, ...: the program writes to these addresses of the ROM to control the MBC
+func declareMBCWrites(state *ProgramState, arguments string) error {
+	if strings.TrimSpace(arguments) == "" {
+		return fmt.Errorf(".MBC_WRITE takes the addresses of the MBC registers written by the program")
+	}
+
+	for _, argument := range strings.Split(arguments, ",") {
+		address, err := Raw16(&state.Labels, "", &state.Defs, 0, strings.ToUpper(strings.TrimSpace(argument)))
+		if err != nil {
+			return err
+		}
+		if address >= 0x8000 {
+			return fmt.Errorf("$%04x is not in the ROM", address)
+		}
+		if state.Lint != nil {
+			state.Lint.MBCWrites[uint16(address)] = true
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The warnings of the assembly of the source, as "line: message"
+func lintTestSource(t *testing.T, source string) []string {
+	t.Helper()
+	warnings := []LintWarning{}
+	_, err := parseFile(filepath.Join(t.TempDir(), "main.gbasm"), []byte(source), 0, Options{
+		Quiet:    true,
+		Sources:  &SourceFiles{},
+		Warnings: &warnings,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := []string{}
+	for _, warning := range warnings {
+		messages = append(messages, strconv.Itoa(warning.Line)+": "+warning.Message)
+	}
+	return messages
+}
+
+func TestLintWarnings(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected []string
+	}{
+		{"\tLD ($2000), A\n", []string{
+			"1: Writes to $2000 in the ROM, which sets a register of the MBC (declare it with .MBC_WRITE if it is on purpose)",
+		}},
+		// Reading the ROM is fine
+		{"\tLD A, ($2000)\n", []string{}},
+		{"\tLD ($e010), A\n\tLD A, ($fdff)\n", []string{
+			"1: Accesses $e010 in the echo RAM, a mirror of $c010 in WRAM",
+			"2: Accesses $fdff in the echo RAM, a mirror of $ddff in WRAM",
+		}},
+		{"\tLD A, ($fea0)\n\tLD ($feff), SP\n", []string{
+			"1: Accesses $fea0 in the unusable memory from $fea0 to $feff",
+			"2: Accesses $feff in the unusable memory from $fea0 to $feff",
+		}},
+		{"\tLD ($ff08), A\n", []string{"1: $ff08 is not an IO register"}},
+		{"\tLD ($44), A\n", []string{"1: Writes to LY ($ff44), which is read only"}},
+		{"\tLD A, ($13)\n", []string{"1: Reads NR13 ($ff13), which is write only and always reads $ff"}},
+		{"\tLD A, ($44)\n\tLD ($13), A\n\tLD ($ff30), A\n\tLD A, ($c000)\n", []string{}},
+		{"\tDI\n\tHALT\n", []string{
+			"2: HALT right after DI only ends when an interrupt is requested, without calling it, and if one is already requested, the HALT bug runs the next byte twice",
+		}},
+		// Not when an instruction or data is between them
+		{"\tDI\n\tNOP\n\tHALT\n\tDI\n\t.DB $76\n", []string{}},
+	}
+	for _, test := range tests {
+		warnings := lintTestSource(t, test.source)
+		if strings.Join(warnings, "\n") != strings.Join(test.expected, "\n") {
+			t.Errorf("%q: got the warnings\n%s\nexpected\n%s", test.source, strings.Join(warnings, "\n"), strings.Join(test.expected, "\n"))
+		}
+	}
+}
+
+func TestLintMBCWrites(t *testing.T) {
+	// .MBC_WRITE only silences the addresses declared, even when declared after the writes
+	source := "\tLD ($2000), A\n\tLD ($4000), A\n\tLD ($2100), A\n.MBC_WRITE $2000, =Bank\n.PADTO $2100\nBank:\n"
+	warnings := lintTestSource(t, source)
+	expected := "2: Writes to $4000 in the ROM, which sets a register of the MBC (declare it with .MBC_WRITE if it is on purpose)"
+	if strings.Join(warnings, "\n") != expected {
+		t.Errorf("Got the warnings\n%s\nexpected\n%s", strings.Join(warnings, "\n"), expected)
+	}
+
+	_, err := assembleTestFile(t, ".MBC_WRITE $c000\n", nil)
+	if err == nil || !strings.Contains(err.Error(), "$c000 is not in the ROM") {
+		t.Errorf("Expected an error for .MBC_WRITE $c000, got %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Bytes shown on a line of the listing. The rest is replaced by "...".
+const listingMaxBytes = 8
+
+type ListingLine struct {
+	File    string
+	Line    int
+	Address uint
+	Bytes   []byte
+	// Cost in M-cycles of the instructions of the line, if it has any
+	Timing string
+	Source string
+}
+
+// Every line of the source files with its address, the bytes it inserted and its cost
+type Listing struct {
+	Lines []ListingLine
+}
+
+// Adds a line before it is assembled, so that the lines of the files it includes come after it.
+// Returns the index to give to Finish.
+func (listing *Listing) Start(file string, line int, address uint, source string) int {
+	listing.Lines = append(listing.Lines, ListingLine{
+		File:    file,
+		Line:    line,
+		Address: address,
+		Source:  strings.TrimRight(source, " \t\r"),
+	})
+	return len(listing.Lines) - 1
+}
+
+// Sets the bytes of a line once it is assembled. The bytes of the lines including another file are
+// already listed with the lines of that file.
+func (listing *Listing) Finish(index int, bytes []byte, timing InstructionTiming, hasTiming bool) {
+	if index != len(listing.Lines)-1 {
+		return
+	}
+	listing.Lines[index].Bytes = bytes
+	if hasTiming {
+		listing.Lines[index].Timing = timing.String()
+	}
+}
+
+func formatListingBytes(bytes []byte) string {
+	shown := bytes[:min(len(bytes), listingMaxBytes)]
+	result := strings.ToUpper(fmt.Sprintf("% x", shown))
+	if len(bytes) > listingMaxBytes {
+		result += " ..."
+	}
+	return result
+}
+
+func (listing *Listing) Write(fileName string) error {
+	output := strings.Builder{}
+	fmt.Fprintf(&output, "; Address  Bytes                        M-cycles  Source\n")
+
+	file := ""
+	for _, line := range listing.Lines {
+		if line.File != file {
+			file = line.File
+			fmt.Fprintf(&output, "\n; %s\n", file)
+		}
+		fmt.Fprintf(
+			&output,
+			"%-9s  %-28s %8s  %s\n",
+			formatROMAddress(line.Address),
+			formatListingBytes(line.Bytes),
+			line.Timing,
+			line.Source,
+		)
+	}
+
+	return os.WriteFile(fileName, []byte(output.String()), 0o644)
+}
@@ -0,0 +1,696 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// The types of the Language Server Protocol used by gbasm lsp
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspTextDocumentPosition struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+}
+
+type lspDocumentSymbol struct {
+	Name           string              `json:"name"`
+	Detail         string              `json:"detail,omitempty"`
+	Kind           int                 `json:"kind"`
+	Range          lspRange            `json:"range"`
+	SelectionRange lspRange            `json:"selectionRange"`
+	Children       []lspDocumentSymbol `json:"children,omitempty"`
+}
+
+type lspCompletionItem struct {
+	Label  string `json:"label"`
+	Kind   int    `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
+
+const (
+	lspSeverityError   = 1
+	lspSeverityWarning = 2
+
+	lspSymbolFunction = 12
+	lspSymbolConstant = 14
+	lspSymbolOperator = 25
+
+	lspCompletionFunction  = 3
+	lspCompletionKeyword   = 14
+	lspCompletionReference = 18
+	lspCompletionConstant  = 21
+)
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err *lspError) Error() string {
+	return err.Message
+}
+
+var errLSPExit = errors.New("exit")
+
+// The result of the last assembly of a file
+type lspBuild struct {
+	Labels  Labels
+	Listing *Listing
+	// The files read, the assembled file first
+	Files []string
+}
+
+type LanguageServer struct {
+	output io.Writer
+	// Searched by .INCLUDE, like with -I
+	includePaths IncludePaths
+	// The text of the open documents, which may not be saved yet
+	documents map[string]string
+	// The file including each file, which is assembled instead of it
+	roots  map[string]string
+	builds map[string]*lspBuild
+	// The files that got diagnostics from the assembly of each file, to clear them
+	diagnosed    map[string][]string
+	shuttingDown bool
+}
+
+func NewLanguageServer(output io.Writer, includePaths IncludePaths) *LanguageServer {
+	return &LanguageServer{
+		output:       output,
+		includePaths: includePaths,
+		documents:    map[string]string{},
+		roots:        map[string]string{},
+		builds:       map[string]*lspBuild{},
+		diagnosed:    map[string][]string{},
+	}
+}
+
+func uriToPath(uri string) string {
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Scheme != "file" {
+		return uri
+	}
+	return filepath.FromSlash(parsed.Path)
+}
+
+func pathToURI(path string) string {
+	absolute, err := filepath.Abs(path)
+	if err == nil {
+		path = absolute
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+func absolutePath(path string) string {
+	absolute, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	return absolute
+}
+
+// The LSP columns count UTF-16 code units
+func utf16Column(line string, offset int) int {
+	return len(utf16.Encode([]rune(line[:min(offset, len(line))])))
+}
+
+func byteColumn(line string, column int) int {
+	units := 0
+	for offset, c := range line {
+		if units >= column {
+			return offset
+		}
+		units += len(utf16.Encode([]rune{c}))
+	}
+	return len(line)
+}
+
+func (server *LanguageServer) text(path string) string {
+	if text, ok := server.documents[path]; ok {
+		return text
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return string(content)
+}
+
+func (server *LanguageServer) lines(path string) []string {
+	return strings.Split(server.text(path), "\n")
+}
+
+func (server *LanguageServer) lineRange(path string, lineNb int, start int, end int) lspRange {
+	line := ""
+	if lines := server.lines(path); lineNb < len(lines) {
+		line = lines[lineNb]
+	}
+	if end < 0 {
+		end = len(strings.TrimRight(line, "\r"))
+	}
+	return lspRange{
+		Start: lspPosition{lineNb, utf16Column(line, start)},
+		End:   lspPosition{lineNb, utf16Column(line, end)},
+	}
+}
+
+func readLSPMessage(reader *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		header = strings.TrimSpace(header)
+		if header == "" {
+			break
+		}
+		name, value, _ := strings.Cut(header, ":")
+		if strings.EqualFold(name, "Content-Length") {
+			length, err = strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid Content-Length \"%s\"", value)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("Missing Content-Length")
+	}
+
+	content := make([]byte, length)
+	_, err := io.ReadFull(reader, content)
+	return content, err
+}
+
+func (server *LanguageServer) send(message map[string]any) error {
+	message["jsonrpc"] = "2.0"
+	content, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(server.output, "Content-Length: %d\r\n\r\n%s", len(content), content)
+	return err
+}
+
+func (server *LanguageServer) notify(method string, params any) error {
+	return server.send(map[string]any{"method": method, "params": params})
+}
+
+// Answers the messages until the exit notification
+func (server *LanguageServer) Serve(input io.Reader) error {
+	reader := bufio.NewReader(input)
+	for {
+		content, err := readLSPMessage(reader)
+		if err != nil {
+			return err
+		}
+
+		var message struct {
+			ID     *json.RawMessage `json:"id"`
+			Method string           `json:"method"`
+			Params json.RawMessage  `json:"params"`
+		}
+		if err := json.Unmarshal(content, &message); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid message: %s\n", err.Error())
+			continue
+		}
+
+		result, err := server.handle(message.Method, message.Params)
+		if err == errLSPExit {
+			return nil
+		}
+		if message.ID == nil {
+			// A notification, or a response to the server
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", message.Method, err.Error())
+			}
+			continue
+		}
+
+		response := map[string]any{"id": message.ID}
+		var protocolError *lspError
+		switch {
+		case errors.As(err, &protocolError):
+			response["error"] = protocolError
+		case err != nil:
+			response["error"] = &lspError{Code: -32603, Message: err.Error()}
+		default:
+			response["result"] = result
+		}
+		if err := server.send(response); err != nil {
+			return err
+		}
+	}
+}
+
+func (server *LanguageServer) handle(method string, params json.RawMessage) (any, error) {
+	var document struct {
+		TextDocument struct {
+			URI  string `json:"uri"`
+			Text string `json:"text"`
+		} `json:"textDocument"`
+		ContentChanges []struct {
+			Text string `json:"text"`
+		} `json:"contentChanges"`
+		Text *string `json:"text"`
+	}
+	var position lspTextDocumentPosition
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &document); err != nil {
+			return nil, &lspError{Code: -32602, Message: err.Error()}
+		}
+		json.Unmarshal(params, &position)
+	}
+	path := uriToPath(document.TextDocument.URI)
+
+	switch method {
+	case "initialize":
+		return map[string]any{
+			"capabilities": map[string]any{
+				"textDocumentSync": map[string]any{
+					"openClose": true,
+					"change":    1,
+					"save":      map[string]any{"includeText": true},
+				},
+				"definitionProvider":     true,
+				"referencesProvider":     true,
+				"hoverProvider":          true,
+				"documentSymbolProvider": true,
+				"completionProvider": map[string]any{
+					"triggerCharacters": []string{"=", "$", "."},
+				},
+			},
+			"serverInfo": map[string]any{"name": "gbasm"},
+		}, nil
+	case "shutdown":
+		server.shuttingDown = true
+		return nil, nil
+	case "exit":
+		return nil, errLSPExit
+	case "textDocument/didOpen":
+		server.documents[path] = document.TextDocument.Text
+		return nil, server.assemble(path)
+	case "textDocument/didChange":
+		if len(document.ContentChanges) > 0 {
+			server.documents[path] = document.ContentChanges[len(document.ContentChanges)-1].Text
+		}
+		return nil, nil
+	case "textDocument/didSave":
+		if document.Text != nil {
+			server.documents[path] = *document.Text
+		}
+		return nil, server.assemble(path)
+	case "textDocument/didClose":
+		delete(server.documents, path)
+		return nil, nil
+	case "textDocument/definition":
+		return server.definition(path, position.Position, false, true), nil
+	case "textDocument/references":
+		var context struct {
+			Context struct {
+				IncludeDeclaration bool `json:"includeDeclaration"`
+			} `json:"context"`
+		}
+		json.Unmarshal(params, &context)
+		return server.definition(path, position.Position, true, context.Context.IncludeDeclaration), nil
+	case "textDocument/hover":
+		return server.hover(path, position.Position), nil
+	case "textDocument/completion":
+		return server.completion(path, position.Position), nil
+	case "textDocument/documentSymbol":
+		return server.documentSymbols(path), nil
+	}
+
+	if strings.HasPrefix(method, "$/") || method == "initialized" {
+		return nil, nil
+	}
+	return nil, &lspError{Code: -32601, Message: fmt.Sprintf("Unknown method %s", method)}
+}
+
+// Runs the assembler, which may panic on unexpected input
+func (server *LanguageServer) build(root string, options Options) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("The assembler crashed: %v", recovered)
+		}
+	}()
+	_, err = parseFile(root, []byte(server.text(root)), 0, options)
+	return err
+}
+
+var errorLocationRegexp = regexp.MustCompile(`File (.+?), line (\d+)[^:\n]*:\s*`)
+
+// Assembles the file (or the file including it) and publishes the errors and warnings
+func (server *LanguageServer) assemble(path string) error {
+	root := server.roots[path]
+	if root == "" {
+		root = path
+	}
+
+	labels := Labels{}
+	warnings := []LintWarning{}
+	// Quiet, as the standard output carries the messages of the protocol
+	options := Options{
+		IncludePaths: server.includePaths,
+		Sources:      &SourceFiles{},
+		Quiet:        true,
+		Listing:      &Listing{},
+		Symbols:      &labels,
+		Warnings:     &warnings,
+	}
+	err := server.build(root, options)
+
+	build := server.builds[root]
+	if build == nil {
+		build = &lspBuild{}
+		server.builds[root] = build
+	}
+	build.Files = []string{root}
+	for _, source := range options.Sources.Paths {
+		source = absolutePath(source)
+		if source != root {
+			server.roots[source] = root
+			build.Files = append(build.Files, source)
+		}
+	}
+	if len(labels) > 0 {
+		build.Labels = labels
+	}
+	if err == nil {
+		build.Listing = options.Listing
+	}
+
+	// The assembled file and the files with diagnostics from the previous assembly, to clear them
+	diagnostics := map[string][]lspDiagnostic{root: {}}
+	for _, file := range server.diagnosed[root] {
+		diagnostics[file] = []lspDiagnostic{}
+	}
+	for _, warning := range warnings {
+		file := absolutePath(warning.File)
+		diagnostics[file] = append(diagnostics[file], lspDiagnostic{
+			Range:    server.lineRange(file, warning.Line-1, 0, -1),
+			Severity: lspSeverityWarning,
+			Source:   "gbasm",
+			Message:  warning.Message,
+		})
+	}
+	if err != nil {
+		file, line, message := root, 0, err.Error()
+		if locations := errorLocationRegexp.FindAllStringSubmatchIndex(message, -1); len(locations) > 0 {
+			// The innermost location, in the included file
+			location := locations[len(locations)-1]
+			errorFile := absolutePath(message[location[2]:location[3]])
+			if isRegularFile(errorFile) {
+				file = errorFile
+				line, _ = strconv.Atoi(message[location[4]:location[5]])
+				line -= 1
+				message = message[location[1]:]
+			}
+		}
+		diagnostics[file] = append(diagnostics[file], lspDiagnostic{
+			Range:    server.lineRange(file, line, 0, -1),
+			Severity: lspSeverityError,
+			Source:   "gbasm",
+			Message:  message,
+		})
+	}
+
+	server.diagnosed[root] = []string{}
+	for _, file := range slices.Sorted(maps.Keys(diagnostics)) {
+		if len(diagnostics[file]) > 0 {
+			server.diagnosed[root] = append(server.diagnosed[root], file)
+		}
+		err := server.notify("textDocument/publishDiagnostics", map[string]any{
+			"uri":         pathToURI(file),
+			"diagnostics": diagnostics[file],
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The files of the program of the document: the files read by its last assembly and the open
+// documents
+func (server *LanguageServer) projectFiles(path string) []string {
+	files := []string{path}
+	root := server.roots[path]
+	if root == "" {
+		root = path
+	}
+	if build := server.builds[root]; build != nil {
+		files = append(files, build.Files...)
+	}
+	files = append(files, slices.Sorted(maps.Keys(server.documents))...)
+
+	unique := []string{}
+	for _, file := range files {
+		if !slices.Contains(unique, file) {
+			unique = append(unique, file)
+		}
+	}
+	return unique
+}
+
+func (server *LanguageServer) symbolAt(path string, position lspPosition) (SourceSymbol, bool) {
+	lines := server.lines(path)
+	if position.Line >= len(lines) {
+		return SourceSymbol{}, false
+	}
+	column := byteColumn(lines[position.Line], position.Character)
+	for _, symbol := range indexSource(server.text(path)) {
+		if symbol.Line == position.Line && column >= symbol.Start && column <= symbol.End {
+			return symbol, true
+		}
+	}
+	return SourceSymbol{}, false
+}
+
+// The definitions of the symbol at the position, or all of its uses
+func (server *LanguageServer) definition(path string, position lspPosition, references bool, declarations bool) []lspLocation {
+	symbol, ok := server.symbolAt(path, position)
+	if !ok {
+		return nil
+	}
+
+	locations := []lspLocation{}
+	for _, file := range server.projectFiles(path) {
+		for _, other := range indexSource(server.text(file)) {
+			if other.Name != symbol.Name || other.Kind != symbol.Kind {
+				continue
+			}
+			if other.Definition && declarations || !other.Definition && references {
+				locations = append(locations, lspLocation{
+					URI:   pathToURI(file),
+					Range: server.lineRange(file, other.Line, other.Start, other.End),
+				})
+			}
+		}
+	}
+	return locations
+}
+
+func (server *LanguageServer) lastBuild(path string) *lspBuild {
+	root := server.roots[path]
+	if root == "" {
+		root = path
+	}
+	return server.builds[root]
+}
+
+func (server *LanguageServer) hover(path string, position lspPosition) any {
+	build := server.lastBuild(path)
+	contents := []string{}
+
+	if symbol, ok := server.symbolAt(path, position); ok {
+		contents = append(contents, fmt.Sprintf("**%s** (%s)", symbol.Name, symbol.Kind))
+		if address, ok := build.label(symbol.Name); symbol.Kind == symbolLabel && ok {
+			contents = append(contents, fmt.Sprintf("`%s`", formatROMAddress(address)))
+		}
+		for _, file := range server.projectFiles(path) {
+			for _, other := range indexSource(server.text(file)) {
+				if other.Definition && other.Name == symbol.Name && other.Kind == symbol.Kind {
+					contents = append(contents, "```gbasm\n"+other.Source+"\n```")
+				}
+			}
+		}
+	}
+	if build != nil && build.Listing != nil {
+		for _, line := range build.Listing.Lines {
+			if line.Line != position.Line+1 || absolutePath(line.File) != path || len(line.Bytes) == 0 {
+				continue
+			}
+			contents = append(contents, "```gbasm\n"+strings.TrimSpace(line.Source)+"\n```")
+			details := fmt.Sprintf("`%s` at `%s`", formatListingBytes(line.Bytes), formatROMAddress(line.Address))
+			if line.Timing != "" {
+				details += fmt.Sprintf(", %s M-cycles", line.Timing)
+			}
+			contents = append(contents, details)
+		}
+	}
+
+	if len(contents) == 0 {
+		return nil
+	}
+	return map[string]any{
+		"contents": map[string]any{"kind": "markdown", "value": strings.Join(contents, "\n\n")},
+	}
+}
+
+func (build *lspBuild) label(name string) (uint, bool) {
+	if build == nil || build.Labels == nil {
+		return 0, false
+	}
+	address, ok := build.Labels[name]
+	return address, ok
+}
+
+// Completes the mnemonics, the directives and macros after a ".", the labels after a "=" and the
+// constants after a "$"
+func (server *LanguageServer) completion(path string, position lspPosition) []lspCompletionItem {
+	lines := server.lines(path)
+	if position.Line >= len(lines) {
+		return []lspCompletionItem{}
+	}
+	line := lines[position.Line]
+	start := byteColumn(line, position.Character)
+	for start > 0 && strings.ContainsRune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_", rune(line[start-1])) {
+		start--
+	}
+	prefix := byte(0)
+	if start > 0 {
+		prefix = line[start-1]
+	}
+
+	items := []lspCompletionItem{}
+	definitions := map[string]SourceSymbol{}
+	for _, file := range server.projectFiles(path) {
+		for _, symbol := range indexSource(server.text(file)) {
+			if symbol.Definition {
+				definitions[symbol.Kind.String()+" "+symbol.Name] = symbol
+			}
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(definitions)) {
+		symbol := definitions[key]
+		switch {
+		case prefix == '=' && symbol.Kind == symbolLabel:
+			items = append(items, lspCompletionItem{Label: symbol.Name, Kind: lspCompletionReference, Detail: "label"})
+		case prefix == '$' && symbol.Kind == symbolConstant:
+			items = append(items, lspCompletionItem{Label: symbol.Name, Kind: lspCompletionConstant, Detail: symbol.Source})
+		case prefix == '.' && symbol.Kind == symbolMacro:
+			items = append(items, lspCompletionItem{Label: symbol.Name, Kind: lspCompletionFunction, Detail: symbol.Source})
+		}
+	}
+
+	switch prefix {
+	case '.':
+		directives := slices.Concat(slices.Collect(maps.Keys(builtinMacros)), MacroParseDirectives, []string{".END", ".ENDTEST"})
+		slices.Sort(directives)
+		for _, directive := range slices.Compact(directives) {
+			items = append(items, lspCompletionItem{Label: directive[1:], Kind: lspCompletionKeyword, Detail: "directive"})
+		}
+	case '=', '$':
+	default:
+		for _, mnemonic := range slices.Sorted(maps.Keys(Instructions)) {
+			items = append(items, lspCompletionItem{Label: mnemonic, Kind: lspCompletionKeyword, Detail: "instruction"})
+		}
+	}
+	return items
+}
+
+// The labels, with their local labels, the constants and the macros defined in the document
+func (server *LanguageServer) documentSymbols(path string) []lspDocumentSymbol {
+	symbols := []lspDocumentSymbol{}
+	for _, symbol := range indexSource(server.text(path)) {
+		if !symbol.Definition {
+			continue
+		}
+
+		documentSymbol := lspDocumentSymbol{
+			Name:           symbol.Name,
+			Detail:         symbol.Kind.String(),
+			Range:          server.lineRange(path, symbol.Line, 0, -1),
+			SelectionRange: server.lineRange(path, symbol.Line, symbol.Start, symbol.End),
+		}
+		switch symbol.Kind {
+		case symbolLabel:
+			documentSymbol.Kind = lspSymbolFunction
+		case symbolConstant:
+			documentSymbol.Kind = lspSymbolConstant
+		case symbolMacro:
+			documentSymbol.Kind = lspSymbolOperator
+		}
+
+		parent, local, isLocal := strings.Cut(symbol.Name, ".")
+		if isLocal && symbol.Kind == symbolLabel && len(symbols) > 0 && symbols[len(symbols)-1].Name == parent {
+			documentSymbol.Name = "." + local
+			last := &symbols[len(symbols)-1]
+			last.Children = append(last.Children, documentSymbol)
+			last.Range.End = documentSymbol.Range.End
+			continue
+		}
+		symbols = append(symbols, documentSymbol)
+	}
+	return symbols
+}
+
+func lspMain(args []string) {
+	flags := flag.NewFlagSet("lsp", flag.ExitOnError)
+	includePaths := IncludePaths{}
+	flags.Var(&includePaths, "I", "Directory searched by .INCLUDE and .INCLUDEBIN (can be repeated)")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gbasm lsp [-I dir]...\n")
+		fmt.Fprintf(os.Stderr, "Runs a language server on the standard input and output\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	server := NewLanguageServer(os.Stdout, includePaths)
+	err := server.Serve(os.Stdin)
+	if err != nil && err != io.EOF {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if !server.shuttingDown {
+		os.Exit(1)
+	}
+}
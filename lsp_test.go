@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLanguageServerSession(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "main.gbasm")
+	uri := "file://" + path
+	source := "Start:\n\tLD ($44), A\n\tJP =Loop\nLoop:\n\tJR =Loop\n"
+
+	input := bytes.Buffer{}
+	for _, message := range []map[string]any{
+		{"id": 1, "method": "initialize", "params": map[string]any{}},
+		{"method": "initialized", "params": map[string]any{}},
+		{"method": "textDocument/didOpen", "params": map[string]any{
+			"textDocument": map[string]any{"uri": uri, "languageId": "gbasm", "version": 1, "text": source},
+		}},
+		{"id": 2, "method": "textDocument/definition", "params": map[string]any{
+			"textDocument": map[string]any{"uri": uri},
+			"position":     map[string]any{"line": 2, "character": 6},
+		}},
+		{"id": 3, "method": "shutdown"},
+		{"method": "exit"},
+	} {
+		message["jsonrpc"] = "2.0"
+		content, err := json.Marshal(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&input, "Content-Length: %d\r\n\r\n%s", len(content), content)
+	}
+
+	// The assembler must not print anything on the standard output, which carries the messages
+	stdout := os.Stdout
+	printed, printer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = printer
+	defer func() { os.Stdout = stdout }()
+
+	output := bytes.Buffer{}
+	server := NewLanguageServer(&output, IncludePaths{})
+	err = server.Serve(&input)
+	os.Stdout = stdout
+	printer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if extra, _ := io.ReadAll(printed); len(extra) > 0 {
+		t.Errorf("Printed on the standard output: %q", extra)
+	}
+	if !server.shuttingDown {
+		t.Errorf("The server didn't receive the shutdown request")
+	}
+
+	type response struct {
+		ID     *int            `json:"id"`
+		Method string          `json:"method"`
+		Result json.RawMessage `json:"result"`
+		Params json.RawMessage `json:"params"`
+		Error  *lspError       `json:"error"`
+	}
+	responses := map[int]response{}
+	diagnostics := []string{}
+	reader := bufio.NewReader(&output)
+	for {
+		content, err := readLSPMessage(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("The output isn't made of messages only: %v", err)
+		}
+
+		var message response
+		if err := json.Unmarshal(content, &message); err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case message.ID != nil:
+			responses[*message.ID] = message
+		case message.Method == "textDocument/publishDiagnostics":
+			diagnostics = append(diagnostics, string(message.Params))
+		}
+	}
+
+	for id := 1; id <= 3; id++ {
+		if responses[id].Error != nil {
+			t.Errorf("Request %d failed: %s", id, responses[id].Error.Message)
+		}
+	}
+	if !strings.Contains(string(responses[1].Result), `"definitionProvider":true`) {
+		t.Errorf("initialize: unexpected capabilities %s", responses[1].Result)
+	}
+
+	var locations []lspLocation
+	if err := json.Unmarshal(responses[2].Result, &locations); err != nil {
+		t.Fatal(err)
+	}
+	if len(locations) != 1 || locations[0].URI != uri || locations[0].Range.Start.Line != 3 {
+		t.Errorf("definition: got %+v, expected Loop on line 3", locations)
+	}
+
+	if string(responses[3].Result) != "null" {
+		t.Errorf("shutdown: got %s, expected null", responses[3].Result)
+	}
+
+	// The warning is a diagnostic, not a line printed among the messages
+	if len(diagnostics) == 0 || !strings.Contains(diagnostics[len(diagnostics)-1], "Writes to LY") {
+		t.Errorf("Expected a diagnostic for the write to LY, got %v", diagnostics)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type SourceSymbolKind int
+
+const (
+	symbolLabel SourceSymbolKind = iota
+	symbolConstant
+	symbolMacro
+)
+
+func (kind SourceSymbolKind) String() string {
+	switch kind {
+	case symbolLabel:
+		return "label"
+	case symbolConstant:
+		return "constant"
+	}
+	return "macro"
+}
+
+// A definition or a use of a label, a .DEFINE constant or a .MACRODEF macro in a source file
+type SourceSymbol struct {
+	// In upper case, with the absolute label before the local labels
+	Name       string
+	Kind       SourceSymbolKind
+	Definition bool
+	// 0 based, the columns are bytes of the line
+	Line  int
+	Start int
+	End   int
+	// The line defining it, for the hover
+	Source string
+}
+
+var (
+	labelReferenceRegexp    = regexp.MustCompile(`=(\.?[A-Za-z_][A-Za-z0-9_.]*)`)
+	constantReferenceRegexp = regexp.MustCompile(`\$([A-Za-z_][A-Za-z0-9_]*)`)
+	wordRegexp              = regexp.MustCompile(`[^ \t]+`)
+)
+
+// Finds the labels, constants and macros of a source file without assembling it, so that it works
+// on files that don't assemble yet
+func indexSource(text string) []SourceSymbol {
+	symbols := []SourceSymbol{}
+	lastAbsoluteLabel := ""
+	// The labels inside of .MACRODEF are local to the macro
+	inMacro := false
+
+	for lineNb, source := range strings.Split(text, "\n") {
+		line := strings.Split(source, ";")[0]
+		column := 0
+
+		isLabelDefined := strings.Contains(line, ":") && !strings.Contains(strings.Split(line, ":")[0], " ")
+		if isLabelDefined {
+			parts := strings.Split(line, ":")
+			for _, part := range parts[:len(parts)-1] {
+				start := column + len(part) - len(strings.TrimLeft(part, " \t"))
+				column += len(part) + 1
+				label := strings.ToUpper(strings.TrimSpace(part))
+				if inMacro || label == "" {
+					continue
+				}
+				if strings.HasPrefix(label, ".") {
+					label = lastAbsoluteLabel + label
+				} else {
+					lastAbsoluteLabel = strings.Split(label, ".")[0]
+				}
+				symbols = append(symbols, SourceSymbol{
+					Name:       label,
+					Kind:       symbolLabel,
+					Definition: true,
+					Line:       lineNb,
+					Start:      start,
+					End:        start + len(strings.TrimSpace(part)),
+					Source:     strings.TrimSpace(source),
+				})
+			}
+		}
+
+		rest := line[column:]
+		words := wordRegexp.FindAllStringIndex(rest, -1)
+		word := func(i int, kind SourceSymbolKind, definition bool) SourceSymbol {
+			start, end := words[i][0], words[i][1]
+			if !definition {
+				// The dot of the macro call
+				start += 1
+			}
+			return SourceSymbol{
+				Name:       strings.ToUpper(rest[start:end]),
+				Kind:       kind,
+				Definition: definition,
+				Line:       lineNb,
+				Start:      column + start,
+				End:        column + end,
+				Source:     strings.TrimSpace(source),
+			}
+		}
+		if len(words) > 0 {
+			directive := strings.ToUpper(rest[words[0][0]:words[0][1]])
+			switch {
+			case directive == ".MACRODEF" && len(words) > 1:
+				inMacro = true
+				symbols = append(symbols, word(1, symbolMacro, true))
+			case directive == ".END":
+				inMacro = false
+			case directive == ".DEFINE" && len(words) > 1:
+				symbols = append(symbols, word(1, symbolConstant, true))
+			case strings.HasPrefix(directive, ".") && len(directive) > 1 && !isDirective(directive):
+				symbols = append(symbols, word(0, symbolMacro, false))
+			}
+		}
+
+		for _, match := range labelReferenceRegexp.FindAllStringSubmatchIndex(rest, -1) {
+			label := strings.ToUpper(rest[match[2]:match[3]])
+			if strings.HasPrefix(label, ".") {
+				label = lastAbsoluteLabel + label
+			}
+			symbols = append(symbols, SourceSymbol{
+				Name:  label,
+				Kind:  symbolLabel,
+				Line:  lineNb,
+				Start: column + match[2],
+				End:   column + match[3],
+			})
+		}
+		for _, match := range constantReferenceRegexp.FindAllStringSubmatchIndex(rest, -1) {
+			name := rest[match[2]:match[3]]
+			if _, err := strconv.ParseUint(name, 16, 16); err == nil {
+				continue
+			}
+			symbols = append(symbols, SourceSymbol{
+				Name:  strings.ToUpper(name),
+				Kind:  symbolConstant,
+				Line:  lineNb,
+				Start: column + match[2],
+				End:   column + match[3],
+			})
+		}
+	}
+	return symbols
+}
+
+// The directives of the assembler, as opposed to the macros defined by .MACRODEF
+func isDirective(name string) bool {
+	_, isBuiltin := builtinMacros[name]
+	return isBuiltin || name == ".END" || name == ".ENDTEST" || slices.Contains(MacroParseDirectives, name)
+}
@@ -2,8 +2,7 @@ package main
 
 import (
 	"fmt"
-	"io"
-	"os"
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -136,6 +135,16 @@ type (
 	ROMAddressPtr uint32
 )
 
+// The directives dispatched by MacroParse. The other directives are the macros of
+// NewInstructionSetMacros, .END, which is read by .MACRODEF, .TILE and .COMPRESS, and .ENDTEST,
+// which is read by .TEST.
+var MacroParseDirectives = []string{
+	".BUDGET", ".COMPRESS", ".CYCLES_MAX", ".DECOMPRESSOR", ".DEFINE", ".ENDCYCLES", ".INCGFX", ".INCLUDE",
+	".INCLUDEBIN", ".INCLZ", ".INCMETASPRITE", ".INCMML", ".INCPAL", ".INCRLE", ".INCTILED",
+	".INCTILEMAP", ".INCWAVE", ".MACRODEF", ".MBC_WRITE", ".MUSICDRIVER", ".OAM", ".PALETTE", ".TEST",
+	".TILE",
+}
+
 func MacroParse(
 	line string,
 	lines []string,
@@ -154,7 +163,7 @@ func MacroParse(
 	macroName := words[0]
 
 	if _, ok := MacroInstructions[macroName]; ok {
-		new_instruction, err := MacroInstructions.Parse(
+		new_instruction, timing, err := MacroInstructions.ParseTimed(
 			&state.Labels,
 			&state.Defs,
 			state.IsMacro,
@@ -168,50 +177,296 @@ func MacroParse(
 		}
 
 		*result = append(*result, new_instruction...)
+		// The second pass counts the cost of the macros defined by .MACRODEF
+		if !isFirstPass && state.Timing != nil {
+			*state.Timing = state.Timing.Add(timing)
+		}
 		return nil
+	} else if !slices.Contains(MacroParseDirectives, macroName) {
+		return fmt.Errorf("Unknown macro \"%s\"", macroName)
 	} else if macroName == ".INCLUDE" && !state.IsMacro {
 		filePath := strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, ".INCLUDE")), "\"'")
 
-		input_file, err := os.Open(filePath)
+		filePath, err := resolveInclude(state, filePath)
 		if err != nil {
-			return fmt.Errorf("Error while opening file %s", filePath)
+			return err
 		}
 
-		input, err := io.ReadAll(input_file)
+		err = checkIncludeCycle(state, filePath)
 		if err != nil {
-			return fmt.Errorf("Error while reading file %s", filePath)
+			return err
 		}
 
-		fileStartOffset := uint(len(*result)) + offset
-		if isFirstPass {
-			included, err := firstPass(filePath, input, fileStartOffset, state)
+		input, err := state.Sources.Read(filePath)
+		if err != nil {
+			return err
+		}
+
+		state.IncludeStack = append(state.IncludeStack, filePath)
+		defer func() {
+			state.IncludeStack = state.IncludeStack[:len(state.IncludeStack)-1]
+		}()
+
+		return assembleSource(state, filePath, input, result, offset, isFirstPass)
+	} else if macroName == ".INCLUDEBIN" && !state.IsMacro {
+		filePath, parameters, err := parseFileArguments(strings.TrimPrefix(line, ".INCLUDEBIN"))
+		if err != nil {
+			return err
+		}
+		if len(parameters) > 2 {
+			return fmt.Errorf(".INCLUDEBIN takes a file path, an optional offset and an optional length")
+		}
+
+		filePath, err = resolveInclude(state, filePath)
+		if err != nil {
+			return err
+		}
+
+		input, err := state.Sources.Read(filePath)
+		if err != nil {
+			return err
+		}
+
+		currentAddress := uint32(uint(len(*result)) + offset)
+		bounds := []uint32{0, uint32(len(input))}
+		for i, parameter := range parameters {
+			v, err := Raw32(&state.Labels, LastAbsoluteLabel, &state.Defs, currentAddress, parameter)
 			if err != nil {
-				return err
+				return fmt.Errorf("Couldn't parse \"%s\" as a .INCLUDEBIN offset or length: %w", parameter, err)
 			}
-			*result = append(*result, included...)
-		} else {
-			included, err := secondPass(filePath, input, fileStartOffset, *state)
+			bounds[i] = v
+		}
+		if len(parameters) < 2 {
+			if bounds[0] > uint32(len(input)) {
+				return fmt.Errorf("Offset $%x is past the end of %s (%d bytes)", bounds[0], filePath, len(input))
+			}
+			bounds[1] = uint32(len(input)) - bounds[0]
+		}
+
+		start, length := bounds[0], bounds[1]
+		if uint64(start)+uint64(length) > uint64(len(input)) {
+			return fmt.Errorf(
+				"Cannot include %d bytes from offset $%x of %s: the file is only %d bytes long",
+				length,
+				start,
+				filePath,
+				len(input),
+			)
+		}
+
+		// Only a slice must fit in the current bank, a whole file can span several banks
+		if len(parameters) > 0 {
+			err = checkFitsInBank(currentAddress, length, filePath)
 			if err != nil {
 				return err
 			}
-			*result = append(*result, included...)
 		}
-	} else if macroName == ".INCLUDEBIN" && !state.IsMacro {
-		filePath := strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, ".INCLUDEBIN")), "\"'")
 
-		input_file, err := os.Open(filePath)
+		*result = append(*result, input[start:start+length]...)
+	} else if macroName == ".INCGFX" && !state.IsMacro {
+		data, err := includeGraphics(state, strings.TrimPrefix(line, ".INCGFX"))
+		if err != nil {
+			return err
+		}
+
+		err = checkFitsInBank(uint32(uint(len(*result))+offset), uint32(len(data)), "The tiles")
+		if err != nil {
+			return err
+		}
+
+		*result = append(*result, data...)
+	} else if macroName == ".INCTILEMAP" && !state.IsMacro {
+		currentAddress := uint32(uint(len(*result)) + offset)
+		data, err := includeTilemap(state, strings.TrimPrefix(line, ".INCTILEMAP"), currentAddress, isFirstPass)
+		if err != nil {
+			return err
+		}
+
+		err = checkFitsInBank(currentAddress, uint32(len(data)), "The tiles and tilemap")
+		if err != nil {
+			return err
+		}
+
+		*result = append(*result, data...)
+	} else if macroName == ".INCTILED" && !state.IsMacro {
+		currentAddress := uint32(uint(len(*result)) + offset)
+		data, err := includeTiledMap(state, strings.TrimPrefix(line, ".INCTILED"), currentAddress, isFirstPass)
+		if err != nil {
+			return err
+		}
+
+		err = checkFitsInBank(currentAddress, uint32(len(data)), "The map")
+		if err != nil {
+			return err
+		}
+
+		*result = append(*result, data...)
+	} else if macroName == ".PALETTE" {
+		data, err := assemblePalette(strings.TrimPrefix(line, ".PALETTE"))
+		if err != nil {
+			return err
+		}
+
+		*result = append(*result, data...)
+	} else if macroName == ".INCPAL" && !state.IsMacro {
+		data, err := includePalettes(state, strings.TrimPrefix(line, ".INCPAL"))
+		if err != nil {
+			return err
+		}
+
+		err = checkFitsInBank(uint32(uint(len(*result))+offset), uint32(len(data)), "The palettes")
+		if err != nil {
+			return err
+		}
+
+		*result = append(*result, data...)
+	} else if macroName == ".OAM" {
+		currentAddress := uint32(uint(len(*result)) + offset)
+		data, err := assembleOAMEntry(state, LastAbsoluteLabel, currentAddress, strings.TrimPrefix(line, ".OAM"))
+		if err != nil {
+			return err
+		}
+
+		*result = append(*result, data...)
+	} else if macroName == ".INCMETASPRITE" && !state.IsMacro {
+		currentAddress := uint32(uint(len(*result)) + offset)
+		data, err := includeMetasprite(state, strings.TrimPrefix(line, ".INCMETASPRITE"), currentAddress, isFirstPass)
+		if err != nil {
+			return err
+		}
+
+		err = checkFitsInBank(currentAddress, uint32(len(data)), "The metasprites")
+		if err != nil {
+			return err
+		}
+
+		*result = append(*result, data...)
+	} else if macroName == ".TILE" && !state.IsMacro {
+		data, err := assembleTileBlock(strings.TrimPrefix(line, ".TILE"), lines, lineNb)
+		if err != nil {
+			return err
+		}
+
+		*result = append(*result, data...)
+	} else if macroName == ".INCWAVE" && !state.IsMacro {
+		data, err := includeWave(state, strings.TrimPrefix(line, ".INCWAVE"))
+		if err != nil {
+			return err
+		}
+
+		err = checkFitsInBank(uint32(uint(len(*result))+offset), uint32(len(data)), "The samples")
+		if err != nil {
+			return err
+		}
+
+		*result = append(*result, data...)
+	} else if (macroName == ".INCLZ" || macroName == ".INCRLE") && !state.IsMacro {
+		method := strings.TrimPrefix(macroName, ".INC")
+		data, err := includeCompressed(state, method, strings.TrimPrefix(line, macroName), isFirstPass)
+		if err != nil {
+			return err
+		}
+
+		err = checkFitsInBank(uint32(uint(len(*result))+offset), uint32(len(data)), "The compressed data")
+		if err != nil {
+			return err
+		}
+
+		*result = append(*result, data...)
+	} else if macroName == ".COMPRESS" && !state.IsMacro {
+		currentAddress := uint32(uint(len(*result)) + offset)
+		data, err := compressBlock(
+			state,
+			strings.TrimPrefix(line, ".COMPRESS"),
+			lines,
+			lineNb,
+			currentAddress,
+			LastAbsoluteLabel,
+			isFirstPass,
+		)
 		if err != nil {
-			return fmt.Errorf("Error while opening file %s", filePath)
+			return err
 		}
 
-		input, err := io.ReadAll(input_file)
+		err = checkFitsInBank(currentAddress, uint32(len(data)), "The compressed data")
 		if err != nil {
-			return fmt.Errorf("Error while reading file %s", filePath)
+			return err
+		}
+
+		*result = append(*result, data...)
+	} else if macroName == ".TEST" && !state.IsMacro {
+		return parseTestBlock(
+			state,
+			strings.TrimPrefix(line, ".TEST"),
+			lines,
+			lineNb,
+			uint32(uint(len(*result))+offset),
+			LastAbsoluteLabel,
+			isFirstPass,
+		)
+	} else if macroName == ".CYCLES_MAX" && !state.IsMacro {
+		if isFirstPass {
+			return nil
+		}
+		return openCycleBudget(state, strings.TrimPrefix(line, ".CYCLES_MAX"), *lineNb)
+	} else if macroName == ".ENDCYCLES" && !state.IsMacro {
+		if isFirstPass {
+			return nil
+		}
+		return closeCycleBudget(state, *lineNb)
+	} else if macroName == ".MBC_WRITE" && !state.IsMacro {
+		if isFirstPass {
+			return nil
+		}
+		return declareMBCWrites(state, strings.TrimPrefix(line, ".MBC_WRITE"))
+	} else if macroName == ".BUDGET" && !state.IsMacro {
+		if isFirstPass {
+			return nil
+		}
+		return declareFillBudget(state, strings.TrimPrefix(line, ".BUDGET"), *lineNb, LastAbsoluteLabel)
+	} else if macroName == ".DECOMPRESSOR" && !state.IsMacro {
+		if len(words) != 2 {
+			return fmt.Errorf(".DECOMPRESSOR takes the compression used (LZ or RLE)")
 		}
 
-		*result = append(*result, input...)
+		fileName, source, err := decompressorSource(words[1])
+		if err != nil {
+			return err
+		}
+
+		return assembleSource(state, fileName, source, result, offset, isFirstPass)
+	} else if macroName == ".INCMML" && !state.IsMacro {
+		currentAddress := uint32(uint(len(*result)) + offset)
+		data, err := includeMML(state, strings.TrimPrefix(line, ".INCMML"), currentAddress)
+		if err != nil {
+			return err
+		}
+
+		err = checkFitsInBank(currentAddress, uint32(len(data)), "The song")
+		if err != nil {
+			return err
+		}
+
+		*result = append(*result, data...)
+	} else if macroName == ".MUSICDRIVER" && !state.IsMacro {
+		if len(words) != 2 {
+			return fmt.Errorf(".MUSICDRIVER takes the address of the RAM used by the driver")
+		}
+
+		fileName, source, err := includeMusicDriver(state, words[1])
+		if err != nil {
+			return err
+		}
+
+		return assembleSource(state, fileName, source, result, offset, isFirstPass)
 	} else if macroName == ".DEFINE" && !state.IsMacro {
-		if len(words) != 3 {
+		// The path given to sizeof_file can contain spaces
+		value := ""
+		if len(words) >= 3 {
+			value = strings.TrimSpace(strings.Join(words[2:], " "))
+		}
+		isFileSize := strings.HasPrefix(value, "sizeof_file(") && strings.HasSuffix(value, ")")
+		if len(words) != 3 && !isFileSize {
 			return fmt.Errorf(".DEFINE must have 2 arguments (%v)", words)
 		}
 
@@ -224,7 +479,27 @@ func MacroParse(
 		current_address := uint32(uint(len(*result)) + offset)
 
 		var definedValue any
-		if v, err := Raw8Indirect(&state.Labels, LastAbsoluteLabel, &state.Defs, current_address, words[2]); err == nil {
+		if isFileSize {
+			filePath, parameters, err := parseFileArguments(value[len("sizeof_file(") : len(value)-1])
+			if err != nil {
+				return err
+			}
+			if len(parameters) != 0 {
+				return fmt.Errorf("sizeof_file only takes a file path")
+			}
+
+			filePath, err = resolveInclude(state, filePath)
+			if err != nil {
+				return err
+			}
+
+			content, err := state.Sources.Read(filePath)
+			if err != nil {
+				return err
+			}
+
+			return defineConstant(state, name, len(content))
+		} else if v, err := Raw8Indirect(&state.Labels, LastAbsoluteLabel, &state.Defs, current_address, words[2]); err == nil {
 			definedValue = Indirect8b(v)
 		} else if v, err := Raw16Indirect(&state.Labels, LastAbsoluteLabel, &state.Defs, current_address, words[2]); err == nil {
 			definedValue = Indirect16b(v)
@@ -232,6 +507,8 @@ func MacroParse(
 			definedValue = Raw8b(v)
 		} else if v, err := Raw16(&state.Labels, LastAbsoluteLabel, &state.Defs, current_address, words[2]); err == nil {
 			definedValue = Raw16b(v)
+		} else if isUndefined(err) {
+			return fmt.Errorf("\"%s\" could not be parsed as a .DEFINE argument: %w", words[2], err)
 		} else {
 			return fmt.Errorf("\"%s\" could not be parsed as a .DEFINE argument", words[2])
 		}
@@ -284,20 +561,22 @@ func MacroParse(
 							Labels:  labels,
 							Defs:    definitions,
 							IsMacro: true,
+							Defined: make(map[string]bool),
 						}
-						new_instructions, err := firstPass("MACRO$"+definedMacroName, macroContent, 0, &state)
+						new_instructions, err := firstPass("MACRO$"+definedMacroName, macroContent, uint(currentAddress), &state)
 						if err != nil {
 							return nil, err
 						}
 						return new_instructions, nil
 					},
+					LabelsBeforeOnly: true,
 				},
 			}
 		} else {
 			MacroInstructions["."+definedMacroName] = []InstructionParams{
 				{
 					Types: parameterTypes,
-					Assembler: func(currentAddress uint32, args []uint32) ([]uint8, error) {
+					TimedAssembler: func(currentAddress uint32, args []uint32) ([]uint8, InstructionTiming, error) {
 						definitions := Clone(state.Defs)
 						labels := Clone(state.Labels)
 						for i, macroArg := range definedMacroArguments {
@@ -311,17 +590,19 @@ func MacroParse(
 							Labels:  labels,
 							Defs:    definitions,
 							IsMacro: true,
+							Defined: make(map[string]bool),
+							Timing:  &InstructionTiming{},
 						}
 						_, err := firstPass("MACRO$"+definedMacroName, macroContent, uint(currentAddress), &state)
 						if err != nil {
-							return nil, err
+							return nil, InstructionTiming{}, err
 						}
 						new_instructions, err := secondPass("MACRO$"+definedMacroName, macroContent, uint(currentAddress), state)
 						if err != nil {
-							return nil, err
+							return nil, InstructionTiming{}, err
 						}
 
-						return new_instructions, nil
+						return new_instructions, *state.Timing, nil
 					},
 				},
 			}
@@ -332,6 +613,69 @@ func MacroParse(
 	return nil
 }
 
+// Assembles an included file at the end of result
+func assembleSource(
+	state *ProgramState,
+	fileName string,
+	input []byte,
+	result *[]byte,
+	offset uint,
+	isFirstPass bool,
+) error {
+	fileStartOffset := uint(len(*result)) + offset
+	if isFirstPass {
+		included, err := firstPass(fileName, input, fileStartOffset, state)
+		if err != nil {
+			return err
+		}
+		*result = append(*result, included...)
+	} else {
+		included, err := secondPass(fileName, input, fileStartOffset, *state)
+		if err != nil {
+			return err
+		}
+		*result = append(*result, included...)
+	}
+	return nil
+}
+
+// Defines a label at the start of data inserted by a directive. During the second pass, the label
+// is only checked to be at the same place.
+func defineDirectiveLabel(state *ProgramState, label string, address uint32, isFirstPass bool) error {
+	if !isFirstPass {
+		if state.Labels[label] != uint(address) {
+			return fmt.Errorf(
+				"Label %s is at $%04x but the first pass placed it at $%04x",
+				label,
+				address,
+				state.Labels[label],
+			)
+		}
+		return nil
+	}
+
+	if state.Defined[label] {
+		return fmt.Errorf("Label %s is already defined", label)
+	}
+	state.Labels[label] = uint(address)
+	state.Defined[label] = true
+	return nil
+}
+
+// Returns an error if data inserted at currentAddress would run into the next bank
+func checkFitsInBank(currentAddress uint32, length uint32, what string) error {
+	if length > 0 && currentAddress/0x4000 != (currentAddress+length-1)/0x4000 {
+		return fmt.Errorf(
+			"%s ($%x bytes) doesn't fit in bank %v: it would end at $%x",
+			what,
+			length,
+			currentAddress/0x4000,
+			currentAddress+length-1,
+		)
+	}
+	return nil
+}
+
 func Clone[K comparable, V any](arg map[K]V) map[K]V {
 	result := make(map[K]V)
 	for k, v := range arg {
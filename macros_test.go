@@ -0,0 +1,20 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMacroParseDirectivesAreDispatched(t *testing.T) {
+	for _, directive := range MacroParseDirectives {
+		_, err := assembleTestFile(t, directive+"\n", nil)
+		if err != nil && strings.Contains(err.Error(), "Unknown macro") {
+			t.Errorf("%s is not dispatched by MacroParse: %v", directive, err)
+		}
+	}
+
+	_, err := assembleTestFile(t, ".NOT_A_DIRECTIVE\n", nil)
+	if err == nil || !strings.Contains(err.Error(), "Unknown macro") {
+		t.Errorf("Expected an unknown macro error, got %v", err)
+	}
+}
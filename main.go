@@ -1,10 +1,12 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"io"
+	"maps"
 	"os"
 	"regexp"
+	"slices"
 	"strings"
 )
 
@@ -14,36 +16,200 @@ type (
 )
 
 type ProgramState struct {
-	Labels  Labels
-	Defs    Definitions
-	IsMacro bool
+	Labels     Labels
+	Defs       Definitions
+	IsMacro    bool
+	Relaxation *BranchRelaxation
+	// Labels defined during the current pass. The other entries of Labels come from the previous
+	// pass and are only there to resolve forward references.
+	Defined map[string]bool
+	IncludePaths IncludePaths
+	// The file being assembled and the files including it, up to the input file
+	IncludeStack []string
+	Sources      *SourceFiles
+	// During the layout passes, the labels defined later aren't known yet or may still move, so
+	// lines using an undefined label or definition are skipped. The second pass reports them.
+	Layout bool
+	// Sizes of the compressed data, for the report
+	Compression *CompressionReport
+	// The .TEST blocks, only collected by gbasm test
+	Tests *TestSuite
+	// Written by the second pass when a listing is requested
+	Listing      *Listing
+	CycleBudgets *CycleBudgets
+	// Cost of the instructions assembled by the second pass so far
+	Timing *InstructionTiming
+	// Warnings about the accesses to the hardware, collected by the second pass
+	Lint *Lint
+	// Written by the second pass, for the map, the bank usage and the .BUDGET checks
+	MemoryMap   *MemoryMap
+	FillBudgets *FillBudgets
+}
+
+// The passes are repeated until the labels stop moving. Most programs need only 2.
+const maxLayoutPasses = 32
+
+// bank:address, like 01:4000 for the start of the second bank
+func formatROMAddress(value uint) string {
+	if value < 0x4000 {
+		return fmt.Sprintf("00:%04x", value)
+	}
+	return fmt.Sprintf("%02x:%04x", value/0x4000, value%0x4000+0x4000)
 }
 
 func printSymbols(labels map[string]uint) {
 	for key, value := range labels {
-		if value < 0x4000 {
-			fmt.Printf("00:%04x %s\n", value, key)
-		} else {
-			bank := value / 0x4000
-			addr := value%0x4000 + 0x4000
-			fmt.Printf("%02x:%04x %s\n", bank, addr, key)
-		}
+		fmt.Printf("%s %s\n", formatROMAddress(value), key)
 	}
 }
 
-func parseFile(inputFileName string, input []byte, offset uint) ([]byte, error) {
+type Options struct {
+	RelaxJP      bool
+	IncludePaths IncludePaths
+	Sources      *SourceFiles
+	// Don't print the symbols, the warnings and the reports
+	Quiet bool
+	// Collects the .TEST blocks when not nil
+	Tests *TestSuite
+	// Collects the lines of the listing when not nil
+	Listing         *Listing
+	ListingFileName string
+	// Receives the labels of the program when not nil
+	Symbols *Labels
+	// Collects the padding of the program when not nil
+	MemoryMap   *MemoryMap
+	MapFileName string
+	// Print the usage of every bank
+	Verbose bool
+	// Limits of the fill of the banks, as errors and as warnings
+	MaxFill  FillLimits
+	WarnFill FillLimits
+	// Receives the warnings instead of printing them when not nil
+	Warnings *[]LintWarning
+}
+
+func parseFile(inputFileName string, input []byte, offset uint, options Options) ([]byte, error) {
+	// The macros defined by a previous assembly (in watch mode) must not leak into this one
+	MacroInstructions = NewInstructionSetMacros()
+
 	state := ProgramState{
-		Labels:  make(map[string]uint),
-		Defs:    make(map[string]any),
-		IsMacro: false,
+		Labels:       make(map[string]uint),
+		Defs:         make(map[string]any),
+		IsMacro:      false,
+		Relaxation:   &BranchRelaxation{RelaxJP: options.RelaxJP},
+		IncludePaths: options.IncludePaths,
+		IncludeStack: []string{inputFileName},
+		Sources:      options.Sources,
+		Compression:  &CompressionReport{},
+		Tests:        options.Tests,
+		Listing:      options.Listing,
+		CycleBudgets: &CycleBudgets{},
+		Lint:         NewLint(),
+		MemoryMap:    options.MemoryMap,
+		FillBudgets:  &FillBudgets{},
+	}
+
+	if state.MemoryMap == nil {
+		state.MemoryMap = &MemoryMap{}
+	}
+
+	err := layoutPasses(inputFileName, input, offset, &state)
+	if err != nil {
+		return nil, err
+	}
+	if !options.Quiet {
+		printSymbols(state.Labels)
+	}
+	if options.Symbols != nil {
+		*options.Symbols = state.Labels
+	}
+
+	state.Relaxation.Reset()
+	result, err := secondPass(inputFileName, input, offset, state)
+	if err != nil {
+		return nil, err
+	}
+	if options.Warnings != nil {
+		*options.Warnings = state.Lint.Reported()
+	} else if !options.Quiet {
+		state.Lint.PrintWarnings()
 	}
 
-	_, err := firstPass(inputFileName, input, offset, &state)
+	err = checkFillBudgets(state.FillBudgets, options.MaxFill, options.WarnFill, state.MemoryMap, result, state.Labels)
 	if err != nil {
 		return nil, err
 	}
-	printSymbols(state.Labels)
-	return secondPass(inputFileName, input, offset, state)
+
+	if len(state.Relaxation.Branches) > 0 && !options.Quiet {
+		state.Relaxation.PrintReport()
+	}
+	if len(state.Compression.Entries) > 0 && !options.Quiet {
+		state.Compression.PrintReport()
+	}
+	return result, nil
+}
+
+// Runs the first pass until the address of every label, the value of every definition and the
+// size of every relaxed branch is the same as in the previous pass.
+func layoutPasses(inputFileName string, input []byte, offset uint, state *ProgramState) error {
+	var previousLabels Labels
+	var previousDefs Definitions
+	for pass := 1; ; pass++ {
+		state.Defined = make(map[string]bool)
+		state.Layout = true
+		state.Relaxation.Reset()
+		_, err := firstPass(inputFileName, input, offset, state)
+		if err != nil {
+			return err
+		}
+
+		for label := range state.Labels {
+			if !state.Defined[label] {
+				delete(state.Labels, label)
+			}
+		}
+
+		relaxed := state.Relaxation.Update(state.Labels, state.Defs)
+		if pass > 1 && !relaxed && maps.Equal(previousLabels, state.Labels) &&
+			maps.Equal(previousDefs, state.Defs) {
+			return nil
+		}
+
+		// Every relaxation turns at least one more branch into a JP, so it can only add that many passes
+		if pass >= maxLayoutPasses+len(state.Relaxation.Branches) {
+			return layoutConvergenceError(pass, previousLabels, state.Labels, previousDefs, state.Defs)
+		}
+
+		previousLabels = Clone(state.Labels)
+		previousDefs = Clone(state.Defs)
+	}
+}
+
+func layoutConvergenceError(
+	pass int,
+	previousLabels Labels,
+	labels Labels,
+	previousDefs Definitions,
+	defs Definitions,
+) error {
+	moving := []string{}
+	for label, address := range labels {
+		if previousAddress, ok := previousLabels[label]; !ok || previousAddress != address {
+			moving = append(moving, fmt.Sprintf("\tLabel %s: $%04x -> $%04x\n", label, previousAddress, address))
+		}
+	}
+	for name, value := range defs {
+		if previousValue, ok := previousDefs[name]; !ok || previousValue != value {
+			moving = append(moving, fmt.Sprintf("\tDefinition $%s: %#x -> %#x\n", name, previousValue, value))
+		}
+	}
+	slices.Sort(moving)
+
+	return fmt.Errorf(
+		"The layout of the program did not converge after %d passes. Still changing between the last 2 passes:\n%s",
+		pass,
+		strings.Join(moving, ""),
+	)
 }
 
 func firstPass(
@@ -95,7 +261,7 @@ func firstPass(
 					lastAbsoluteLabel = labelParts[0]
 				}
 
-				if _, ok := state.Labels[label]; ok {
+				if state.Defined[label] {
 					return nil, fmt.Errorf(
 						"File %s, line %d:\nLabel %s is already defined",
 						inputFileName,
@@ -112,6 +278,7 @@ func firstPass(
 				}
 
 				state.Labels[label] = uint(len(result)) + offset
+				state.Defined[label] = true
 			}
 
 			line = parts[len(parts)-1]
@@ -122,7 +289,7 @@ func firstPass(
 		// nil sets all the labels and defintion to 0 & thus, to not crash JR, the currentAddress should also be 0
 		if strings.HasPrefix(line, ".") {
 			err := MacroParse(line, lines, &result, state, &lineNb, true, offset, lastAbsoluteLabel)
-			if err != nil {
+			if err != nil && !(state.Layout && isUndefined(err)) {
 				return nil, fmt.Errorf(
 					"File %s, line %d (1st pass|macro):\n%w",
 					inputFileName,
@@ -131,8 +298,9 @@ func firstPass(
 				)
 			}
 		} else {
+			line = state.Relaxation.Rewrite(line, uint32(uint(len(result))+offset), lastAbsoluteLabel)
 			nextInstruction, err := Instructions.Parse(&state.Labels, &state.Defs, state.IsMacro, true, 0, lastAbsoluteLabel, line)
-			if err != nil {
+			if err != nil && !(state.Layout && isUndefined(err)) {
 				return nil, fmt.Errorf(
 					"File %s, line %d (1st pass):\n%w",
 					inputFileName,
@@ -156,12 +324,16 @@ func secondPass(
 	state ProgramState,
 ) ([]byte, error) {
 	lines := strings.Split(string(input), "\n")
+	if state.Timing == nil {
+		state.Timing = &InstructionTiming{}
+	}
 
 	lineNb := 0
 	result := []byte{}
 	lastAbsoluteLabel := ""
 	for lineNb < len(lines) {
 		line := lines[lineNb]
+		startLine := lineNb
 		lineParts := strings.Split(line, ";")
 		line = lineParts[0]
 		isLabelDefined := strings.Contains(line, ":") && !strings.Contains(strings.Split(line,":")[0], " ")
@@ -183,13 +355,36 @@ func secondPass(
 					}
 
 					lastAbsoluteLabel = labelParts[0]
+				} else {
+					label = lastAbsoluteLabel + label
+				}
+
+				address := uint(len(result)) + offset
+				if state.Labels[label] != address {
+					return nil, fmt.Errorf(
+						"File %s, line %d (2nd pass):\nLabel %s is at $%04x but the first pass placed it at $%04x. The size of something before it depends on a label the first pass couldn't resolve",
+						inputFileName,
+						lineNb+1,
+						label,
+						address,
+						state.Labels[label],
+					)
 				}
 			}
 		}
 
 		line = strings.TrimSpace(line)
 
+		listingIndex := 0
+		if state.Listing != nil {
+			listingIndex = state.Listing.Start(inputFileName, lineNb+1, uint(len(result))+offset, lines[lineNb])
+		}
+		lineStart := len(result)
+		var timing InstructionTiming
+		hasTiming := false
+
 		if strings.HasPrefix(line, ".") {
+			spent := *state.Timing
 			err := MacroParse(
 				line,
 				lines,
@@ -208,8 +403,31 @@ func secondPass(
 					err,
 				)
 			}
+
+			// The macros defined by .MACRODEF are code
+			macroName := strings.Split(line, " ")[0]
+			_, isMacro := MacroInstructions[macroName]
+			if _, isBuiltin := builtinMacros[macroName]; isMacro && !isBuiltin {
+				timing, hasTiming = state.Timing.Since(spent), true
+				if state.Lint != nil {
+					state.Lint.Check(inputFileName, lineNb+1, result[lineStart:])
+				}
+			} else if len(result) > lineStart && state.Lint != nil {
+				state.Lint.Data()
+			}
+
+			if (macroName == ".PADTO" || macroName == ".ALIGN") && state.MemoryMap != nil {
+				state.MemoryMap.AddPadding(
+					inputFileName,
+					lineNb+1,
+					macroName,
+					uint(lineStart)+offset,
+					uint(len(result)-lineStart),
+				)
+			}
 		} else {
-			nextInstruction, err := Instructions.Parse(&state.Labels, &state.Defs, state.IsMacro, false, uint32(uint(len(result))+offset), lastAbsoluteLabel, line)
+			line = state.Relaxation.Rewrite(line, uint32(uint(len(result))+offset), lastAbsoluteLabel)
+			nextInstruction, instructionTiming, err := Instructions.ParseTimed(&state.Labels, &state.Defs, state.IsMacro, false, uint32(uint(len(result))+offset), lastAbsoluteLabel, line)
 			if err != nil {
 				return nil, fmt.Errorf(
 					"File %s, line %d (2nd pass): %w",
@@ -220,49 +438,176 @@ func secondPass(
 			}
 
 			result = append(result, nextInstruction...)
+			if len(nextInstruction) > 0 {
+				timing, hasTiming = instructionTiming, true
+				*state.Timing = state.Timing.Add(timing)
+				if state.Lint != nil {
+					state.Lint.Check(inputFileName, lineNb+1, nextInstruction)
+				}
+			}
+		}
+
+		if hasTiming && state.CycleBudgets != nil {
+			state.CycleBudgets.Add(timing)
+		}
+		if state.Listing != nil {
+			state.Listing.Finish(listingIndex, slices.Clone(result[lineStart:]), timing, hasTiming)
+			// The lines of a block read by a directive
+			for blockLine := startLine + 1; blockLine <= lineNb && blockLine < len(lines); blockLine++ {
+				state.Listing.Start(inputFileName, blockLine+1, uint(len(result))+offset, lines[blockLine])
+			}
 		}
 		lineNb += 1
 	}
 
+	if state.CycleBudgets != nil {
+		for _, budget := range state.CycleBudgets.Open {
+			if budget.File == inputFileName {
+				return nil, fmt.Errorf(
+					"File %s, line %d:\n.CYCLES_MAX is never closed by .ENDCYCLES",
+					inputFileName,
+					budget.Line,
+				)
+			}
+		}
+	}
+
 	return result, nil
 }
 
-func main() {
-	if len(os.Args) != 3 {
-		fmt.Fprintf(os.Stderr, "Usage: gbasm [input_file] [output_file]\n")
-		os.Exit(1)
+// The flags of the assembly, shared by the commands assembling a file. -M is only registered for the
+// commands writing a ROM (when dependencyFileName isn't nil).
+func addAssemblerFlags(flags *flag.FlagSet, options *Options, dependencyFileName *string) {
+	flags.BoolVar(&options.RelaxJP, "relax", false, "Assemble JP as JR whenever the target is close enough (JMP is always relaxed)")
+	flags.Var(&options.IncludePaths, "I", "Directory searched by .INCLUDE and .INCLUDEBIN (can be repeated)")
+	if dependencyFileName != nil {
+		flags.StringVar(dependencyFileName, "M", "", "Write the files used by the program as a Makefile rule in this file")
 	}
+	flags.StringVar(&options.ListingFileName, "list", "", "Write every line with its address, its bytes and its cost in M-cycles in this file")
+	flags.StringVar(&options.MapFileName, "map", "", "Write the usage of every bank, the labels with their size and the padding in this file")
+	flags.BoolVar(&options.Verbose, "v", false, "Print the usage of every bank")
+	flags.Var(&options.MaxFill, "max-fill", "Fail when a bank is fuller than this, written bank=percent like 0=90 (can be repeated)")
+	flags.Var(&options.WarnFill, "warn-fill", "Warn when a bank is fuller than this, written bank=percent like 0=80 (can be repeated)")
+}
 
-	inputFileName := os.Args[1]
-	outputFileName := os.Args[2]
-
-	inputFile, err := os.Open(inputFileName)
+// Assembles the input file into the output file. The files read are recorded in options.Sources.
+func assemble(inputFileName string, outputFileName string, options Options, dependencyFileName string) error {
+	result, err := assembleROM(inputFileName, options)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error while opening input file: %s\n", err.Error())
-		os.Exit(1)
+		return err
 	}
 
-	input, err := io.ReadAll(inputFile)
+	err = os.WriteFile(outputFileName, result, 0o644)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error while reading input file: %s\n", err.Error())
-		os.Exit(1)
+		return fmt.Errorf("Error while writing to output file: %w", err)
+	}
+
+	if dependencyFileName != "" {
+		err = options.Sources.WriteDependencies(dependencyFileName, outputFileName)
+		if err != nil {
+			return fmt.Errorf("Error while writing the dependency file: %w", err)
+		}
 	}
+	return nil
+}
 
-	result, err := parseFile(inputFileName, input, 0)
+// Assembles the input file, writing the listing and the map asked by the options
+func assembleROM(inputFileName string, options Options) ([]byte, error) {
+	input, err := options.Sources.Read(inputFileName)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
-		os.Exit(1)
+		return nil, fmt.Errorf("Error while reading input file: %w", err)
+	}
+
+	if options.ListingFileName != "" {
+		options.Listing = &Listing{}
+	}
+	labels := Labels{}
+	if options.MapFileName != "" || options.Verbose {
+		options.MemoryMap = &MemoryMap{}
+		if options.Symbols == nil {
+			options.Symbols = &labels
+		}
 	}
 
-	outputFile, err := os.Create(outputFileName)
+	result, err := parseFile(inputFileName, input, 0, options)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error while opening output file: %s\n", err.Error())
+		return nil, fmt.Errorf("Error: %w", err)
+	}
+
+	if options.Listing != nil {
+		err = options.Listing.Write(options.ListingFileName)
+		if err != nil {
+			return nil, fmt.Errorf("Error while writing the listing: %w", err)
+		}
+	}
+
+	if options.MapFileName != "" {
+		err = options.MemoryMap.Write(options.MapFileName, result, *options.Symbols)
+		if err != nil {
+			return nil, fmt.Errorf("Error while writing the map: %w", err)
+		}
+	}
+	if options.Verbose {
+		options.MemoryMap.PrintSummary(result)
+	}
+	return result, nil
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "watch" {
+		watchMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "run" {
+		runMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "test" {
+		testMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "analyze" {
+		analyzeMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "sizediff" {
+		sizediffMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "lsp" {
+		lspMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "fmt" {
+		fmtMain(os.Args[2:])
+		return
+	}
+
+	options := Options{}
+	dependencyFileName := ""
+	addAssemblerFlags(flag.CommandLine, &options, &dependencyFileName)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gbasm [-relax] [-I dir]... [-M deps_file] [-list listing_file] [-map map_file] [-v] [-max-fill bank=percent]... [input_file] [output_file]\n")
+		fmt.Fprintf(os.Stderr, "       gbasm watch [options] [input_file] [output_file]\n")
+		fmt.Fprintf(os.Stderr, "       gbasm run [-cycles n] [-trace] [rom_file]\n")
+		fmt.Fprintf(os.Stderr, "       gbasm test [options] [-cycles n] [input_file]\n")
+		fmt.Fprintf(os.Stderr, "       gbasm analyze [options] [-dot dot_file] [input_file]\n")
+		fmt.Fprintf(os.Stderr, "       gbasm sizediff old_map_file new_map_file\n")
+		fmt.Fprintf(os.Stderr, "       gbasm lsp [-I dir]...\n")
+		fmt.Fprintf(os.Stderr, "       gbasm fmt [-check] [-width n] file_or_directory...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
 		os.Exit(1)
 	}
 
-	_, err = outputFile.Write(result)
+	options.Sources = &SourceFiles{}
+	err := assemble(flag.Arg(0), flag.Arg(1), options, dependencyFileName)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error while writing to output file: %s\n", err.Error())
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Assembles source as the file main.gbasm of a temporary directory that also contains files
+func assembleTestFile(t *testing.T, source string, files map[string][]byte) ([]byte, error) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		err := os.WriteFile(filepath.Join(dir, name), content, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return parseFile(filepath.Join(dir, "main.gbasm"), []byte(source), 0, Options{
+		Quiet:    true,
+		Sources:  &SourceFiles{},
+		Warnings: &[]LintWarning{},
+	})
+}
+
+func TestForwardReferences(t *testing.T) {
+	// Data moves when JMP is relaxed, and $DATA_END is used before being defined
+	source := `	LD HL, $DATA_END
+	JMP =Data
+.DEFINE DATA_END =Data+4
+	NOP
+Data:
+	.DB 1, 2, 3, 4
+`
+	result, err := assembleTestFile(t, source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0x21, 0x0a, 0x00, 0x18, 0x01, 0x00, 0x01, 0x02, 0x03, 0x04}
+	if !bytes.Equal(result, expected) {
+		t.Errorf("Got % x, expected % x", result, expected)
+	}
+}
+
+func TestLayoutConvergence(t *testing.T) {
+	// End is always 1 byte after itself
+	source := `.DEFINE N =End+1
+.PADTO $N
+End:
+	NOP
+`
+	_, err := assembleTestFile(t, source, nil)
+	expected := fmt.Sprintf("did not converge after %d passes", maxLayoutPasses)
+	if err == nil || !strings.Contains(err.Error(), expected) {
+		t.Fatalf("Expected an error containing %q, got %v", expected, err)
+	}
+	if !strings.Contains(err.Error(), "Label END") || !strings.Contains(err.Error(), "Definition $N") {
+		t.Errorf("The error doesn't list END and $N: %v", err)
+	}
+}
+
+func TestLayoutConvergenceError(t *testing.T) {
+	err := layoutConvergenceError(
+		3,
+		Labels{"B": 0x10, "A": 0x20, "STILL": 0x30},
+		Labels{"B": 0x11, "A": 0x22, "STILL": 0x30, "NEW": 0x40},
+		Definitions{"N": Raw8b(1)},
+		Definitions{"N": Raw8b(2)},
+	)
+	expected := "The layout of the program did not converge after 3 passes. Still changing between the last 2 passes:\n" +
+		"\tDefinition $N: 0x1 -> 0x2\n" +
+		"\tLabel A: $0020 -> $0022\n" +
+		"\tLabel B: $0010 -> $0011\n" +
+		"\tLabel NEW: $0000 -> $0040\n"
+	if err.Error() != expected {
+		t.Errorf("Got\n%s\nexpected\n%s", err, expected)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+const bankSize = 0x4000
+
+// Bytes inserted by .PADTO or .ALIGN only to move the next line
+type Padding struct {
+	File      string
+	Line      int
+	Directive string
+	Address   uint
+	Size      uint
+}
+
+type BankUsage struct {
+	Bank int
+	// The bytes inserted in the bank, except the padding
+	Used uint
+	// The bytes left after the end of the ROM and the padding
+	Free    uint
+	Padding uint
+	// The largest range of free bytes
+	LargestGap        uint
+	LargestGapAddress uint
+}
+
+// Where the bytes of the ROM go, collected by the second pass
+type MemoryMap struct {
+	Padding []Padding
+}
+
+func (memoryMap *MemoryMap) AddPadding(file string, line int, directive string, address uint, size uint) {
+	memoryMap.Padding = append(memoryMap.Padding, Padding{file, line, directive, address, size})
+}
+
+func bankCount(rom []byte) int {
+	return max(1, (len(rom)+bankSize-1)/bankSize)
+}
+
+func (memoryMap *MemoryMap) Banks(rom []byte) []BankUsage {
+	banks := []BankUsage{}
+	for bank := range bankCount(rom) {
+		start := uint(bank * bankSize)
+		end := start + bankSize
+		dataEnd := min(end, uint(len(rom)))
+
+		// The padding and the end of the bank after the ROM, merged when they touch
+		gaps := [][2]uint{}
+		padding := uint(0)
+		for _, entry := range memoryMap.Padding {
+			gapStart := max(entry.Address, start)
+			gapEnd := min(entry.Address+entry.Size, end)
+			if gapStart < gapEnd {
+				gaps = append(gaps, [2]uint{gapStart, gapEnd})
+				padding += gapEnd - gapStart
+			}
+		}
+		if dataEnd < end {
+			gaps = append(gaps, [2]uint{dataEnd, end})
+		}
+		slices.SortFunc(gaps, func(a, b [2]uint) int { return int(a[0]) - int(b[0]) })
+
+		usage := BankUsage{Bank: bank, Padding: padding}
+		usage.Used = dataEnd - start - padding
+		usage.Free = bankSize - usage.Used
+		for i := 0; i < len(gaps); i++ {
+			gap := gaps[i]
+			for i+1 < len(gaps) && gaps[i+1][0] <= gap[1] {
+				gap[1] = max(gap[1], gaps[i+1][1])
+				i++
+			}
+			if gap[1]-gap[0] > usage.LargestGap {
+				usage.LargestGap = gap[1] - gap[0]
+				usage.LargestGapAddress = gap[0]
+			}
+		}
+		banks = append(banks, usage)
+	}
+	return banks
+}
+
+func (usage BankUsage) String() string {
+	return fmt.Sprintf(
+		"%d bytes used (%d%%), %d free (%d of padding), largest gap: %d bytes at %s",
+		usage.Used,
+		usage.Used*100/bankSize,
+		usage.Free,
+		usage.Padding,
+		usage.LargestGap,
+		formatROMAddress(usage.LargestGapAddress),
+	)
+}
+
+func (memoryMap *MemoryMap) PrintSummary(rom []byte) {
+	fmt.Printf("Bank  Used          Free   Padding  Largest gap\n")
+	for _, usage := range memoryMap.Banks(rom) {
+		fmt.Printf(
+			"%02x    %5d (%3d%%)  %5d  %7d  %d at %s\n",
+			usage.Bank,
+			usage.Used,
+			usage.Used*100/bankSize,
+			usage.Free,
+			usage.Padding,
+			usage.LargestGap,
+			formatROMAddress(usage.LargestGapAddress),
+		)
+	}
+}
+
+type mapEntry struct {
+	Address uint
+	Size    uint
+	Name    string
+}
+
+// The labels sorted by address, then by name
+func sortedLabelNames(labels Labels) []string {
+	names := []string{}
+	for name := range labels {
+		names = append(names, name)
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		if labels[a] != labels[b] {
+			return int(labels[a]) - int(labels[b])
+		}
+		return strings.Compare(a, b)
+	})
+	return names
+}
+
+// The size of every label: the distance to the next label or padding, or to the end of the data of
+// its bank
+func (memoryMap *MemoryMap) LabelSizes(rom []byte, labels Labels) map[string]uint {
+	names := sortedLabelNames(labels)
+	sizes := map[string]uint{}
+	for i, name := range names {
+		address := labels[name]
+		next := min(address/bankSize*bankSize+bankSize, uint(len(rom)))
+		if i+1 < len(names) {
+			next = min(next, labels[names[i+1]])
+		}
+		for _, padding := range memoryMap.Padding {
+			if padding.Address > address && padding.Size > 0 {
+				next = min(next, padding.Address)
+			}
+		}
+		sizes[name] = max(next, address) - address
+	}
+	return sizes
+}
+
+// Writes the usage of every bank, followed by its labels with their size and its padding
+func (memoryMap *MemoryMap) Write(fileName string, rom []byte, labels Labels) error {
+	names := sortedLabelNames(labels)
+	sizes := memoryMap.LabelSizes(rom, labels)
+
+	output := strings.Builder{}
+	fmt.Fprintf(&output, "; Address  Size  Label\n")
+	for _, usage := range memoryMap.Banks(rom) {
+		start := uint(usage.Bank * bankSize)
+
+		entries := []mapEntry{}
+		for _, name := range names {
+			address := labels[name]
+			if address >= start && address < start+bankSize {
+				entries = append(entries, mapEntry{address, sizes[name], name})
+			}
+		}
+		for _, padding := range memoryMap.Padding {
+			if padding.Address >= start && padding.Address < start+bankSize && padding.Size > 0 {
+				entries = append(entries, mapEntry{
+					padding.Address,
+					padding.Size,
+					fmt.Sprintf("(%s, %s line %d)", padding.Directive, padding.File, padding.Line),
+				})
+			}
+		}
+		// The labels come before the padding starting at their address
+		slices.SortStableFunc(entries, func(a, b mapEntry) int { return int(a.Address) - int(b.Address) })
+
+		fmt.Fprintf(&output, "\n; Bank %02x: %s\n", usage.Bank, usage)
+		for _, entry := range entries {
+			fmt.Fprintf(&output, "%-9s  %5d  %s\n", formatROMAddress(entry.Address), entry.Size, entry.Name)
+		}
+	}
+
+	return os.WriteFile(fileName, []byte(output.String()), 0o644)
+}
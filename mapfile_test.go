@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const mapSource = `Start:
+	.DB 1, 2, 3, 4
+.PADTO $1000
+.PADTO $3000
+Code:
+	NOP
+.ALIGN
+Bank1:
+	.DB 7
+`
+
+func TestMemoryMap(t *testing.T) {
+	dir := t.TempDir()
+	labels := Labels{}
+	memoryMap := &MemoryMap{}
+	rom, err := parseFile(filepath.Join(dir, "main.gbasm"), []byte(mapSource), 0, Options{
+		Quiet:     true,
+		Sources:   &SourceFiles{},
+		Warnings:  &[]LintWarning{},
+		Symbols:   &labels,
+		MemoryMap: memoryMap,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The 2 .PADTO touch and make a single gap, larger than the one of .ALIGN
+	expected := []BankUsage{
+		{Bank: 0, Used: 5, Free: 0x3ffb, Padding: 0x3ffb, LargestGap: 0x2ffc, LargestGapAddress: 0x0004},
+		{Bank: 1, Used: 1, Free: 0x3fff, Padding: 0, LargestGap: 0x3fff, LargestGapAddress: 0x4001},
+	}
+	banks := memoryMap.Banks(rom)
+	if len(banks) != len(expected) {
+		t.Fatalf("Got %d banks instead of %d: %v", len(banks), len(expected), banks)
+	}
+	for i := range banks {
+		if banks[i] != expected[i] {
+			t.Errorf("Bank %d: got %+v, expected %+v", i, banks[i], expected[i])
+		}
+	}
+
+	path := filepath.Join(dir, "main.map")
+	if err := memoryMap.Write(path, rom, labels); err != nil {
+		t.Fatal(err)
+	}
+	written, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := []string{
+		"; Bank 00: 5 bytes used (0%), 16379 free (16379 of padding), largest gap: 12284 bytes at 00:0004\n",
+		"00:0000        4  START\n",
+		"00:0004     4092  (.PADTO, ",
+		"00:1000     8192  (.PADTO, ",
+		"00:3000        1  CODE\n",
+		"00:3001     4095  (.ALIGN, ",
+		"; Bank 01: 1 bytes used (0%), 16383 free (0 of padding), largest gap: 16383 bytes at 01:4001\n",
+		"01:4000        1  BANK1\n",
+	}
+	for _, line := range lines {
+		if !strings.Contains(string(written), line) {
+			t.Errorf("%q not found in\n%s", line, written)
+		}
+	}
+}
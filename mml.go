@@ -0,0 +1,403 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Events of the patterns read by the music driver (lib/music.gbasm). The notes are $01 to $48 (C2
+// to B7) followed by their duration in steps.
+const (
+	musicEnd      = 0x00
+	musicRest     = 0x80
+	musicEnvelope = 0x81
+	musicDuty     = 0x82
+	musicNoise    = 0x83
+	musicWait     = 0x84
+)
+
+const (
+	musicLowestOctave = 2
+	musicNotes        = 72
+	// A step is a 16th note
+	musicStepsPerWhole = 16
+)
+
+type musicChannelKind int
+
+const (
+	musicPulse musicChannelKind = iota
+	musicWave
+	musicNoiseChannel
+)
+
+func musicChannelKindOf(channel int) musicChannelKind {
+	switch channel {
+	case 3:
+		return musicWave
+	case 4:
+		return musicNoiseChannel
+	}
+	return musicPulse
+}
+
+type mmlSong struct {
+	Tempo    int
+	Patterns map[string]string
+	// Pattern names played by each channel, in order
+	Orders [4][]string
+}
+
+// Reads the # lines of a song. The lines that don't start with # continue the previous #PATTERN.
+func parseMMLSong(content string) (mmlSong, error) {
+	song := mmlSong{Tempo: 6, Patterns: make(map[string]string)}
+	currentPattern := ""
+
+	for lineNb, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(strings.Split(line, ";")[0])
+		if line == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(line, "#") {
+			if currentPattern == "" {
+				return song, fmt.Errorf("Line %d: notes outside of a #PATTERN", lineNb+1)
+			}
+			song.Patterns[currentPattern] += " " + line
+			continue
+		}
+
+		fields := strings.Fields(line)
+		command := strings.ToUpper(fields[0])
+		currentPattern = ""
+
+		switch command {
+		case "#TEMPO":
+			if len(fields) != 2 {
+				return song, fmt.Errorf("Line %d: #TEMPO takes the number of frames per step", lineNb+1)
+			}
+			tempo, err := strconv.ParseUint(fields[1], 0, 8)
+			if err != nil || tempo == 0 {
+				return song, fmt.Errorf("Line %d: the tempo must be between 1 and 255 frames per step", lineNb+1)
+			}
+			song.Tempo = int(tempo)
+		case "#PATTERN":
+			if len(fields) < 2 {
+				return song, fmt.Errorf("Line %d: #PATTERN takes a name followed by its notes", lineNb+1)
+			}
+			name := strings.ToUpper(fields[1])
+			if _, ok := song.Patterns[name]; ok {
+				return song, fmt.Errorf("Line %d: pattern %s is already defined", lineNb+1, name)
+			}
+			song.Patterns[name] = strings.Join(fields[2:], " ")
+			currentPattern = name
+		case "#CHANNEL":
+			if len(fields) < 2 {
+				return song, fmt.Errorf("Line %d: #CHANNEL takes a channel number followed by patterns", lineNb+1)
+			}
+			channel, err := strconv.Atoi(fields[1])
+			if err != nil || channel < 1 || channel > 4 {
+				return song, fmt.Errorf("Line %d: the channel must be 1, 2, 3 or 4, not \"%s\"", lineNb+1, fields[1])
+			}
+			for _, pattern := range fields[2:] {
+				song.Orders[channel-1] = append(song.Orders[channel-1], strings.ToUpper(pattern))
+			}
+		default:
+			return song, fmt.Errorf("Line %d: unknown command \"%s\" (expected #TEMPO, #PATTERN or #CHANNEL)", lineNb+1, fields[0])
+		}
+	}
+
+	return song, nil
+}
+
+// Reads the number following a command (decimal, or hexadecimal after a $), returning the position
+// after it
+func mmlNumber(mml string, i int) (int, int, bool) {
+	start := i
+	digits := "0123456789"
+	base := 10
+	if i < len(mml) && mml[i] == '$' {
+		digits = "0123456789abcdefABCDEF"
+		base = 16
+		i++
+	}
+
+	digitsStart := i
+	for i < len(mml) && strings.IndexByte(digits, mml[i]) >= 0 {
+		i++
+	}
+
+	v, err := strconv.ParseInt(mml[digitsStart:i], base, 32)
+	if err != nil {
+		return 0, start, false
+	}
+	return int(v), i, true
+}
+
+// Reads an optional length (1, 2, 4, 8 or 16) followed by dots, in steps
+func mmlLength(mml string, i int, defaultSteps int) (int, int, error) {
+	steps := defaultSteps
+	if length, next, ok := mmlNumber(mml, i); ok {
+		if length == 0 || musicStepsPerWhole%length != 0 {
+			return 0, i, fmt.Errorf("Length %d is not 1, 2, 4, 8 or 16", length)
+		}
+		steps = musicStepsPerWhole / length
+		i = next
+	}
+
+	dot := steps
+	for i < len(mml) && mml[i] == '.' {
+		if dot%2 != 0 {
+			return 0, i, fmt.Errorf("Too many dots: the length is not a whole number of steps")
+		}
+		dot /= 2
+		steps += dot
+		i++
+	}
+	return steps, i, nil
+}
+
+// Converts the MML of a pattern to events for one kind of channel
+func compileMMLPattern(name string, mml string, kind musicChannelKind) ([]byte, error) {
+	result := []byte{}
+	octave := 4
+	defaultSteps := 4
+	hasDuration := false
+
+	addDuration := func(event []byte, steps int) {
+		for steps > 0xff {
+			result = append(result, event...)
+			result = append(result, 0xff)
+			event = []byte{musicWait}
+			steps -= 0xff
+		}
+		result = append(result, event...)
+		result = append(result, uint8(steps))
+		hasDuration = true
+	}
+
+	for i := 0; i < len(mml); {
+		c := strings.ToLower(mml[i : i+1])[0]
+		i++
+
+		var err error
+		switch {
+		case c == ' ' || c == '\t' || c == '|':
+		case c == '>':
+			octave++
+		case c == '<':
+			octave--
+		case c == 'o':
+			v, next, ok := mmlNumber(mml, i)
+			if !ok {
+				return nil, fmt.Errorf("Pattern %s: o must be followed by the octave", name)
+			}
+			octave, i = v, next
+		case c == 'l':
+			defaultSteps, i, err = mmlLength(mml, i, 0)
+			if err != nil || defaultSteps == 0 {
+				return nil, fmt.Errorf("Pattern %s: l must be followed by a length (%v)", name, err)
+			}
+		case c == 'v':
+			v, next, ok := mmlNumber(mml, i)
+			if !ok || v > 15 {
+				return nil, fmt.Errorf("Pattern %s: v must be followed by a volume from 0 to 15", name)
+			}
+			i = next
+
+			envelope := uint8(v << 4)
+			if kind == musicWave {
+				// Output level of the wave channel: 100%, 50%, 25% or muted
+				switch {
+				case v >= 12:
+					envelope = 0x20
+				case v >= 6:
+					envelope = 0x40
+				case v >= 3:
+					envelope = 0x60
+				default:
+					envelope = 0x00
+				}
+			}
+			result = append(result, musicEnvelope, envelope)
+		case c == '@':
+			v, next, ok := mmlNumber(mml, i)
+			if !ok || v > 3 {
+				return nil, fmt.Errorf("Pattern %s: @ must be followed by a duty from 0 to 3", name)
+			}
+			if kind != musicPulse {
+				return nil, fmt.Errorf("Pattern %s: @ (duty) can only be used on channels 1 and 2", name)
+			}
+			i = next
+			result = append(result, musicDuty, uint8(v<<6))
+		case c == 'r' || c == '^':
+			steps := 0
+			steps, i, err = mmlLength(mml, i, defaultSteps)
+			if err != nil {
+				return nil, fmt.Errorf("Pattern %s: %w", name, err)
+			}
+			if c == 'r' {
+				addDuration([]byte{musicRest}, steps)
+			} else {
+				addDuration([]byte{musicWait}, steps)
+			}
+		case c == 'n':
+			if kind != musicNoiseChannel {
+				return nil, fmt.Errorf("Pattern %s: n (noise) can only be used on channel 4", name)
+			}
+			v, next, ok := mmlNumber(mml, i)
+			if !ok || v > 0xff {
+				return nil, fmt.Errorf("Pattern %s: n must be followed by a noise value from $00 to $ff", name)
+			}
+			i = next
+			addDuration([]byte{musicNoise, uint8(v)}, defaultSteps)
+		case c >= 'a' && c <= 'g':
+			if kind == musicNoiseChannel {
+				return nil, fmt.Errorf("Pattern %s: channel 4 plays noise (n) instead of notes", name)
+			}
+
+			semitone := map[byte]int{'c': 0, 'd': 2, 'e': 4, 'f': 5, 'g': 7, 'a': 9, 'b': 11}[c]
+			for i < len(mml) && strings.ContainsRune("+#-", rune(mml[i])) {
+				if mml[i] == '-' {
+					semitone--
+				} else {
+					semitone++
+				}
+				i++
+			}
+
+			steps := 0
+			steps, i, err = mmlLength(mml, i, defaultSteps)
+			if err != nil {
+				return nil, fmt.Errorf("Pattern %s: %w", name, err)
+			}
+
+			note := (octave-musicLowestOctave)*12 + semitone + 1
+			if kind == musicWave {
+				// The same frequency value plays an octave lower on the wave channel
+				note += 12
+			}
+			if note < 1 || note > musicNotes {
+				return nil, fmt.Errorf("Pattern %s: note %c in octave %d is out of the range of the channel", name, c, octave)
+			}
+			addDuration([]byte{uint8(note)}, steps)
+		default:
+			return nil, fmt.Errorf("Pattern %s: unknown command '%c'", name, c)
+		}
+	}
+
+	if !hasDuration {
+		return nil, fmt.Errorf("Pattern %s doesn't have any note or rest", name)
+	}
+	return append(result, musicEnd), nil
+}
+
+// Address of ROM data as seen from code in the same bank
+func bankedAddress(address uint32) uint32 {
+	if bank := address / 0x4000; bank != 0 {
+		return address - bank*0x4000 + 0x4000
+	}
+	return address
+}
+
+// Converts a song (.INCMML) to the tempo, the pointers to the order list of each channel (0 for
+// unused channels), the order lists (pointers to patterns, ending with 0) and the patterns
+func includeMML(state *ProgramState, arguments string, currentAddress uint32) ([]byte, error) {
+	filePath, parameters, err := parseFileArguments(arguments)
+	if err != nil {
+		return nil, err
+	}
+	if len(parameters) > 0 {
+		return nil, fmt.Errorf(".INCMML only takes a file path")
+	}
+
+	filePath, err = resolveInclude(state, filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := state.Sources.Read(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	song, err := parseMMLSong(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	}
+
+	// Each pattern is converted once for each kind of channel playing it
+	type compiledKey struct {
+		name string
+		kind musicChannelKind
+	}
+	compiled := make(map[compiledKey]uint32)
+	patterns := []byte{}
+
+	orderLists := [4][]byte{}
+	orderListsSize := 0
+	for _, order := range song.Orders {
+		if len(order) > 0 {
+			orderListsSize += len(order)*2 + 2
+		}
+	}
+	patternsAddress := currentAddress + 1 + 4*2 + uint32(orderListsSize)
+
+	for channel, order := range song.Orders {
+		kind := musicChannelKindOf(channel + 1)
+		for _, name := range order {
+			mml, ok := song.Patterns[name]
+			if !ok {
+				return nil, fmt.Errorf("%s: channel %d plays pattern %s, which is not defined", filePath, channel+1, name)
+			}
+
+			key := compiledKey{name, kind}
+			address, ok := compiled[key]
+			if !ok {
+				events, err := compileMMLPattern(name, mml, kind)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", filePath, err)
+				}
+				address = bankedAddress(patternsAddress + uint32(len(patterns)))
+				compiled[key] = address
+				patterns = append(patterns, events...)
+			}
+			orderLists[channel] = append(orderLists[channel], uint8(address&0xff), uint8(address>>8))
+		}
+		if len(order) > 0 {
+			orderLists[channel] = append(orderLists[channel], 0, 0)
+		}
+	}
+
+	result := []byte{uint8(song.Tempo)}
+	orderListAddress := currentAddress + 1 + 4*2
+	for _, orderList := range orderLists {
+		if len(orderList) == 0 {
+			result = append(result, 0, 0)
+			continue
+		}
+		address := bankedAddress(orderListAddress)
+		result = append(result, uint8(address&0xff), uint8(address>>8))
+		orderListAddress += uint32(len(orderList))
+	}
+	for _, orderList := range orderLists {
+		result = append(result, orderList...)
+	}
+	return append(result, patterns...), nil
+}
+
+// Source of the music driver inserted by .MUSICDRIVER, with its variables at ramAddress
+func includeMusicDriver(state *ProgramState, ramAddress string) (string, []byte, error) {
+	address, err := Raw16(nil, "", &state.Defs, 0, ramAddress)
+	if err != nil {
+		return "", nil, fmt.Errorf(".MUSICDRIVER takes the address of the 43 bytes of RAM used by the driver: %w", err)
+	}
+	if address < 0xa000 {
+		return "", nil, fmt.Errorf("The variables of the music driver must be in RAM, not at $%04x", address)
+	}
+
+	state.Defs["MUSIC_RAM"] = Raw16b(address)
+	source, err := libraries.ReadFile("lib/music.gbasm")
+	return "lib/music.gbasm", source, err
+}
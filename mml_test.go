@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestIncludeMMLGolden(t *testing.T) {
+	song, err := os.ReadFile("examples/music.mml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := os.ReadFile("testdata/music.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := assembleTestFile(t, ".INCMML \"music.mml\"\n", map[string][]byte{"music.mml": song})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, expected) {
+		t.Errorf("Got\n% x\nexpected\n% x", result, expected)
+	}
+}
+
+func TestIncludeMMLErrors(t *testing.T) {
+	tests := []struct {
+		song     string
+		expected string
+	}{
+		{"#PATTERN a c\n#LOOP a\n", "unknown command \"#LOOP\""},
+		{"#PATTERN a c x\n#CHANNEL 1 a\n", "unknown command 'x'"},
+		{"#PATTERN a o9 c\n#CHANNEL 1 a\n", "out of the range of the channel"},
+		{"#PATTERN a o c\n#CHANNEL 1 a\n", "o must be followed by the octave"},
+		{"#PATTERN a c\n#CHANNEL 1 a b\n", "channel 1 plays pattern B, which is not defined"},
+		{"#PATTERN a c\n#CHANNEL 5 a\n", "the channel must be 1, 2, 3 or 4"},
+		{"c d e\n", "notes outside of a #PATTERN"},
+		{"#PATTERN a c\n#CHANNEL 4 a\n", "channel 4 plays noise"},
+	}
+
+	for _, test := range tests {
+		_, err := assembleTestFile(t, ".INCMML \"song.mml\"\n", map[string][]byte{"song.mml": []byte(test.song)})
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%q: expected an error containing %q, got %v", test.song, test.expected, err)
+		}
+	}
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The OAM position of an object is its screen position plus 16 for Y and 8 for X
+const (
+	oamOffsetY = 16
+	oamOffsetX = 8
+)
+
+// Named bits of the OAM attributes byte (the flips are the same bits as the CGB background attributes)
+var oamFlags = map[string]uint32{
+	"PRIORITY": 1 << 7,
+	"FLIPY":    attributeFlipY,
+	"FLIPX":    attributeFlipX,
+	"PAL0":     0,
+	"PAL1":     1 << 4,
+	"BANK0":    0,
+	"BANK1":    1 << 3,
+	"CGBPAL0":  0,
+	"CGBPAL1":  1,
+	"CGBPAL2":  2,
+	"CGBPAL3":  3,
+	"CGBPAL4":  4,
+	"CGBPAL5":  5,
+	"CGBPAL6":  6,
+	"CGBPAL7":  7,
+}
+
+// A byte parameter of a directive. Macro arguments are Raw16b, so they are accepted if they fit.
+func parseByte(state *ProgramState, lastAbsoluteLabel string, currentAddress uint32, param string) (uint32, error) {
+	v, err := Raw8(&state.Labels, lastAbsoluteLabel, &state.Defs, currentAddress, param)
+	if err == nil {
+		return v, nil
+	}
+	v, err16 := Raw16(&state.Labels, lastAbsoluteLabel, &state.Defs, currentAddress, param)
+	if err16 != nil || v > 0xff {
+		return 0, err
+	}
+	return v, nil
+}
+
+// Screen coordinate (which can be negative to be partly off screen) converted to an OAM coordinate
+func parseScreenCoordinate(
+	state *ProgramState,
+	lastAbsoluteLabel string,
+	currentAddress uint32,
+	param string,
+	offset int,
+) (uint32, error) {
+	negative := strings.HasPrefix(param, "-")
+	v, err := parseByte(state, lastAbsoluteLabel, currentAddress, strings.TrimPrefix(param, "-"))
+	if err != nil {
+		return 0, err
+	}
+
+	coordinate := int(v)
+	if negative {
+		coordinate = -coordinate
+	}
+	if coordinate+offset < 0 || coordinate+offset > 0xff {
+		return 0, fmt.Errorf("Screen coordinate %d is out of the OAM range (%d to %d)", coordinate, -offset, 0xff-offset)
+	}
+	return uint32(coordinate + offset), nil
+}
+
+// Attributes written as flag names and numbers separated by |, like FLIPX|PAL1|CGBPAL2
+func parseOAMFlags(state *ProgramState, lastAbsoluteLabel string, currentAddress uint32, param string) (uint32, error) {
+	result := uint32(0)
+	for _, flag := range strings.Split(param, "|") {
+		flag = strings.TrimSpace(flag)
+		if v, ok := oamFlags[strings.ToUpper(flag)]; ok {
+			result |= v
+			continue
+		}
+
+		v, err := parseByte(state, lastAbsoluteLabel, currentAddress, flag)
+		if err != nil {
+			return 0, fmt.Errorf(
+				"Unknown OAM flag \"%s\" (expected PRIORITY, FLIPY, FLIPX, PAL0, PAL1, BANK0, BANK1, CGBPAL0 to CGBPAL7 or a number)",
+				flag,
+			)
+		}
+		result |= v
+	}
+	return result, nil
+}
+
+// Converts a .OAM y, x, tile[, flags] to the 4 bytes of an OAM entry
+func assembleOAMEntry(state *ProgramState, lastAbsoluteLabel string, currentAddress uint32, arguments string) ([]byte, error) {
+	params := strings.Split(arguments, ",")
+	if len(params) != 3 && len(params) != 4 {
+		return nil, fmt.Errorf(".OAM takes a Y and X screen position, a tile number and optionally flags")
+	}
+	for i := range params {
+		params[i] = strings.TrimSpace(params[i])
+	}
+
+	y, err := parseScreenCoordinate(state, lastAbsoluteLabel, currentAddress, params[0], oamOffsetY)
+	if err != nil {
+		return nil, err
+	}
+
+	x, err := parseScreenCoordinate(state, lastAbsoluteLabel, currentAddress, params[1], oamOffsetX)
+	if err != nil {
+		return nil, err
+	}
+
+	tile, err := parseByte(state, lastAbsoluteLabel, currentAddress, params[2])
+	if err != nil {
+		return nil, err
+	}
+
+	flags := uint32(0)
+	if len(params) == 4 {
+		flags, err = parseOAMFlags(state, lastAbsoluteLabel, currentAddress, params[3])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return []byte{uint8(y), uint8(x), uint8(tile), uint8(flags)}, nil
+}
+
+// The parts of the Aseprite JSON sprite sheet format used by .INCMETASPRITE
+type asepriteSheet struct {
+	Frames json.RawMessage `json:"frames"`
+	Meta   struct {
+		Image     string `json:"image"`
+		FrameTags []struct {
+			Name string `json:"name"`
+			From int    `json:"from"`
+			To   int    `json:"to"`
+		} `json:"frameTags"`
+	} `json:"meta"`
+}
+
+type asepriteRect struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+type asepriteFrame struct {
+	Frame            asepriteRect `json:"frame"`
+	Rotated          bool         `json:"rotated"`
+	SpriteSourceSize asepriteRect `json:"spriteSourceSize"`
+}
+
+// Frames of the sheet in order. Aseprite writes them as an array or as an object whose keys are
+// the frame names, in order.
+func (sheet asepriteSheet) frames() ([]asepriteFrame, error) {
+	frames := []asepriteFrame{}
+	if bytes.HasPrefix(bytes.TrimSpace(sheet.Frames), []byte("[")) {
+		err := json.Unmarshal(sheet.Frames, &frames)
+		return frames, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(sheet.Frames))
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	for decoder.More() {
+		// Frame name
+		if _, err := decoder.Token(); err != nil {
+			return nil, err
+		}
+
+		frame := asepriteFrame{}
+		if err := decoder.Decode(&frame); err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
+
+type MetaspriteOptions struct {
+	Name        string
+	Shades      [4]uint8
+	Base        uint32
+	Sprites8x16 bool
+	Flip        bool
+	// The palette of the indexed image is made of CGB palettes of 4 colours, which are written in the
+	// flags of the entries
+	CGB bool
+	// Position in the frame of the point the entries are relative to
+	OriginX int
+	OriginY int
+}
+
+func parseMetaspriteOptions(filePath string, parameters []string) (MetaspriteOptions, error) {
+	options := MetaspriteOptions{
+		Name:   nameFromFile(filePath),
+		Shades: [4]uint8{0, 1, 2, 3},
+	}
+
+	for _, parameter := range parameters {
+		key, value, hasValue := strings.Cut(strings.ToUpper(parameter), "=")
+		switch {
+		case key == "8X16" && !hasValue:
+			options.Sprites8x16 = true
+		case key == "FLIP" && !hasValue:
+			options.Flip = true
+		case key == "CGB" && !hasValue:
+			options.CGB = true
+		case key == "SHADES" && hasValue:
+			shades, err := parseShades(value)
+			if err != nil {
+				return options, err
+			}
+			options.Shades = shades
+		case key == "BASE" && hasValue:
+			base, err := Raw8(nil, "", &Definitions{}, 0, value)
+			if err != nil {
+				return options, fmt.Errorf("Invalid BASE tile number \"%s\": %w", value, err)
+			}
+			options.Base = base
+		case key == "ORIGIN" && hasValue:
+			x, y, ok := strings.Cut(value, ":")
+			originX, errX := strconv.Atoi(x)
+			originY, errY := strconv.Atoi(y)
+			if !ok || errX != nil || errY != nil {
+				return options, fmt.Errorf("ORIGIN must be written ORIGIN=x:y, not \"%s\"", value)
+			}
+			options.OriginX, options.OriginY = originX, originY
+		case key == "NAME" && hasValue:
+			options.Name = value
+		default:
+			return options, fmt.Errorf(
+				"Unknown metasprite option \"%s\" (expected 8X16, FLIP, CGB, SHADES=xxxx, BASE=xx, ORIGIN=x:y or NAME=name)",
+				parameter,
+			)
+		}
+	}
+
+	if options.Sprites8x16 && options.Base%2 != 0 {
+		return options, fmt.Errorf("BASE must be even for 8x16 sprites (got %d)", options.Base)
+	}
+	return options, nil
+}
+
+// The tiles of one object: the top tile, and the bottom one for 8x16 sprites
+type spriteTiles [2]Tile
+
+func (tiles spriteTiles) FlipX() spriteTiles {
+	return spriteTiles{tiles[0].FlipX(), tiles[1].FlipX()}
+}
+
+func (tiles spriteTiles) FlipY(sprites8x16 bool) spriteTiles {
+	if !sprites8x16 {
+		return spriteTiles{tiles[0].FlipY(), tiles[1]}
+	}
+	return spriteTiles{tiles[1].FlipY(), tiles[0].FlipY()}
+}
+
+type spriteVariant struct {
+	tiles spriteTiles
+	flags uint8
+}
+
+// The tiles of an object and its CGB palette: the same pixels in another palette are another object
+type paletteSpriteTiles struct {
+	tiles   spriteTiles
+	palette uint8
+}
+
+// Metasprite entries end with a Y offset of -128
+const metaspriteEnd = 0x80
+
+// Reads an Aseprite sprite sheet (.INCMETASPRITE) and its image and inserts the different tiles of
+// the frames followed by a table of the metasprite entries of each frame and a table of pointers
+// to them. Labels are defined at the start of each part.
+func includeMetasprite(state *ProgramState, arguments string, currentAddress uint32, isFirstPass bool) ([]byte, error) {
+	filePath, parameters, err := parseFileArguments(arguments)
+	if err != nil {
+		return nil, err
+	}
+
+	options, err := parseMetaspriteOptions(filePath, parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	filePath, err = resolveInclude(state, filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := state.Sources.Read(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	sheet := asepriteSheet{}
+	err = json.Unmarshal(content, &sheet)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read %s as an Aseprite JSON sprite sheet: %w", filePath, err)
+	}
+
+	frames, err := sheet.frames()
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read the frames of %s: %w", filePath, err)
+	}
+
+	// The image is relative to the JSON file
+	imagePath := filepath.Join(filepath.Dir(filePath), sheet.Meta.Image)
+	imageContent, err := state.Sources.Read(imagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(imageContent))
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't decode %s: %w", imagePath, err)
+	}
+	err = checkPaletteIndexes(img, options.CGB)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", imagePath, err)
+	}
+
+	objectHeight := 8
+	if options.Sprites8x16 {
+		objectHeight = 16
+	}
+
+	type entry struct {
+		y, x  int
+		index int
+		flags uint8
+	}
+
+	unique := []spriteTiles{}
+	indexes := make(map[paletteSpriteTiles]int)
+	frameEntries := make([][]entry, len(frames))
+
+	for i, frame := range frames {
+		if frame.Rotated {
+			return nil, fmt.Errorf("Frame %d of %s is rotated, which is not supported", i, filePath)
+		}
+
+		// Colour of a pixel of the frame, 0 outside of it
+		pixel := func(x int, y int) uint8 {
+			if x >= frame.Frame.W || y >= frame.Frame.H {
+				return 0
+			}
+			return options.Shades[pixelShade(img, frame.Frame.X+x, frame.Frame.Y+y)]
+		}
+
+		for objectY := 0; objectY < frame.Frame.H; objectY += objectHeight {
+			for objectX := 0; objectX < frame.Frame.W; objectX += 8 {
+				tiles := spriteTiles{}
+				empty := true
+				// The transparent pixels (colour 0 of any palette) don't choose the palette of the object
+				palette, opaque := uint8(0), false
+				for y := 0; y < objectHeight; y++ {
+					for x := 0; x < 8; x++ {
+						colour := pixel(objectX+x, objectY+y)
+						tiles[y/8][(y%8)*8+x] = colour
+						empty = empty && colour == 0
+
+						if objectX+x >= frame.Frame.W || objectY+y >= frame.Frame.H {
+							continue
+						}
+						imageX, imageY := frame.Frame.X+objectX+x, frame.Frame.Y+objectY+y
+						if pixelShade(img, imageX, imageY) == 0 {
+							continue
+						}
+						colourPalette, err := pixelPalette(img, imageX, imageY, options.CGB)
+						if err != nil {
+							return nil, fmt.Errorf("%s: %w", imagePath, err)
+						}
+						if opaque && colourPalette != palette {
+							return nil, fmt.Errorf(
+								"Frame %d of %s: the object at (%d, %d) uses colours of both palette %d and palette %d",
+								i,
+								filePath,
+								objectX,
+								objectY,
+								palette,
+								colourPalette,
+							)
+						}
+						palette, opaque = colourPalette, true
+					}
+				}
+				if empty {
+					continue
+				}
+
+				variants := []spriteVariant{{tiles, 0}}
+				if options.Flip {
+					variants = append(
+						variants,
+						spriteVariant{tiles.FlipX(), attributeFlipX},
+						spriteVariant{tiles.FlipY(options.Sprites8x16), attributeFlipY},
+						spriteVariant{tiles.FlipX().FlipY(options.Sprites8x16), attributeFlipX | attributeFlipY},
+					)
+				}
+
+				e := entry{
+					y:     frame.SpriteSourceSize.Y + objectY - options.OriginY,
+					x:     frame.SpriteSourceSize.X + objectX - options.OriginX,
+					flags: palette,
+				}
+				found := false
+				for _, variant := range variants {
+					if index, ok := indexes[paletteSpriteTiles{variant.tiles, palette}]; ok {
+						e.index, e.flags = index, variant.flags|palette
+						found = true
+						break
+					}
+				}
+				if !found {
+					indexes[paletteSpriteTiles{tiles, palette}] = len(unique)
+					e.index = len(unique)
+					unique = append(unique, tiles)
+				}
+
+				if e.y < -127 || e.y > 127 || e.x < -128 || e.x > 127 {
+					return nil, fmt.Errorf(
+						"Frame %d of %s: the object at (%d, %d) is too far from the origin",
+						i,
+						filePath,
+						e.x,
+						e.y,
+					)
+				}
+				frameEntries[i] = append(frameEntries[i], e)
+			}
+		}
+	}
+
+	tilesPerObject := objectHeight / 8
+	if int(options.Base)+len(unique)*tilesPerObject > 0x100 {
+		return nil, fmt.Errorf(
+			"%s needs %d tiles, which doesn't fit after tile %d",
+			filePath,
+			len(unique)*tilesPerObject,
+			options.Base,
+		)
+	}
+
+	name := strings.ToUpper(options.Name)
+	result := []byte{}
+
+	err = defineDirectiveLabel(state, name+".TILES", currentAddress, isFirstPass)
+	if err != nil {
+		return nil, err
+	}
+	for _, tiles := range unique {
+		for _, tile := range tiles[:tilesPerObject] {
+			result = append(result, tile.Encode2bpp()...)
+		}
+	}
+
+	// Each entry is a Y offset, a X offset, a tile number and the flags
+	frameAddresses := make([]uint32, len(frames))
+	for i, entries := range frameEntries {
+		frameAddresses[i] = currentAddress + uint32(len(result))
+		err = defineDirectiveLabel(state, fmt.Sprintf("%s.FRAME%d", name, i), frameAddresses[i], isFirstPass)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range entries {
+			tile := int(options.Base) + e.index*tilesPerObject
+			result = append(result, uint8(e.y), uint8(e.x), uint8(tile), e.flags)
+		}
+		result = append(result, metaspriteEnd)
+	}
+
+	// Pointers (little endian) to the entries of each frame, usable from the same bank
+	err = defineDirectiveLabel(state, name+".TABLE", currentAddress+uint32(len(result)), isFirstPass)
+	if err != nil {
+		return nil, err
+	}
+	for _, address := range frameAddresses {
+		if bank := address / 0x4000; bank != 0 {
+			address = address - bank*0x4000 + 0x4000
+		}
+		result = append(result, uint8(address&0xff), uint8(address>>8))
+	}
+
+	constants := map[string]int{
+		name + "_TILES":  len(unique) * tilesPerObject,
+		name + "_FRAMES": len(frames),
+	}
+	for _, tag := range sheet.Meta.FrameTags {
+		tagName := name + "_" + nameFromFile(tag.Name)
+		constants[tagName] = tag.From
+		constants[tagName+"_LENGTH"] = tag.To - tag.From + 1
+	}
+	for constant, value := range constants {
+		err = defineConstant(state, constant, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
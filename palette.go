@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+// The CGB palettes have 4 colours and there are 8 of them for the background (and 8 for the objects)
+const (
+	paletteColours = 4
+	maxPalettes    = 8
+)
+
+// CGB colour: 5 bits per component, red in the low bits, stored in little endian
+func encodeCGBColour(r uint8, g uint8, b uint8) []byte {
+	to5bits := func(v uint8) uint16 { return (uint16(v)*31 + 127) / 255 }
+	colour := to5bits(r) | to5bits(g)<<5 | to5bits(b)<<10
+	return []byte{uint8(colour & 0xff), uint8(colour >> 8)}
+}
+
+// Parses a colour written #rrggbb or rgb(r, g, b) (with components from 0 to 255)
+func parseColour(param string) (uint8, uint8, uint8, error) {
+	param = strings.TrimSpace(param)
+	lower := strings.ToLower(param)
+
+	if strings.HasPrefix(lower, "#") {
+		if len(lower) != 7 {
+			return 0, 0, 0, fmt.Errorf("Colour \"%s\" must be written #rrggbb", param)
+		}
+		v, err := strconv.ParseUint(lower[1:], 16, 32)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("Colour \"%s\" must be written #rrggbb", param)
+		}
+		return uint8(v >> 16), uint8(v >> 8), uint8(v), nil
+	}
+
+	if strings.HasPrefix(lower, "rgb(") && strings.HasSuffix(lower, ")") {
+		components := strings.Split(lower[4:len(lower)-1], ",")
+		if len(components) != 3 {
+			return 0, 0, 0, fmt.Errorf("Colour \"%s\" must have 3 components", param)
+		}
+
+		result := [3]uint8{}
+		for i, component := range components {
+			v, err := strconv.ParseUint(strings.TrimSpace(component), 0, 8)
+			if err != nil {
+				return 0, 0, 0, fmt.Errorf("Component \"%s\" of colour \"%s\" is not between 0 and 255", component, param)
+			}
+			result[i] = uint8(v)
+		}
+		return result[0], result[1], result[2], nil
+	}
+
+	return 0, 0, 0, fmt.Errorf("Couldn't parse \"%s\" as a colour (expected #rrggbb or rgb(r, g, b))", param)
+}
+
+// Splits on the commas that are not between parentheses
+func splitColours(arguments string) []string {
+	result := []string{}
+	depth := 0
+	start := 0
+	for i, c := range arguments {
+		switch c {
+		case '(':
+			depth += 1
+		case ')':
+			depth -= 1
+		case ',':
+			if depth == 0 {
+				result = append(result, arguments[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(result, arguments[start:])
+}
+
+// Converts the colours of a .PALETTE to a CGB palette
+func assemblePalette(arguments string) ([]byte, error) {
+	if strings.TrimSpace(arguments) == "" {
+		return nil, fmt.Errorf(".PALETTE needs at least one colour")
+	}
+
+	colours := splitColours(arguments)
+	if len(colours) > paletteColours {
+		return nil, fmt.Errorf("A palette has at most %d colours, %d were given", paletteColours, len(colours))
+	}
+
+	result := []byte{}
+	for _, colour := range colours {
+		r, g, b, err := parseColour(colour)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, encodeCGBColour(r, g, b)...)
+	}
+	return result, nil
+}
+
+// Converts the palette of an indexed PNG (.INCPAL) to CGB palettes: the palette indexes 0 to 3 are
+// the first palette, 4 to 7 the second one, etc. Like for .INCGFX, each tile must only use the
+// colours of one palette.
+func includePalettes(state *ProgramState, arguments string) ([]byte, error) {
+	filePath, parameters, err := parseFileArguments(arguments)
+	if err != nil {
+		return nil, err
+	}
+
+	name := nameFromFile(filePath)
+	for _, parameter := range parameters {
+		key, value, hasValue := strings.Cut(strings.ToUpper(parameter), "=")
+		if key != "NAME" || !hasValue {
+			return nil, fmt.Errorf("Unknown palette option \"%s\" (expected NAME=name)", parameter)
+		}
+		name = value
+	}
+
+	filePath, err = resolveInclude(state, filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := state.Sources.Read(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := decodePNG(filePath, content)
+	if err != nil {
+		return nil, err
+	}
+
+	paletted, ok := img.(*image.Paletted)
+	if !ok {
+		return nil, fmt.Errorf("%s must be an indexed PNG to read its palettes", filePath)
+	}
+
+	bounds := paletted.Bounds()
+	for tileY := bounds.Min.Y; tileY < bounds.Max.Y; tileY += 8 {
+		for tileX := bounds.Min.X; tileX < bounds.Max.X; tileX += 8 {
+			err := checkTilePalette(paletted, tileX, tileY)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", filePath, err)
+			}
+		}
+	}
+
+	// Only the palettes used by the image are inserted
+	used := 0
+	for _, index := range paletted.Pix {
+		used = max(used, int(index)/paletteColours+1)
+	}
+	if used > maxPalettes {
+		return nil, fmt.Errorf(
+			"%s uses %d palettes of %d colours but there are only %d CGB palettes",
+			filePath,
+			used,
+			paletteColours,
+			maxPalettes,
+		)
+	}
+
+	result := []byte{}
+	for i := 0; i < used*paletteColours; i++ {
+		c := color.RGBA{A: 0xff}
+		if i < len(paletted.Palette) {
+			c = color.RGBAModel.Convert(paletted.Palette[i]).(color.RGBA)
+		}
+		result = append(result, encodeCGBColour(c.R, c.G, c.B)...)
+	}
+
+	err = defineConstant(state, name+"_PALETTES", used)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
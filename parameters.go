@@ -1,11 +1,25 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
 )
 
+// A label or a definition that isn't defined. During the layout passes, it can still be defined
+// further in the program, so only the second pass reports it.
+type UndefinedError string
+
+func (err UndefinedError) Error() string {
+	return string(err)
+}
+
+func isUndefined(err error) bool {
+	var undefined UndefinedError
+	return errors.As(err, &undefined)
+}
+
 func parseOffset(param string) (string, uint32, error) {
 	if strings.Contains(param, "+") {
 		labelParts := strings.Split(param, "+")
@@ -180,7 +194,7 @@ func Raw8(
 
 		definition, ok := (*defs)[varWithoutOffset]
 		if !ok {
-			return 0, fmt.Errorf("$%s is undefined", varWithoutOffset)
+			return 0, UndefinedError(fmt.Sprintf("$%s is undefined", varWithoutOffset))
 		}
 
 		res, ok := definition.(Raw8b)
@@ -247,7 +261,7 @@ func Raw16(
 
 		definition, ok := (*defs)[varWithoutOffset]
 		if !ok {
-			return 0, fmt.Errorf("$%s is undefined", varWithoutOffset)
+			return 0, UndefinedError(fmt.Sprintf("$%s is undefined", varWithoutOffset))
 		}
 
 		res, ok := definition.(Raw16b)
@@ -377,6 +391,9 @@ func Raw16(
 
 		return romAddr - romAddrBank*0x4000 + 0x4000, nil
 	}
+	if isUndefined(err) {
+		return 0, err
+	}
 
 	v, err := Raw8(labels, lastAbsoluteLabel, defs, currentAddress, param)
 	if err == nil {
@@ -388,6 +405,34 @@ func Raw16(
 	return uint32(res), err
 }
 
+// Like Raw16, with hexadecimal ($ or 0x) and decimal values up to 32 bits, for the offsets in
+// files larger than 64KiB
+func Raw32(
+	labels *Labels,
+	lastAbsoluteLabel string,
+	defs *Definitions,
+	currentAddress uint32,
+	param string,
+) (uint32, error) {
+	v, err := Raw16(labels, lastAbsoluteLabel, defs, currentAddress, param)
+	if err == nil {
+		return v, nil
+	}
+
+	if hex, ok := strings.CutPrefix(param, "$"); ok {
+		if res, err := strconv.ParseUint(hex, 16, 32); err == nil {
+			return uint32(res), nil
+		}
+	} else if hex, ok := strings.CutPrefix(param, "0x"); ok {
+		if res, err := strconv.ParseUint(hex, 16, 32); err == nil {
+			return uint32(res), nil
+		}
+	} else if res, err := strconv.ParseUint(param, 10, 32); err == nil {
+		return uint32(res), nil
+	}
+	return 0, err
+}
+
 func Raw16MacroRelativeLabel(
 	labels *Labels,
 	lastAbsoluteLabel string,
@@ -436,7 +481,7 @@ func Raw8Indirect(
 
 		definition, ok := (*defs)[param]
 		if !ok {
-			return 0, fmt.Errorf("$%s is undefined", param)
+			return 0, UndefinedError(fmt.Sprintf("$%s is undefined", param))
 		}
 
 		res, ok := definition.(Indirect8b)
@@ -473,7 +518,7 @@ func Raw16Indirect(
 
 		definition, ok := (*defs)[param]
 		if !ok {
-			return 0, fmt.Errorf("$%s is undefined", param)
+			return 0, UndefinedError(fmt.Sprintf("$%s is undefined", param))
 		}
 
 		res, ok := definition.(Indirect16b)
@@ -523,7 +568,7 @@ func ROMAddress(
 		label := strings.ToUpper(strings.TrimPrefix(labelWithoutOffset, "="))
 		labelValue, ok := (*labels)[label]
 		if !ok {
-			return 0, fmt.Errorf("Label \"%s\" not found", label)
+			return 0, UndefinedError(fmt.Sprintf("Label \"%s\" not found", label))
 		}
 
 		return uint32(labelValue) + offset, nil
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A branch for which the assembler picks the encoding: JR when the target is close enough, JP otherwise.
+type RelaxedBranch struct {
+	Address           uint32
+	Target            string
+	LastAbsoluteLabel string
+	Long              bool
+}
+
+// Branches are identified by their order of appearance, which is the same on every pass.
+type BranchRelaxation struct {
+	RelaxJP  bool
+	Branches []RelaxedBranch
+	next     int
+}
+
+func (relax *BranchRelaxation) Reset() {
+	relax.next = 0
+}
+
+// Rewrites JMP (and JP when RelaxJP is set) into the JR or JP chosen for this branch.
+// Every branch starts as a JR and is only turned into a JP once its target is out of range,
+// which guarantees the passes stop.
+func (relax *BranchRelaxation) Rewrite(line string, currentAddress uint32, lastAbsoluteLabel string) string {
+	words := strings.Fields(strings.ReplaceAll(line, ",", " "))
+	if len(words) < 2 || len(words) > 3 {
+		return line
+	}
+
+	isRelaxedJP := words[0] == "JP" && relax != nil && relax.RelaxJP
+	if words[0] != "JMP" && !isRelaxedJP {
+		return line
+	}
+
+	// Inside of macros (no relaxation state) and for JP HL, only JP is possible. JR would read a
+	// number as an offset instead of an address, so only the branches to a label are relaxed.
+	if relax == nil || !strings.HasPrefix(words[len(words)-1], "=") {
+		return "JP " + strings.Join(words[1:], ", ")
+	}
+
+	if relax.next == len(relax.Branches) {
+		relax.Branches = append(relax.Branches, RelaxedBranch{})
+	}
+	branch := &relax.Branches[relax.next]
+	relax.next += 1
+
+	branch.Address = currentAddress
+	branch.Target = words[len(words)-1]
+	branch.LastAbsoluteLabel = lastAbsoluteLabel
+
+	if branch.Long {
+		return "JP " + strings.Join(words[1:], ", ")
+	}
+	return "JR " + strings.Join(words[1:], ", ")
+}
+
+// Checks every short branch against the labels of the last pass and turns the ones that
+// cannot reach their target into JP. Returns whether another pass is needed.
+func (relax *BranchRelaxation) Update(labels Labels, defs Definitions) bool {
+	changed := false
+	for i := range relax.Branches {
+		branch := &relax.Branches[i]
+		if branch.Long {
+			continue
+		}
+
+		target, err := Raw16(&labels, branch.LastAbsoluteLabel, &defs, branch.Address, branch.Target)
+		if err != nil {
+			// The second pass will report the error
+			continue
+		}
+
+		if _, err := absoluteJPValueToRelative(branch.Address, target); err != nil {
+			branch.Long = true
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (relax *BranchRelaxation) PrintReport() {
+	short := 0
+	for _, branch := range relax.Branches {
+		if !branch.Long {
+			short += 1
+		}
+	}
+	fmt.Printf(
+		"Branch relaxation: %d of %d branches assembled as JR (%d bytes saved)\n",
+		short,
+		len(relax.Branches),
+		short,
+	)
+}
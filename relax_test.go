@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBranchRelaxation(t *testing.T) {
+	source := `Start:
+	JMP =Start
+	JMP NZ, =Start
+	JMP $08
+	JMP NZ, $1234
+	JMP HL
+	JMP =Far
+	JP =Start
+	JP $08
+.PADTO $100
+Far:
+	NOP
+`
+	tests := []struct {
+		relaxJP  bool
+		expected []byte
+	}{
+		{false, []byte{
+			0x18, 0xfe, // JMP =Start
+			0x20, 0xfc, // JMP NZ, =Start
+			0xc3, 0x08, 0x00, // JMP $08 stays an address
+			0xc2, 0x34, 0x12, // JMP NZ, $1234
+			0xe9,             // JMP HL
+			0xc3, 0x00, 0x01, // JMP =Far is too far for JR
+			0xc3, 0x00, 0x00, // JP =Start
+			0xc3, 0x08, 0x00, // JP $08
+		}},
+		{true, []byte{
+			0x18, 0xfe,
+			0x20, 0xfc,
+			0xc3, 0x08, 0x00,
+			0xc2, 0x34, 0x12,
+			0xe9,
+			0xc3, 0x00, 0x01,
+			0x18, 0xf0, // JP =Start is relaxed with -relax
+			0xc3, 0x08, 0x00, // but not JP $08
+		}},
+	}
+	for _, test := range tests {
+		result, err := parseFile(filepath.Join(t.TempDir(), "main.gbasm"), []byte(source), 0, Options{
+			RelaxJP:  test.relaxJP,
+			Quiet:    true,
+			Sources:  &SourceFiles{},
+			Warnings: &[]LintWarning{},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result) != 0x101 || result[0x100] != 0x00 {
+			t.Fatalf("-relax=%v: Far is not at $100 in\n% x", test.relaxJP, result)
+		}
+		if !bytes.Equal(result[:len(test.expected)], test.expected) {
+			t.Errorf("-relax=%v: got\n% x\nexpected\n% x", test.relaxJP, result[:len(test.expected)], test.expected)
+		}
+	}
+}
+
+func TestBranchRelaxationRewrite(t *testing.T) {
+	relax := &BranchRelaxation{RelaxJP: true}
+	tests := []struct {
+		line     string
+		expected string
+	}{
+		{"JMP =Loop", "JR =Loop"},
+		{"JP NZ, =Loop", "JR NZ, =Loop"},
+		{"JP $08", "JP $08"},
+		{"JMP C, $1234", "JP C, $1234"},
+		{"JMP HL", "JP HL"},
+		{"LD A, B", "LD A, B"},
+	}
+	for _, test := range tests {
+		if rewritten := relax.Rewrite(test.line, 0, ""); rewritten != test.expected {
+			t.Errorf("Rewrite(%q) = %q, expected %q", test.line, rewritten, test.expected)
+		}
+	}
+	// Only the branches to a label can be relaxed
+	if len(relax.Branches) != 2 {
+		t.Errorf("%d branches registered instead of 2", len(relax.Branches))
+	}
+
+	// The branch to a label out of range falls back to JP on the next pass
+	labels := Labels{"LOOP": 0x1000}
+	if !relax.Update(labels, Definitions{}) {
+		t.Fatal("Update didn't find the branches out of range")
+	}
+	relax.Reset()
+	if rewritten := relax.Rewrite("JMP =Loop", 0, ""); rewritten != "JP =Loop" {
+		t.Errorf("Rewrite of a long branch = %q, expected JP =Loop", rewritten)
+	}
+	if relax.Update(labels, Definitions{}) {
+		t.Error("Update changed the branches again")
+	}
+}
+
+func TestBranchRelaxationReport(t *testing.T) {
+	relax := &BranchRelaxation{Branches: []RelaxedBranch{{}, {Long: true}, {}}}
+
+	stdout := os.Stdout
+	printed, printer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = printer
+	relax.PrintReport()
+	os.Stdout = stdout
+	printer.Close()
+
+	report, err := io.ReadAll(printed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Branch relaxation: 2 of 3 branches assembled as JR (2 bytes saved)\n"
+	if string(report) != expected {
+		t.Errorf("Got %q, expected %q", report, expected)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// About 10 seconds of the real hardware
+const defaultRunCycles = 10 * 4194304
+
+func runMain(args []string) {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	maxCycles := flags.Uint64("cycles", defaultRunCycles, "Stops after this number of clock cycles (0 for no limit)")
+	trace := flags.Bool("trace", false, "Prints the registers before every instruction")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gbasm run [-cycles n] [-trace] [rom_file]\n")
+		fmt.Fprintf(os.Stderr, "Runs a ROM until HALT with the interrupts disabled, DBG or the cycle limit\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	rom, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error while reading the ROM: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	memory := NewMemory(rom)
+	memory.SerialOutput = os.Stdout
+	cpu := NewCPU(memory)
+
+	var traceOutput io.Writer
+	if *trace {
+		traceOutput = os.Stdout
+	}
+
+	reason, err := cpu.Run(*maxCycles, traceOutput)
+	if len(memory.Serial) > 0 && memory.Serial[len(memory.Serial)-1] != '\n' {
+		fmt.Println()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error after %d cycles: %s\n%s\n", cpu.Cycles, err.Error(), cpu.Dump())
+		os.Exit(1)
+	}
+
+	fmt.Printf("Stopped on %s after %d cycles\n%s\n", reason, cpu.Cycles, cpu.Dump())
+	if reason == StopCycleLimit {
+		os.Exit(1)
+	}
+}
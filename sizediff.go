@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+// The size of the banks and of the labels of a build
+type SizeSnapshot struct {
+	// Bytes used in every bank
+	Banks  map[int]uint
+	Labels map[string]uint
+}
+
+// Reads a file written with -map
+func readMapSizes(fileName string) (SizeSnapshot, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return SizeSnapshot{}, err
+	}
+	defer file.Close()
+
+	snapshot := SizeSnapshot{map[int]uint{}, map[string]uint{}}
+	scanner := bufio.NewScanner(file)
+	for lineNb := 1; scanner.Scan(); lineNb++ {
+		line := scanner.Text()
+		if strings.HasPrefix(line, ";") {
+			var bank int
+			var used uint
+			if _, err := fmt.Sscanf(line, "; Bank %x: %d bytes used", &bank, &used); err == nil {
+				snapshot.Banks[bank] = used
+			}
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 || len(fields) > 3 && strings.HasPrefix(fields[2], "(") {
+			// The padding
+			continue
+		}
+		if len(fields) != 3 {
+			return SizeSnapshot{}, fmt.Errorf("%s, line %d: expected an address, a size and a label", fileName, lineNb)
+		}
+		var size uint
+		if _, err := fmt.Sscanf(fields[1], "%d", &size); err != nil {
+			return SizeSnapshot{}, fmt.Errorf("%s, line %d: invalid size \"%s\"", fileName, lineNb, fields[1])
+		}
+		snapshot.Labels[fields[2]] = size
+	}
+	return snapshot, scanner.Err()
+}
+
+// Reads a ROM and the symbols printed while assembling it. The padding isn't known, so it is counted
+// in the size of the banks and of the labels before it.
+func readROMSizes(romFileName string, symbolsFileName string) (SizeSnapshot, error) {
+	rom, err := os.ReadFile(romFileName)
+	if err != nil {
+		return SizeSnapshot{}, err
+	}
+	symbols, err := os.ReadFile(symbolsFileName)
+	if err != nil {
+		return SizeSnapshot{}, err
+	}
+
+	labels := Labels{}
+	for _, line := range strings.Split(string(symbols), "\n") {
+		// The other lines are the reports of the assembler
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		address, err := ROMAddress(nil, "", nil, 0, fields[0])
+		if err != nil {
+			continue
+		}
+		labels[fields[1]] = uint(address)
+	}
+
+	memoryMap := &MemoryMap{}
+	snapshot := SizeSnapshot{map[int]uint{}, memoryMap.LabelSizes(rom, labels)}
+	for _, usage := range memoryMap.Banks(rom) {
+		snapshot.Banks[usage.Bank] = usage.Used
+	}
+	return snapshot, nil
+}
+
+type sizeDelta struct {
+	Name     string
+	Old      uint
+	New      uint
+	OldFound bool
+	NewFound bool
+}
+
+func (delta sizeDelta) Delta() int {
+	return int(delta.New) - int(delta.Old)
+}
+
+func formatSize(size uint, found bool) string {
+	if !found {
+		return "-"
+	}
+	return fmt.Sprint(size)
+}
+
+// The entries whose size changed, the largest changes first
+func sizeDeltas[K comparable](old map[K]uint, new map[K]uint, name func(K) string) []sizeDelta {
+	deltas := []sizeDelta{}
+	keys := slices.Collect(maps.Keys(old))
+	for key := range new {
+		if _, ok := old[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		oldSize, oldFound := old[key]
+		newSize, newFound := new[key]
+		if oldFound == newFound && oldSize == newSize {
+			continue
+		}
+		deltas = append(deltas, sizeDelta{name(key), oldSize, newSize, oldFound, newFound})
+	}
+	slices.SortFunc(deltas, func(a, b sizeDelta) int {
+		if a.Delta()*a.Delta() != b.Delta()*b.Delta() {
+			return b.Delta()*b.Delta() - a.Delta()*a.Delta()
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	return deltas
+}
+
+func printSizeDeltas(title string, deltas []sizeDelta) {
+	width := len(title)
+	for _, delta := range deltas {
+		width = max(width, len(delta.Name))
+	}
+	fmt.Printf("%-*s  %6s  %6s  %6s\n", width, title, "Old", "New", "Delta")
+	for _, delta := range deltas {
+		fmt.Printf(
+			"%-*s  %6s  %6s  %+6d\n",
+			width,
+			delta.Name,
+			formatSize(delta.Old, delta.OldFound),
+			formatSize(delta.New, delta.NewFound),
+			delta.Delta(),
+		)
+	}
+}
+
+func printSizeDiff(old SizeSnapshot, new SizeSnapshot) {
+	banks := sizeDeltas(old.Banks, new.Banks, func(bank int) string { return fmt.Sprintf("%02x", bank) })
+	labels := sizeDeltas(old.Labels, new.Labels, func(label string) string { return label })
+	if len(banks) == 0 && len(labels) == 0 {
+		fmt.Printf("No size changed\n")
+		return
+	}
+
+	oldTotal, newTotal := uint(0), uint(0)
+	for _, used := range old.Banks {
+		oldTotal += used
+	}
+	for _, used := range new.Banks {
+		newTotal += used
+	}
+
+	if len(banks) > 0 {
+		printSizeDeltas("Bank", banks)
+	}
+	fmt.Printf("Total: %d -> %d bytes (%+d)\n", oldTotal, newTotal, int(newTotal)-int(oldTotal))
+	if len(labels) > 0 {
+		fmt.Println()
+		printSizeDeltas("Label", labels)
+	}
+}
+
+func sizediffMain(args []string) {
+	flags := flag.NewFlagSet("sizediff", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gbasm sizediff old_map_file new_map_file\n")
+		fmt.Fprintf(os.Stderr, "       gbasm sizediff old_rom_file old_symbols_file new_rom_file new_symbols_file\n")
+		fmt.Fprintf(os.Stderr, "Prints the size changes of the banks and the labels between two builds\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	var old, new SizeSnapshot
+	var err error
+	switch flags.NArg() {
+	case 2:
+		old, err = readMapSizes(flags.Arg(0))
+		if err == nil {
+			new, err = readMapSizes(flags.Arg(1))
+		}
+	case 4:
+		old, err = readROMSizes(flags.Arg(0), flags.Arg(1))
+		if err == nil {
+			new, err = readROMSizes(flags.Arg(2), flags.Arg(3))
+		}
+	default:
+		flags.Usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	printSizeDiff(old, new)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"maps"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSizeDeltas(t *testing.T) {
+	old := map[string]uint{"A": 10, "B": 5, "C": 3, "D": 7, "G": 4, "H": 8}
+	new := map[string]uint{"A": 12, "B": 1, "C": 3, "E": 6, "G": 6, "H": 6}
+
+	// The largest changes first, growing or shrinking, then by name
+	deltas := sizeDeltas(old, new, func(name string) string { return name })
+	order := []string{}
+	for _, delta := range deltas {
+		order = append(order, delta.Name)
+	}
+	if strings.Join(order, " ") != "D E B A G H" {
+		t.Errorf("Got the order %v, expected D E B A G H", order)
+	}
+
+	expected := map[string]sizeDelta{
+		"D": {"D", 7, 0, true, false},
+		"E": {"E", 0, 6, false, true},
+		"B": {"B", 5, 1, true, true},
+	}
+	for _, delta := range deltas {
+		if want, ok := expected[delta.Name]; ok && delta != want {
+			t.Errorf("Got %+v, expected %+v", delta, want)
+		}
+	}
+	if deltas[0].Delta() != -7 || deltas[1].Delta() != 6 {
+		t.Errorf("Got the deltas %d and %d instead of -7 and 6", deltas[0].Delta(), deltas[1].Delta())
+	}
+}
+
+func TestReadMapSizes(t *testing.T) {
+	dir := t.TempDir()
+	labels := Labels{}
+	memoryMap := &MemoryMap{}
+	rom, err := parseFile(filepath.Join(dir, "main.gbasm"), []byte(mapSource), 0, Options{
+		Quiet:     true,
+		Sources:   &SourceFiles{},
+		Warnings:  &[]LintWarning{},
+		Symbols:   &labels,
+		MemoryMap: memoryMap,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "main.map")
+	if err := memoryMap.Write(path, rom, labels); err != nil {
+		t.Fatal(err)
+	}
+
+	// The padding is skipped
+	snapshot, err := readMapSizes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !maps.Equal(snapshot.Banks, map[int]uint{0: 5, 1: 1}) {
+		t.Errorf("Got the banks %v", snapshot.Banks)
+	}
+	if !maps.Equal(snapshot.Labels, map[string]uint{"START": 4, "CODE": 1, "BANK1": 1}) {
+		t.Errorf("Got the labels %v", snapshot.Labels)
+	}
+}
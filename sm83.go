@@ -0,0 +1,852 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// Flags of the F register
+const (
+	flagZ = 0x80
+	flagN = 0x40
+	flagH = 0x20
+	flagC = 0x10
+)
+
+// Interrupts, by priority: VBlank, LCD STAT, timer, serial and joypad
+const (
+	interruptVBlank = 1 << 0
+	interruptStat   = 1 << 1
+	interruptTimer  = 1 << 2
+	interruptSerial = 1 << 3
+)
+
+type StopReason int
+
+const (
+	// HALT executed with the interrupts disabled (or with no interrupt that could wake the CPU up)
+	StopHalt StopReason = iota
+	// DBG (0xD3) executed
+	StopDebug
+	StopCycleLimit
+	// The program counter reached CPU.Breakpoint
+	StopBreakpoint
+)
+
+func (reason StopReason) String() string {
+	switch reason {
+	case StopHalt:
+		return "HALT with interrupts disabled"
+	case StopDebug:
+		return "DBG"
+	case StopCycleLimit:
+		return "cycle limit reached"
+	case StopBreakpoint:
+		return "breakpoint"
+	}
+	return "unknown"
+}
+
+// Memory map of a cartridge with a simple MBC: writing to $2000-$3fff selects the ROM bank mapped at
+// $4000-$7fff (0 selects bank 1), writing to $4000-$5fff selects the RAM bank mapped at $a000-$bfff
+// and writing $0a to $0000-$1fff enables the RAM. Only the IO registers needed to run code headlessly
+// are simulated (the LY and STAT LCD registers, DIV, the timer and an instant serial transfer).
+type Memory struct {
+	ROM        []byte
+	ROMBank    int
+	RAM        [16 * 0x2000]byte
+	RAMBank    int
+	RAMEnabled bool
+	VRAM       [0x2000]byte
+	WRAM       [0x2000]byte
+	OAM        [0xa0]byte
+	// $ff00 to $ffff: IO registers, HRAM and IE
+	High [0x100]byte
+
+	// Bytes sent through the serial port
+	Serial       []byte
+	SerialOutput io.Writer
+
+	lineCycles  int
+	divCycles   int
+	timerCycles int
+}
+
+const (
+	regP1   = 0x00
+	regSB   = 0x01
+	regSC   = 0x02
+	regDIV  = 0x04
+	regTIMA = 0x05
+	regTMA  = 0x06
+	regTAC  = 0x07
+	regIF   = 0x0f
+	regLCDC = 0x40
+	regSTAT = 0x41
+	regLY   = 0x44
+	regLYC  = 0x45
+	regIE   = 0xff
+)
+
+// Cycles of a line and number of lines of a frame
+const (
+	cyclesPerLine = 456
+	linesPerFrame = 154
+	vblankLine    = 144
+)
+
+func NewMemory(rom []byte) *Memory {
+	memory := &Memory{ROM: rom, ROMBank: 1}
+	// The LCD is on after the boot ROM
+	memory.High[regLCDC] = 0x91
+	return memory
+}
+
+func (memory *Memory) romByte(address int) uint8 {
+	if address < len(memory.ROM) {
+		return memory.ROM[address]
+	}
+	return 0xff
+}
+
+func (memory *Memory) Read(address uint16) uint8 {
+	switch {
+	case address < 0x4000:
+		return memory.romByte(int(address))
+	case address < 0x8000:
+		banks := max((len(memory.ROM)+0x3fff)/0x4000, 2)
+		return memory.romByte((memory.ROMBank%banks)*0x4000 + int(address-0x4000))
+	case address < 0xa000:
+		return memory.VRAM[address-0x8000]
+	case address < 0xc000:
+		if !memory.RAMEnabled {
+			return 0xff
+		}
+		return memory.RAM[memory.RAMBank*0x2000+int(address-0xa000)]
+	case address < 0xe000:
+		return memory.WRAM[address-0xc000]
+	case address < 0xfe00:
+		return memory.WRAM[address-0xe000]
+	case address < 0xfea0:
+		return memory.OAM[address-0xfe00]
+	case address < 0xff00:
+		return 0xff
+	}
+
+	register := address - 0xff00
+	switch register {
+	case regP1:
+		// No button pressed
+		return memory.High[regP1]&0x30 | 0xcf
+	case regIF:
+		return memory.High[regIF] | 0xe0
+	}
+	return memory.High[register]
+}
+
+func (memory *Memory) Write(address uint16, value uint8) {
+	switch {
+	case address < 0x2000:
+		memory.RAMEnabled = value&0x0f == 0x0a
+	case address < 0x4000:
+		memory.ROMBank = max(int(value), 1)
+	case address < 0x6000:
+		memory.RAMBank = int(value & 0x0f)
+	case address < 0x8000:
+	case address < 0xa000:
+		memory.VRAM[address-0x8000] = value
+	case address < 0xc000:
+		if memory.RAMEnabled {
+			memory.RAM[memory.RAMBank*0x2000+int(address-0xa000)] = value
+		}
+	case address < 0xe000:
+		memory.WRAM[address-0xc000] = value
+	case address < 0xfe00:
+		memory.WRAM[address-0xe000] = value
+	case address < 0xfea0:
+		memory.OAM[address-0xfe00] = value
+	case address < 0xff00:
+	default:
+		memory.writeRegister(address-0xff00, value)
+	}
+}
+
+func (memory *Memory) writeRegister(register uint16, value uint8) {
+	switch register {
+	case regDIV:
+		memory.High[regDIV] = 0
+		memory.divCycles = 0
+		return
+	case regLY:
+		return
+	case regSC:
+		// Transfers with the internal clock are done instantly, with nothing connected
+		if value&0x81 == 0x81 {
+			memory.Serial = append(memory.Serial, memory.High[regSB])
+			if memory.SerialOutput != nil {
+				memory.SerialOutput.Write([]byte{memory.High[regSB]})
+			}
+			memory.High[regSB] = 0xff
+			memory.High[regIF] |= interruptSerial
+			value &^= 0x80
+		}
+	case regLCDC:
+		if value&0x80 == 0 {
+			memory.High[regLY] = 0
+			memory.lineCycles = 0
+		}
+	}
+	memory.High[register] = value
+}
+
+// Advances the IO registers that depend on time
+func (memory *Memory) Tick(cycles int) {
+	memory.divCycles += cycles
+	for memory.divCycles >= 256 {
+		memory.divCycles -= 256
+		memory.High[regDIV]++
+	}
+
+	if tac := memory.High[regTAC]; tac&0x04 != 0 {
+		period := [4]int{1024, 16, 64, 256}[tac&0x03]
+		memory.timerCycles += cycles
+		for memory.timerCycles >= period {
+			memory.timerCycles -= period
+			memory.High[regTIMA]++
+			if memory.High[regTIMA] == 0 {
+				memory.High[regTIMA] = memory.High[regTMA]
+				memory.High[regIF] |= interruptTimer
+			}
+		}
+	}
+
+	if memory.High[regLCDC]&0x80 == 0 {
+		return
+	}
+
+	memory.lineCycles += cycles
+	for memory.lineCycles >= cyclesPerLine {
+		memory.lineCycles -= cyclesPerLine
+		ly := (memory.High[regLY] + 1) % linesPerFrame
+		memory.High[regLY] = ly
+		if ly == vblankLine {
+			memory.High[regIF] |= interruptVBlank
+		}
+		if ly == memory.High[regLYC] && memory.High[regSTAT]&0x40 != 0 {
+			memory.High[regIF] |= interruptStat
+		}
+	}
+
+	// Mode (HBlank, VBlank, OAM scan or drawing) and LY = LYC flag
+	mode := uint8(0)
+	switch {
+	case memory.High[regLY] >= vblankLine:
+		mode = 1
+	case memory.lineCycles < 80:
+		mode = 2
+	case memory.lineCycles < 252:
+		mode = 3
+	}
+	coincidence := uint8(0)
+	if memory.High[regLY] == memory.High[regLYC] {
+		coincidence = 0x04
+	}
+	memory.High[regSTAT] = memory.High[regSTAT]&0xf8 | coincidence | mode
+}
+
+// Cycles of each instruction (without the CB prefixed ones), when the conditional branches are not taken
+var instructionCycles = [256]int{
+	4, 12, 8, 8, 4, 4, 8, 4, 20, 8, 8, 8, 4, 4, 8, 4,
+	4, 12, 8, 8, 4, 4, 8, 4, 12, 8, 8, 8, 4, 4, 8, 4,
+	8, 12, 8, 8, 4, 4, 8, 4, 8, 8, 8, 8, 4, 4, 8, 4,
+	8, 12, 8, 8, 12, 12, 12, 4, 8, 8, 8, 8, 4, 4, 8, 4,
+	4, 4, 4, 4, 4, 4, 8, 4, 4, 4, 4, 4, 4, 4, 8, 4,
+	4, 4, 4, 4, 4, 4, 8, 4, 4, 4, 4, 4, 4, 4, 8, 4,
+	4, 4, 4, 4, 4, 4, 8, 4, 4, 4, 4, 4, 4, 4, 8, 4,
+	8, 8, 8, 8, 8, 8, 4, 8, 4, 4, 4, 4, 4, 4, 8, 4,
+	4, 4, 4, 4, 4, 4, 8, 4, 4, 4, 4, 4, 4, 4, 8, 4,
+	4, 4, 4, 4, 4, 4, 8, 4, 4, 4, 4, 4, 4, 4, 8, 4,
+	4, 4, 4, 4, 4, 4, 8, 4, 4, 4, 4, 4, 4, 4, 8, 4,
+	4, 4, 4, 4, 4, 4, 8, 4, 4, 4, 4, 4, 4, 4, 8, 4,
+	8, 12, 12, 16, 12, 16, 8, 16, 8, 16, 12, 4, 12, 24, 8, 16,
+	8, 12, 12, 4, 12, 16, 8, 16, 8, 16, 12, 4, 12, 4, 8, 16,
+	12, 12, 8, 4, 4, 16, 8, 16, 16, 4, 16, 4, 4, 4, 8, 16,
+	12, 12, 8, 4, 4, 16, 8, 16, 12, 8, 16, 4, 4, 4, 8, 16,
+}
+
+// Cycles added when the condition of JR, JP, CALL or RET is true
+const (
+	takenJRCycles   = 4
+	takenJPCycles   = 4
+	takenCallCycles = 12
+	takenRetCycles  = 12
+	interruptCycles = 20
+)
+
+// SM83 core. The registers start with the values left by the DMG boot ROM.
+type CPU struct {
+	A, F, B, C, D, E, H, L uint8
+	SP, PC                 uint16
+	IME                    bool
+	Halted                 bool
+	Cycles                 uint64
+	Memory                 *Memory
+	// Run stops when the program counter reaches it
+	Breakpoint    uint16
+	HasBreakpoint bool
+
+	// EI enables the interrupts after the next instruction: the number of instructions left to
+	// execute, including EI itself
+	enableInterrupts int
+}
+
+func NewCPU(memory *Memory) *CPU {
+	return &CPU{
+		A: 0x01, F: 0xb0, B: 0x00, C: 0x13, D: 0x00, E: 0xd8, H: 0x01, L: 0x4d,
+		SP: 0xfffe, PC: 0x0100,
+		Memory: memory,
+	}
+}
+
+func (cpu *CPU) BC() uint16 { return uint16(cpu.B)<<8 | uint16(cpu.C) }
+func (cpu *CPU) DE() uint16 { return uint16(cpu.D)<<8 | uint16(cpu.E) }
+func (cpu *CPU) HL() uint16 { return uint16(cpu.H)<<8 | uint16(cpu.L) }
+func (cpu *CPU) AF() uint16 { return uint16(cpu.A)<<8 | uint16(cpu.F) }
+
+func (cpu *CPU) SetBC(v uint16) { cpu.B, cpu.C = uint8(v>>8), uint8(v) }
+func (cpu *CPU) SetDE(v uint16) { cpu.D, cpu.E = uint8(v>>8), uint8(v) }
+func (cpu *CPU) SetHL(v uint16) { cpu.H, cpu.L = uint8(v>>8), uint8(v) }
+func (cpu *CPU) SetAF(v uint16) { cpu.A, cpu.F = uint8(v>>8), uint8(v)&0xf0 }
+
+// Registers in the format of the Gameboy Doctor logs, followed by the 4 bytes at PC
+func (cpu *CPU) Dump() string {
+	return fmt.Sprintf(
+		"A:%02X F:%02X B:%02X C:%02X D:%02X E:%02X H:%02X L:%02X SP:%04X PC:%04X PCMEM:%02X,%02X,%02X,%02X",
+		cpu.A, cpu.F, cpu.B, cpu.C, cpu.D, cpu.E, cpu.H, cpu.L, cpu.SP, cpu.PC,
+		cpu.Memory.Read(cpu.PC), cpu.Memory.Read(cpu.PC+1), cpu.Memory.Read(cpu.PC+2), cpu.Memory.Read(cpu.PC+3),
+	)
+}
+
+func (cpu *CPU) flag(flag uint8) bool {
+	return cpu.F&flag != 0
+}
+
+func (cpu *CPU) setFlags(z bool, n bool, h bool, c bool) {
+	cpu.F = 0
+	for _, f := range []struct {
+		set  bool
+		flag uint8
+	}{{z, flagZ}, {n, flagN}, {h, flagH}, {c, flagC}} {
+		if f.set {
+			cpu.F |= f.flag
+		}
+	}
+}
+
+func (cpu *CPU) fetch() uint8 {
+	v := cpu.Memory.Read(cpu.PC)
+	cpu.PC++
+	return v
+}
+
+func (cpu *CPU) fetch16() uint16 {
+	low := cpu.fetch()
+	return uint16(cpu.fetch())<<8 | uint16(low)
+}
+
+func (cpu *CPU) push(v uint16) {
+	cpu.SP--
+	cpu.Memory.Write(cpu.SP, uint8(v>>8))
+	cpu.SP--
+	cpu.Memory.Write(cpu.SP, uint8(v))
+}
+
+func (cpu *CPU) pop() uint16 {
+	low := cpu.Memory.Read(cpu.SP)
+	cpu.SP++
+	high := cpu.Memory.Read(cpu.SP)
+	cpu.SP++
+	return uint16(high)<<8 | uint16(low)
+}
+
+// 8 bits registers in the order of the opcodes: B, C, D, E, H, L, (HL), A
+func (cpu *CPU) reg8(index uint8) uint8 {
+	switch index {
+	case 0:
+		return cpu.B
+	case 1:
+		return cpu.C
+	case 2:
+		return cpu.D
+	case 3:
+		return cpu.E
+	case 4:
+		return cpu.H
+	case 5:
+		return cpu.L
+	case 6:
+		return cpu.Memory.Read(cpu.HL())
+	}
+	return cpu.A
+}
+
+func (cpu *CPU) setReg8(index uint8, v uint8) {
+	switch index {
+	case 0:
+		cpu.B = v
+	case 1:
+		cpu.C = v
+	case 2:
+		cpu.D = v
+	case 3:
+		cpu.E = v
+	case 4:
+		cpu.H = v
+	case 5:
+		cpu.L = v
+	case 6:
+		cpu.Memory.Write(cpu.HL(), v)
+	default:
+		cpu.A = v
+	}
+}
+
+// 16 bits registers in the order of the opcodes: BC, DE, HL, SP
+func (cpu *CPU) reg16(index uint8) uint16 {
+	switch index {
+	case 0:
+		return cpu.BC()
+	case 1:
+		return cpu.DE()
+	case 2:
+		return cpu.HL()
+	}
+	return cpu.SP
+}
+
+func (cpu *CPU) setReg16(index uint8, v uint16) {
+	switch index {
+	case 0:
+		cpu.SetBC(v)
+	case 1:
+		cpu.SetDE(v)
+	case 2:
+		cpu.SetHL(v)
+	default:
+		cpu.SP = v
+	}
+}
+
+// Conditions in the order of the opcodes: NZ, Z, NC, C
+func (cpu *CPU) condition(index uint8) bool {
+	switch index {
+	case 0:
+		return !cpu.flag(flagZ)
+	case 1:
+		return cpu.flag(flagZ)
+	case 2:
+		return !cpu.flag(flagC)
+	}
+	return cpu.flag(flagC)
+}
+
+// ADD, ADC, SUB, SBC, AND, XOR, OR and CP, in the order of the opcodes
+func (cpu *CPU) alu(operation uint8, v uint8) {
+	a := cpu.A
+	carry := uint8(0)
+	if cpu.flag(flagC) {
+		carry = 1
+	}
+
+	switch operation {
+	case 0, 1:
+		if operation == 0 {
+			carry = 0
+		}
+		result := uint16(a) + uint16(v) + uint16(carry)
+		cpu.A = uint8(result)
+		cpu.setFlags(cpu.A == 0, false, (a&0xf)+(v&0xf)+carry > 0xf, result > 0xff)
+	case 2, 3, 7:
+		if operation != 3 {
+			carry = 0
+		}
+		result := int(a) - int(v) - int(carry)
+		cpu.setFlags(uint8(result) == 0, true, int(a&0xf)-int(v&0xf)-int(carry) < 0, result < 0)
+		if operation != 7 {
+			cpu.A = uint8(result)
+		}
+	case 4:
+		cpu.A &= v
+		cpu.setFlags(cpu.A == 0, false, true, false)
+	case 5:
+		cpu.A ^= v
+		cpu.setFlags(cpu.A == 0, false, false, false)
+	case 6:
+		cpu.A |= v
+		cpu.setFlags(cpu.A == 0, false, false, false)
+	}
+}
+
+// RLC, RRC, RL, RR, SLA, SRA, SWAP and SRL, in the order of the CB opcodes
+func (cpu *CPU) rotate(operation uint8, v uint8) uint8 {
+	carryIn := uint8(0)
+	if cpu.flag(flagC) {
+		carryIn = 1
+	}
+
+	var result uint8
+	carry := false
+	switch operation {
+	case 0:
+		result, carry = v<<1|v>>7, v&0x80 != 0
+	case 1:
+		result, carry = v>>1|v<<7, v&1 != 0
+	case 2:
+		result, carry = v<<1|carryIn, v&0x80 != 0
+	case 3:
+		result, carry = v>>1|carryIn<<7, v&1 != 0
+	case 4:
+		result, carry = v<<1, v&0x80 != 0
+	case 5:
+		result, carry = v>>1|v&0x80, v&1 != 0
+	case 6:
+		result = v<<4 | v>>4
+	case 7:
+		result, carry = v>>1, v&1 != 0
+	}
+	cpu.setFlags(result == 0, false, false, carry)
+	return result
+}
+
+// SP + signed 8 bits offset (ADD SP, e and LD HL, SP+e): the flags come from the low byte
+func (cpu *CPU) spOffset() uint16 {
+	offset := uint16(int8(cpu.fetch()))
+	result := cpu.SP + offset
+	cpu.setFlags(false, false, (cpu.SP&0xf)+(offset&0xf) > 0xf, (cpu.SP&0xff)+(offset&0xff) > 0xff)
+	return result
+}
+
+func (cpu *CPU) daa() {
+	a := cpu.A
+	carry := cpu.flag(flagC)
+	if !cpu.flag(flagN) {
+		if carry || a > 0x99 {
+			a += 0x60
+			carry = true
+		}
+		if cpu.flag(flagH) || a&0x0f > 0x09 {
+			a += 0x06
+		}
+	} else {
+		if carry {
+			a -= 0x60
+		}
+		if cpu.flag(flagH) {
+			a -= 0x06
+		}
+	}
+	cpu.A = a
+	cpu.setFlags(a == 0, cpu.flag(flagN), false, carry)
+}
+
+// Jumps to the interrupt with the highest priority if the interrupts are enabled. A pending interrupt
+// also ends HALT.
+func (cpu *CPU) handleInterrupts() int {
+	pending := cpu.Memory.High[regIE] & cpu.Memory.High[regIF] & 0x1f
+	if pending == 0 {
+		return 0
+	}
+	cpu.Halted = false
+	if !cpu.IME {
+		return 0
+	}
+
+	for bit := 0; bit < 5; bit++ {
+		if pending&(1<<bit) != 0 {
+			cpu.Memory.High[regIF] &^= 1 << bit
+			cpu.IME = false
+			cpu.push(cpu.PC)
+			cpu.PC = 0x40 + uint16(bit)*8
+			return interruptCycles
+		}
+	}
+	return 0
+}
+
+// Executes one instruction (or handles an interrupt, or waits 4 cycles in HALT). Returns the
+// number of cycles used.
+func (cpu *CPU) Step() (int, error) {
+	if cycles := cpu.handleInterrupts(); cycles != 0 {
+		cpu.Memory.Tick(cycles)
+		cpu.Cycles += uint64(cycles)
+		return cycles, nil
+	}
+	if cpu.Halted {
+		cpu.Memory.Tick(4)
+		cpu.Cycles += 4
+		return 4, nil
+	}
+
+	address := cpu.PC
+	opcode := cpu.fetch()
+	cycles, err := cpu.execute(opcode)
+	if err != nil {
+		cpu.PC = address
+		return 0, err
+	}
+	// Checked after the instruction, so a DI following EI cancels it
+	if cpu.enableInterrupts > 0 {
+		cpu.enableInterrupts--
+		if cpu.enableInterrupts == 0 {
+			cpu.IME = true
+		}
+	}
+
+	cpu.Memory.Tick(cycles)
+	cpu.Cycles += uint64(cycles)
+	return cycles, nil
+}
+
+func (cpu *CPU) execute(opcode uint8) (int, error) {
+	cycles := instructionCycles[opcode]
+	x, y, z := opcode>>6, (opcode>>3)&7, opcode&7
+
+	switch {
+	case opcode == 0x76:
+		cpu.Halted = true
+	case x == 1:
+		cpu.setReg8(y, cpu.reg8(z))
+	case x == 2:
+		cpu.alu(y, cpu.reg8(z))
+	case x == 0:
+		return cpu.executeBlock0(opcode, cycles)
+	default:
+		return cpu.executeBlock3(opcode, cycles)
+	}
+	return cycles, nil
+}
+
+// Opcodes $00 to $3f
+func (cpu *CPU) executeBlock0(opcode uint8, cycles int) (int, error) {
+	y, z, p := (opcode>>3)&7, opcode&7, (opcode>>4)&3
+
+	switch {
+	case opcode == 0x00:
+	case opcode == 0x08:
+		address := cpu.fetch16()
+		cpu.Memory.Write(address, uint8(cpu.SP))
+		cpu.Memory.Write(address+1, uint8(cpu.SP>>8))
+	case opcode == 0x10:
+		// STOP is followed by a byte and stops the CPU until a button is pressed
+		cpu.fetch()
+		cpu.Halted = true
+	case opcode == 0x18:
+		offset := int8(cpu.fetch())
+		cpu.PC = uint16(int(cpu.PC) + int(offset))
+	case opcode&0xe7 == 0x20:
+		offset := int8(cpu.fetch())
+		if cpu.condition(y - 4) {
+			cpu.PC = uint16(int(cpu.PC) + int(offset))
+			cycles += takenJRCycles
+		}
+	case z == 1 && y%2 == 0:
+		cpu.setReg16(p, cpu.fetch16())
+	case z == 1:
+		hl := cpu.HL()
+		v := cpu.reg16(p)
+		result := uint32(hl) + uint32(v)
+		zero := cpu.flag(flagZ)
+		cpu.setFlags(zero, false, (hl&0xfff)+(v&0xfff) > 0xfff, result > 0xffff)
+		cpu.SetHL(uint16(result))
+	case z == 2:
+		// (BC), (DE), (HL+) and (HL-)
+		address := [4]uint16{cpu.BC(), cpu.DE(), cpu.HL(), cpu.HL()}[p]
+		if y%2 == 0 {
+			cpu.Memory.Write(address, cpu.A)
+		} else {
+			cpu.A = cpu.Memory.Read(address)
+		}
+		if p == 2 {
+			cpu.SetHL(cpu.HL() + 1)
+		} else if p == 3 {
+			cpu.SetHL(cpu.HL() - 1)
+		}
+	case z == 3 && y%2 == 0:
+		cpu.setReg16(p, cpu.reg16(p)+1)
+	case z == 3:
+		cpu.setReg16(p, cpu.reg16(p)-1)
+	case z == 4:
+		v := cpu.reg8(y)
+		result := v + 1
+		cpu.setReg8(y, result)
+		cpu.setFlags(result == 0, false, v&0xf == 0xf, cpu.flag(flagC))
+	case z == 5:
+		v := cpu.reg8(y)
+		result := v - 1
+		cpu.setReg8(y, result)
+		cpu.setFlags(result == 0, true, v&0xf == 0, cpu.flag(flagC))
+	case z == 6:
+		cpu.setReg8(y, cpu.fetch())
+	case opcode == 0x07, opcode == 0x0f, opcode == 0x17, opcode == 0x1f:
+		// RLCA, RRCA, RLA and RRA always clear Z
+		cpu.A = cpu.rotate(y, cpu.A)
+		cpu.F &^= flagZ
+	case opcode == 0x27:
+		cpu.daa()
+	case opcode == 0x2f:
+		cpu.A = ^cpu.A
+		cpu.F |= flagN | flagH
+	case opcode == 0x37:
+		cpu.F = cpu.F&flagZ | flagC
+	case opcode == 0x3f:
+		cpu.F = cpu.F&(flagZ|flagC) ^ flagC
+	}
+	return cycles, nil
+}
+
+// Opcodes $c0 to $ff
+func (cpu *CPU) executeBlock3(opcode uint8, cycles int) (int, error) {
+	y, z, p := (opcode>>3)&7, opcode&7, (opcode>>4)&3
+
+	switch {
+	case opcode&0xe7 == 0xc0:
+		if cpu.condition(y) {
+			cpu.PC = cpu.pop()
+			cycles += takenRetCycles
+		}
+	case opcode&0xe7 == 0xc2:
+		address := cpu.fetch16()
+		if cpu.condition(y) {
+			cpu.PC = address
+			cycles += takenJPCycles
+		}
+	case opcode&0xe7 == 0xc4:
+		address := cpu.fetch16()
+		if cpu.condition(y) {
+			cpu.push(cpu.PC)
+			cpu.PC = address
+			cycles += takenCallCycles
+		}
+	case z == 1 && y%2 == 0:
+		v := cpu.pop()
+		if p == 3 {
+			cpu.SetAF(v)
+		} else {
+			cpu.setReg16(p, v)
+		}
+	case z == 5 && y%2 == 0:
+		if p == 3 {
+			cpu.push(cpu.AF())
+		} else {
+			cpu.push(cpu.reg16(p))
+		}
+	case z == 6:
+		cpu.alu(y, cpu.fetch())
+	case z == 7:
+		cpu.push(cpu.PC)
+		cpu.PC = uint16(y) * 8
+	case opcode == 0xc3:
+		cpu.PC = cpu.fetch16()
+	case opcode == 0xc9:
+		cpu.PC = cpu.pop()
+	case opcode == 0xd9:
+		cpu.PC = cpu.pop()
+		cpu.IME = true
+	case opcode == 0xcd:
+		address := cpu.fetch16()
+		cpu.push(cpu.PC)
+		cpu.PC = address
+	case opcode == 0xcb:
+		return cpu.executeCB(cpu.fetch())
+	case opcode == 0xe0:
+		cpu.Memory.Write(0xff00+uint16(cpu.fetch()), cpu.A)
+	case opcode == 0xf0:
+		cpu.A = cpu.Memory.Read(0xff00 + uint16(cpu.fetch()))
+	case opcode == 0xe2:
+		cpu.Memory.Write(0xff00+uint16(cpu.C), cpu.A)
+	case opcode == 0xf2:
+		cpu.A = cpu.Memory.Read(0xff00 + uint16(cpu.C))
+	case opcode == 0xea:
+		cpu.Memory.Write(cpu.fetch16(), cpu.A)
+	case opcode == 0xfa:
+		cpu.A = cpu.Memory.Read(cpu.fetch16())
+	case opcode == 0xe8:
+		cpu.SP = cpu.spOffset()
+	case opcode == 0xf8:
+		cpu.SetHL(cpu.spOffset())
+	case opcode == 0xe9:
+		cpu.PC = cpu.HL()
+	case opcode == 0xf9:
+		cpu.SP = cpu.HL()
+	case opcode == 0xf3:
+		cpu.IME = false
+		cpu.enableInterrupts = 0
+	case opcode == 0xfb:
+		cpu.enableInterrupts = 2
+	default:
+		return 0, fmt.Errorf("Illegal opcode $%02x at $%04x", opcode, cpu.PC-1)
+	}
+	return cycles, nil
+}
+
+// Cycles of a CB prefixed instruction, with the prefix: BIT only reads (HL), the others write it back
+func cbInstructionCycles(opcode uint8) int {
+	switch {
+	case opcode&7 != 6:
+		return 8
+	case opcode>>6 == 1:
+		return 12
+	}
+	return 16
+}
+
+func (cpu *CPU) executeCB(opcode uint8) (int, error) {
+	x, y, z := opcode>>6, (opcode>>3)&7, opcode&7
+	cycles := cbInstructionCycles(opcode)
+
+	v := cpu.reg8(z)
+	switch x {
+	case 0:
+		cpu.setReg8(z, cpu.rotate(y, v))
+	case 1:
+		cpu.setFlags(v&(1<<y) == 0, false, true, cpu.flag(flagC))
+	case 2:
+		cpu.setReg8(z, v&^(1<<y))
+	case 3:
+		cpu.setReg8(z, v|(1<<y))
+	}
+	return cycles, nil
+}
+
+// The DBG opcode of the assembler, which is illegal on real hardware
+const debugOpcode = 0xd3
+
+// Runs until HALT with the interrupts disabled, DBG, the breakpoint or maxCycles cycles (0 for no limit)
+func (cpu *CPU) Run(maxCycles uint64, trace io.Writer) (StopReason, error) {
+	for {
+		if maxCycles != 0 && cpu.Cycles >= maxCycles {
+			return StopCycleLimit, nil
+		}
+		if cpu.HasBreakpoint && cpu.PC == cpu.Breakpoint && !cpu.Halted {
+			return StopBreakpoint, nil
+		}
+
+		if cpu.Halted {
+			// Nothing can end HALT without interrupts or with no interrupt enabled
+			if !cpu.IME || cpu.Memory.High[regIE]&0x1f == 0 {
+				return StopHalt, nil
+			}
+		} else if cpu.Memory.Read(cpu.PC) == debugOpcode {
+			return StopDebug, nil
+		}
+
+		if trace != nil && !cpu.Halted {
+			fmt.Fprintln(trace, cpu.Dump())
+		}
+
+		_, err := cpu.Step()
+		if err != nil {
+			return 0, err
+		}
+	}
+}
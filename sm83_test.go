@@ -0,0 +1,187 @@
+package main
+
+import "testing"
+
+// A CPU running program from $0100, with setup applied to its registers
+func newTestCPU(program []byte, setup func(cpu *CPU)) *CPU {
+	rom := make([]byte, 0x8000)
+	copy(rom[0x0100:], program)
+	cpu := NewCPU(NewMemory(rom))
+	if setup != nil {
+		setup(cpu)
+	}
+	return cpu
+}
+
+// Executes instructions until the end of the program
+func runTestCPU(t *testing.T, program []byte, setup func(cpu *CPU)) *CPU {
+	t.Helper()
+	cpu := newTestCPU(program, setup)
+	for cpu.PC < 0x0100+uint16(len(program)) {
+		if _, err := cpu.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cpu
+}
+
+func TestDAA(t *testing.T) {
+	tests := []struct {
+		name    string
+		program []byte
+		a, f    uint8
+	}{
+		{"45 + 38", []byte{0x3e, 0x45, 0xc6, 0x38, 0x27}, 0x83, 0x00},
+		{"99 + 01", []byte{0x3e, 0x99, 0xc6, 0x01, 0x27}, 0x00, flagZ | flagC},
+		{"90 + 90", []byte{0x3e, 0x90, 0xc6, 0x90, 0x27}, 0x80, flagC},
+		{"83 - 38", []byte{0x3e, 0x83, 0xd6, 0x38, 0x27}, 0x45, flagN},
+		{"10 - 20", []byte{0x3e, 0x10, 0xd6, 0x20, 0x27}, 0x90, flagN | flagC},
+	}
+	for _, test := range tests {
+		cpu := runTestCPU(t, test.program, nil)
+		if cpu.A != test.a || cpu.F != test.f {
+			t.Errorf("%s: A = %02x, F = %02x, expected %02x, %02x", test.name, cpu.A, cpu.F, test.a, test.f)
+		}
+	}
+}
+
+func TestSPOffsetFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		sp      uint16
+		program []byte
+		result  uint16
+		f       uint8
+	}{
+		{"ADD SP, 8", 0xfff8, []byte{0xe8, 0x08}, 0x0000, flagH | flagC},
+		{"ADD SP, -1", 0x1000, []byte{0xe8, 0xff}, 0x0fff, 0x00},
+		{"ADD SP, 1", 0x000f, []byte{0xe8, 0x01}, 0x0010, flagH},
+		{"LD HL, SP-1", 0x0001, []byte{0xf8, 0xff}, 0x0000, flagH | flagC},
+		{"LD HL, SP+2", 0x00fe, []byte{0xf8, 0x02}, 0x0100, flagH | flagC},
+	}
+	for _, test := range tests {
+		cpu := runTestCPU(t, test.program, func(cpu *CPU) {
+			cpu.SP = test.sp
+			cpu.F = flagZ | flagN
+		})
+		result := cpu.SP
+		if test.program[0] == 0xf8 {
+			result = cpu.HL()
+		}
+		if result != test.result || cpu.F != test.f {
+			t.Errorf("%s: %04x, F = %02x, expected %04x, %02x", test.name, result, cpu.F, test.result, test.f)
+		}
+	}
+}
+
+func TestIncDecHalfCarry(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, f    uint8
+		program []byte
+		result  uint8
+		flags   uint8
+	}{
+		// The carry flag is kept
+		{"INC A", 0x0f, flagC, []byte{0x3c}, 0x10, flagH | flagC},
+		{"INC A", 0x0e, 0x00, []byte{0x3c}, 0x0f, 0x00},
+		{"INC A", 0xff, 0x00, []byte{0x3c}, 0x00, flagZ | flagH},
+		{"DEC A", 0x10, 0x00, []byte{0x3d}, 0x0f, flagN | flagH},
+		{"DEC A", 0x01, flagC, []byte{0x3d}, 0x00, flagZ | flagN | flagC},
+		{"DEC A", 0x00, 0x00, []byte{0x3d}, 0xff, flagN | flagH},
+	}
+	for _, test := range tests {
+		cpu := runTestCPU(t, test.program, func(cpu *CPU) { cpu.A, cpu.F = test.a, test.f })
+		if cpu.A != test.result || cpu.F != test.flags {
+			t.Errorf("%s from %02x: %02x, F = %02x, expected %02x, %02x", test.name, test.a, cpu.A, cpu.F, test.result, test.flags)
+		}
+	}
+
+	// (HL) is incremented in memory
+	cpu := runTestCPU(t, []byte{0x34}, func(cpu *CPU) {
+		cpu.SetHL(0xc000)
+		cpu.Memory.Write(0xc000, 0x2f)
+		cpu.F = 0
+	})
+	if v := cpu.Memory.Read(0xc000); v != 0x30 || cpu.F != flagH {
+		t.Errorf("INC (HL) from 2f: %02x, F = %02x, expected 30, %02x", v, cpu.F, flagH)
+	}
+}
+
+func TestEIDelay(t *testing.T) {
+	// A V-Blank interrupt is pending
+	setup := func(cpu *CPU) {
+		cpu.Memory.High[regIE] = interruptVBlank
+		cpu.Memory.High[regIF] = interruptVBlank
+	}
+
+	// EI, NOP, NOP: the interrupt is handled after the instruction following EI
+	cpu := newTestCPU([]byte{0xfb, 0x00, 0x00}, setup)
+	for step := 0; step < 2; step++ {
+		if _, err := cpu.Step(); err != nil {
+			t.Fatal(err)
+		}
+		if cpu.PC == 0x40 {
+			t.Fatalf("The interrupt was handled after %d instructions", step+1)
+		}
+	}
+	if !cpu.IME {
+		t.Errorf("The interrupts are not enabled after the instruction following EI")
+	}
+	if _, err := cpu.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if cpu.PC != 0x40 || cpu.SP != 0xfffc || cpu.Memory.Read(0xfffc) != 0x02 {
+		t.Errorf("PC = %04x, SP = %04x, expected the V-Blank interrupt called from $0102", cpu.PC, cpu.SP)
+	}
+
+	// EI, DI: the interrupts stay disabled
+	cpu = runTestCPU(t, []byte{0xfb, 0xf3, 0x00, 0x00}, setup)
+	if cpu.IME || cpu.PC != 0x0104 {
+		t.Errorf("EI followed by DI: IME = %v, PC = %04x", cpu.IME, cpu.PC)
+	}
+}
+
+func TestHALT(t *testing.T) {
+	// Without interrupts, HALT stops the program
+	cpu := newTestCPU([]byte{0x76, 0x00}, nil)
+	reason, err := cpu.Run(1000, nil)
+	if err != nil || reason != StopHalt {
+		t.Errorf("Run stopped with %v, %v, expected %v", reason, err, StopHalt)
+	}
+
+	// EI, HALT: the CPU waits until the interrupt and then calls it
+	cpu = newTestCPU([]byte{0xfb, 0x76, 0x00}, func(cpu *CPU) {
+		cpu.Memory.High[regIE] = interruptVBlank
+	})
+	for step := 0; step < 4; step++ {
+		if _, err := cpu.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !cpu.Halted || cpu.PC != 0x0102 {
+		t.Fatalf("Halted = %v, PC = %04x, expected to wait at $0102", cpu.Halted, cpu.PC)
+	}
+	cpu.Memory.High[regIF] = interruptVBlank
+	if _, err := cpu.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if cpu.Halted || cpu.PC != 0x40 || cpu.Memory.Read(cpu.SP) != 0x02 {
+		t.Errorf("Halted = %v, PC = %04x, expected the V-Blank interrupt called from $0102", cpu.Halted, cpu.PC)
+	}
+
+	// With the interrupts disabled, a pending interrupt ends HALT without being called
+	cpu = newTestCPU([]byte{0x76, 0x00}, func(cpu *CPU) {
+		cpu.Memory.High[regIE] = interruptVBlank
+	})
+	if _, err := cpu.Step(); err != nil {
+		t.Fatal(err)
+	}
+	cpu.Memory.High[regIF] = interruptVBlank
+	if _, err := cpu.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if cpu.Halted || cpu.PC != 0x0102 {
+		t.Errorf("Halted = %v, PC = %04x, expected to continue after HALT", cpu.Halted, cpu.PC)
+	}
+}
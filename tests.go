@@ -0,0 +1,409 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// A line of a .TEST block: SET and EXPECT a register, a flag or memory, or CALL a routine
+type TestStatement struct {
+	Line     int
+	Source   string
+	Keyword  string
+	Register string
+	// Memory when Register is empty
+	Address uint16
+	Value   uint32
+	Bytes   []byte
+	// Routine called, and the ROM bank to map at $4000 before (0 to leave it as it is)
+	Target uint16
+	Bank   int
+}
+
+type UnitTest struct {
+	Name       string
+	File       string
+	Line       int
+	Statements []TestStatement
+}
+
+// Tests collected by the second pass. The normal assembly doesn't collect them.
+type TestSuite struct {
+	Tests []UnitTest
+}
+
+// The routines called by the tests return to this address, which can't contain code
+const testReturnAddress = 0xfea0
+
+var testRegisters8 = map[string]bool{"A": true, "B": true, "C": true, "D": true, "E": true, "H": true, "L": true, "F": true}
+
+var testRegisters16 = map[string]bool{"AF": true, "BC": true, "DE": true, "HL": true, "SP": true}
+
+// Indexes of the 8 bits registers for CPU.reg8
+var reg8Indexes = map[string]uint8{"B": 0, "C": 1, "D": 2, "E": 3, "H": 4, "L": 5, "A": 7}
+
+var testConditions = map[string]bool{"Z": true, "NZ": true, "C": true, "NC": true}
+
+// Splits on the commas that aren't in a string
+func splitTestArguments(arguments string) []string {
+	parts := []string{}
+	current := strings.Builder{}
+	var quote rune
+	for _, c := range arguments {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			parts = append(parts, strings.TrimSpace(current.String()))
+			current.Reset()
+			continue
+		}
+		current.WriteRune(c)
+	}
+	return append(parts, strings.TrimSpace(current.String()))
+}
+
+// Bytes written or expected in memory: 8 bits values and strings
+func parseTestBytes(state *ProgramState, lastAbsoluteLabel string, currentAddress uint32, values []string) ([]byte, error) {
+	result := []byte{}
+	for _, value := range values {
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			result = append(result, value[1:len(value)-1]...)
+			continue
+		}
+
+		v, err := parseByte(state, lastAbsoluteLabel, currentAddress, strings.ToUpper(value))
+		if err != nil {
+			return nil, fmt.Errorf("\"%s\" is neither an 8 bits value nor a string", value)
+		}
+		result = append(result, uint8(v))
+	}
+	return result, nil
+}
+
+func parseTestStatement(
+	state *ProgramState,
+	lastAbsoluteLabel string,
+	currentAddress uint32,
+	line string,
+) (TestStatement, error) {
+	keyword, arguments, _ := strings.Cut(line, " ")
+	keyword = strings.ToUpper(keyword)
+	parameters := splitTestArguments(arguments)
+	statement := TestStatement{Source: line, Keyword: keyword}
+
+	switch keyword {
+	case "CALL":
+		if len(parameters) != 1 || parameters[0] == "" {
+			return statement, fmt.Errorf("CALL takes the routine called")
+		}
+		target := strings.ToUpper(parameters[0])
+		address, err := ROMAddress(&state.Labels, lastAbsoluteLabel, &state.Defs, currentAddress, target)
+		if err == nil {
+			statement.Target = uint16(address)
+			if address >= 0x4000 {
+				statement.Bank = int(address / 0x4000)
+				statement.Target = uint16(address%0x4000 + 0x4000)
+			}
+			return statement, nil
+		}
+
+		// Routines copied to RAM are called with their address
+		address, err16 := Raw16(&state.Labels, lastAbsoluteLabel, &state.Defs, currentAddress, target)
+		if err16 != nil {
+			return statement, err
+		}
+		statement.Target = uint16(address)
+		return statement, nil
+	case "SET", "EXPECT":
+	default:
+		return statement, fmt.Errorf("Unknown test statement \"%s\" (expected SET, CALL or EXPECT)", keyword)
+	}
+
+	target := strings.ToUpper(parameters[0])
+	values := parameters[1:]
+
+	if keyword == "EXPECT" && testConditions[target] {
+		if len(values) != 0 {
+			return statement, fmt.Errorf("EXPECT %s doesn't take a value", target)
+		}
+		statement.Register = target
+		return statement, nil
+	}
+
+	if strings.HasPrefix(target, "(") && strings.HasSuffix(target, ")") {
+		address, err := Raw16(&state.Labels, lastAbsoluteLabel, &state.Defs, currentAddress, target[1:len(target)-1])
+		if err != nil {
+			return statement, err
+		}
+		if len(values) == 0 {
+			return statement, fmt.Errorf("%s %s takes at least one value", keyword, target)
+		}
+		statement.Address = uint16(address)
+		statement.Bytes, err = parseTestBytes(state, lastAbsoluteLabel, currentAddress, values)
+		return statement, err
+	}
+
+	if len(values) != 1 {
+		return statement, fmt.Errorf("%s %s takes one value", keyword, target)
+	}
+	value := strings.ToUpper(values[0])
+
+	var err error
+	switch {
+	case testRegisters8[target]:
+		statement.Value, err = parseByte(state, lastAbsoluteLabel, currentAddress, value)
+	case testRegisters16[target]:
+		statement.Value, err = Raw16(&state.Labels, lastAbsoluteLabel, &state.Defs, currentAddress, value)
+	default:
+		return statement, fmt.Errorf(
+			"%s expects a register, (address) or, for EXPECT, a flag condition (Z, NZ, C or NC), not \"%s\"",
+			keyword,
+			target,
+		)
+	}
+	statement.Register = target
+	return statement, err
+}
+
+// Reads a .TEST "name" ... .ENDTEST block. The block never adds anything to the ROM. In the second
+// pass, its statements are checked and, when tests are collected, added to the suite.
+func parseTestBlock(
+	state *ProgramState,
+	arguments string,
+	lines []string,
+	lineNb *int,
+	currentAddress uint32,
+	lastAbsoluteLabel string,
+	isFirstPass bool,
+) error {
+	startLine := *lineNb
+	blockLines := []int{}
+	for {
+		*lineNb += 1
+		if *lineNb >= len(lines) {
+			return fmt.Errorf(".TEST started on line %d is never closed by .ENDTEST", startLine+1)
+		}
+
+		line := strings.TrimSpace(strings.Split(lines[*lineNb], ";")[0])
+		if line == ".ENDTEST" {
+			break
+		}
+		if line != "" {
+			blockLines = append(blockLines, *lineNb)
+		}
+	}
+
+	if isFirstPass {
+		return nil
+	}
+
+	name := strings.TrimSpace(arguments)
+	if len(name) < 2 || name[0] != '"' || name[len(name)-1] != '"' {
+		return fmt.Errorf(".TEST takes the name of the test in double quotes")
+	}
+
+	test := UnitTest{
+		Name: name[1 : len(name)-1],
+		File: state.IncludeStack[len(state.IncludeStack)-1],
+		Line: startLine + 1,
+	}
+	for _, blockLine := range blockLines {
+		line := strings.TrimSpace(strings.Split(lines[blockLine], ";")[0])
+		statement, err := parseTestStatement(state, lastAbsoluteLabel, currentAddress, line)
+		if err != nil {
+			return fmt.Errorf("Line %d: %w", blockLine+1, err)
+		}
+		statement.Line = blockLine + 1
+		test.Statements = append(test.Statements, statement)
+	}
+
+	if state.Tests != nil {
+		state.Tests.Tests = append(state.Tests.Tests, test)
+	}
+	return nil
+}
+
+func setTestRegister(cpu *CPU, register string, value uint32) {
+	switch register {
+	case "AF":
+		cpu.SetAF(uint16(value))
+	case "BC":
+		cpu.SetBC(uint16(value))
+	case "DE":
+		cpu.SetDE(uint16(value))
+	case "HL":
+		cpu.SetHL(uint16(value))
+	case "SP":
+		cpu.SP = uint16(value)
+	case "F":
+		cpu.F = uint8(value) & 0xf0
+	default:
+		cpu.setReg8(reg8Indexes[register], uint8(value))
+	}
+}
+
+func testRegister(cpu *CPU, register string) uint32 {
+	switch register {
+	case "AF":
+		return uint32(cpu.AF())
+	case "BC":
+		return uint32(cpu.BC())
+	case "DE":
+		return uint32(cpu.DE())
+	case "HL":
+		return uint32(cpu.HL())
+	case "SP":
+		return uint32(cpu.SP)
+	case "F":
+		return uint32(cpu.F)
+	}
+	return uint32(cpu.reg8(reg8Indexes[register]))
+}
+
+// Calls the routine of a CALL statement (switching to its bank) and runs until it returns
+func callTestRoutine(cpu *CPU, statement TestStatement, maxCycles uint64) error {
+	if statement.Bank != 0 {
+		cpu.Memory.ROMBank = statement.Bank
+	}
+
+	cpu.push(testReturnAddress)
+	cpu.PC = statement.Target
+	cpu.Breakpoint = testReturnAddress
+	cpu.HasBreakpoint = true
+
+	start := cpu.Cycles
+	reason, err := cpu.Run(start+maxCycles, nil)
+	if err != nil {
+		return err
+	}
+	if reason != StopBreakpoint {
+		return fmt.Errorf("The routine didn't return (stopped on %s after %d cycles)\n%s", reason, cpu.Cycles-start, cpu.Dump())
+	}
+	return nil
+}
+
+// Checks an EXPECT statement. Returns the difference, or "" when it matches.
+func checkTestExpectation(cpu *CPU, statement TestStatement) string {
+	if testConditions[statement.Register] {
+		if !cpu.condition(map[string]uint8{"NZ": 0, "Z": 1, "NC": 2, "C": 3}[statement.Register]) {
+			return fmt.Sprintf("The flags are $%02x, expected %s", cpu.F, statement.Register)
+		}
+		return ""
+	}
+
+	if statement.Register != "" {
+		value := testRegister(cpu, statement.Register)
+		if value == statement.Value {
+			return ""
+		}
+		if testRegisters16[statement.Register] {
+			return fmt.Sprintf("%s is $%04x, expected $%04x", statement.Register, value, statement.Value)
+		}
+		return fmt.Sprintf("%s is $%02x, expected $%02x", statement.Register, value, statement.Value)
+	}
+
+	actual := make([]byte, len(statement.Bytes))
+	for i := range actual {
+		actual[i] = cpu.Memory.Read(statement.Address + uint16(i))
+	}
+	if string(actual) == string(statement.Bytes) {
+		return ""
+	}
+	return fmt.Sprintf("($%04x) is % x, expected % x", statement.Address, actual, statement.Bytes)
+}
+
+// Runs a test on a fresh CPU. Returns the failures and the number of clock cycles spent in the
+// routines.
+func runUnitTest(rom []byte, test UnitTest, maxCycles uint64) ([]string, uint64) {
+	cpu := NewCPU(NewMemory(rom))
+	// The RAM of the cartridge is accessible, as if the program had enabled it
+	cpu.Memory.RAMEnabled = true
+
+	failures := []string{}
+	cycles := uint64(0)
+	for _, statement := range test.Statements {
+		switch statement.Keyword {
+		case "SET":
+			if statement.Register != "" {
+				setTestRegister(cpu, statement.Register, statement.Value)
+				continue
+			}
+			for i, b := range statement.Bytes {
+				cpu.Memory.Write(statement.Address+uint16(i), b)
+			}
+		case "CALL":
+			start := cpu.Cycles
+			err := callTestRoutine(cpu, statement, maxCycles)
+			cycles += cpu.Cycles - start
+			if err != nil {
+				return append(failures, fmt.Sprintf("%s, line %d: %s: %s", test.File, statement.Line, statement.Source, err.Error())), cycles
+			}
+		case "EXPECT":
+			difference := checkTestExpectation(cpu, statement)
+			if difference != "" {
+				failures = append(failures, fmt.Sprintf("%s, line %d: %s", test.File, statement.Line, difference))
+			}
+		}
+	}
+	return failures, cycles
+}
+
+// Runs every test of the suite and prints the results. Returns the number of failed tests.
+func (suite *TestSuite) Run(rom []byte, maxCycles uint64) int {
+	failed := 0
+	for _, test := range suite.Tests {
+		failures, cycles := runUnitTest(rom, test, maxCycles)
+		if len(failures) == 0 {
+			fmt.Printf("PASS %s (%d M-cycles)\n", test.Name, cycles/4)
+			continue
+		}
+
+		failed += 1
+		fmt.Printf("FAIL %s (%s, line %d)\n", test.Name, test.File, test.Line)
+		for _, failure := range failures {
+			fmt.Printf("\t%s\n", strings.ReplaceAll(failure, "\n", "\n\t"))
+		}
+	}
+
+	fmt.Printf("%d tests, %d failed\n", len(suite.Tests), failed)
+	return failed
+}
+
+func testMain(args []string) {
+	flags := flag.NewFlagSet("test", flag.ExitOnError)
+	options := Options{}
+	addAssemblerFlags(flags, &options, nil)
+	maxCycles := flags.Uint64("cycles", defaultRunCycles, "Fails a CALL that doesn't return after this number of clock cycles")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gbasm test [-relax] [-I dir]... [-list listing_file] [-map map_file] [-v] [-max-fill bank=percent]... [-cycles n] [input_file]\n")
+		fmt.Fprintf(os.Stderr, "Assembles the input file and runs its .TEST blocks\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	options.Sources = &SourceFiles{}
+	options.Quiet = true
+	options.Tests = &TestSuite{}
+
+	rom, err := assembleROM(flags.Arg(0), options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if options.Tests.Run(rom, *maxCycles) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const multiplyRoutine = `Multiply: ; A = A * B
+	LD C, A
+	LD A, $00
+	.loop:
+		ADD C
+		DEC B
+		JR NZ, =.loop
+	RET
+`
+
+const multiplyTest = `.TEST "multiply 3 by 4"
+	SET A, 3
+	SET B, 4
+	CALL =Multiply
+	EXPECT A, %s
+	EXPECT NC
+.ENDTEST
+`
+
+func TestTestBlocks(t *testing.T) {
+	source := multiplyRoutine + strings.Replace(multiplyTest, "%s", "12", 1) + "\tNOP\n"
+	withoutTests := multiplyRoutine + "\tNOP\n"
+
+	expected, err := assembleTestFile(t, withoutTests, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The tests don't insert anything, whether they are collected or not
+	result, err := assembleTestFile(t, source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, expected) {
+		t.Errorf("The ROM with the tests is\n% x\ninstead of\n% x", result, expected)
+	}
+
+	suite := &TestSuite{}
+	result, err = parseFile(filepath.Join(t.TempDir(), "main.gbasm"), []byte(source), 0, Options{
+		Quiet:   true,
+		Sources: &SourceFiles{},
+		Tests:   suite,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, expected) {
+		t.Errorf("The ROM assembled by gbasm test is\n% x\ninstead of\n% x", result, expected)
+	}
+
+	if len(suite.Tests) != 1 {
+		t.Fatalf("%d tests collected instead of 1", len(suite.Tests))
+	}
+	test := suite.Tests[0]
+	if test.Name != "multiply 3 by 4" || test.Line != 9 {
+		t.Errorf("Collected the test %q of line %d", test.Name, test.Line)
+	}
+	keywords := []string{}
+	for _, statement := range test.Statements {
+		keywords = append(keywords, statement.Keyword+" "+statement.Register)
+	}
+	if strings.Join(keywords, ", ") != "SET A, SET B, CALL , EXPECT A, EXPECT NC" {
+		t.Errorf("Parsed the statements %v", keywords)
+	}
+	if call := test.Statements[2]; call.Target != 0 {
+		t.Errorf("CALL =Multiply calls $%04x instead of $0000", call.Target)
+	}
+
+	failures, cycles := runUnitTest(result, test, defaultRunCycles)
+	if len(failures) != 0 {
+		t.Errorf("The test failed: %v", failures)
+	}
+	if cycles == 0 {
+		t.Errorf("No cycles were spent in Multiply")
+	}
+}
+
+// Runs gbasm test in a process of the test binary, which calls testMain when this variable is set
+const testMainVariable = "GBASM_TEST_MAIN"
+
+func TestTestMainExitCode(t *testing.T) {
+	if path := os.Getenv(testMainVariable); path != "" {
+		testMain([]string{path})
+		os.Exit(0)
+	}
+
+	tests := []struct {
+		expected string
+		exitCode int
+		output   string
+	}{
+		{"12", 0, "PASS multiply 3 by 4"},
+		{"13", 1, "FAIL multiply 3 by 4"},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "main.gbasm")
+		source := multiplyRoutine + strings.Replace(multiplyTest, "%s", test.expected, 1)
+		if err := os.WriteFile(path, []byte(source), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		cmd := exec.Command(os.Args[0], "-test.run=^TestTestMainExitCode$")
+		cmd.Env = append(os.Environ(), testMainVariable+"="+path)
+		output, err := cmd.Output()
+
+		exitCode := 0
+		var exitError *exec.ExitError
+		if errors.As(err, &exitError) {
+			exitCode = exitError.ExitCode()
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if exitCode != test.exitCode || !strings.Contains(string(output), test.output) {
+			t.Errorf("EXPECT A, %s: exit code %d and output\n%s", test.expected, exitCode, output)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The parts of the Tiled JSON map format (.tmj) used by .INCTILED
+type tiledMap struct {
+	Width      int            `json:"width"`
+	Height     int            `json:"height"`
+	TileWidth  int            `json:"tilewidth"`
+	TileHeight int            `json:"tileheight"`
+	Infinite   bool           `json:"infinite"`
+	Layers     []tiledLayer   `json:"layers"`
+	Tilesets   []tiledTileset `json:"tilesets"`
+}
+
+type tiledTileset struct {
+	FirstGID uint32 `json:"firstgid"`
+}
+
+type tiledLayer struct {
+	Name        string          `json:"name"`
+	Type        string          `json:"type"`
+	Width       int             `json:"width"`
+	Height      int             `json:"height"`
+	Data        json.RawMessage `json:"data"`
+	Encoding    string          `json:"encoding"`
+	Compression string          `json:"compression"`
+	Objects     []tiledObject   `json:"objects"`
+	Layers      []tiledLayer    `json:"layers"`
+}
+
+type tiledObject struct {
+	ID         int             `json:"id"`
+	Type       string          `json:"type"`
+	Class      string          `json:"class"`
+	X          float64         `json:"x"`
+	Y          float64         `json:"y"`
+	Height     float64         `json:"height"`
+	GID        uint32          `json:"gid"`
+	Properties []tiledProperty `json:"properties"`
+}
+
+type tiledProperty struct {
+	Name  string `json:"name"`
+	Value any    `json:"value"`
+}
+
+// The 3 highest bits of a tile id are the flip flags
+const tiledFlagsMask = 0xe0000000
+
+type TiledOptions struct {
+	Name   string
+	Layers []string
+	Base   uint32
+	Empty  uint32
+	// Bytes of each object in the object tables
+	Fields []string
+	// Byte added after the last object of each object table
+	End    uint32
+	HasEnd bool
+}
+
+func parseTiledOptions(filePath string, parameters []string) (TiledOptions, error) {
+	options := TiledOptions{
+		Name:   nameFromFile(filePath),
+		Fields: []string{"TYPE", "X", "Y"},
+	}
+
+	for _, parameter := range parameters {
+		key, value, hasValue := strings.Cut(strings.ToUpper(parameter), "=")
+		if !hasValue {
+			return options, fmt.Errorf("Tiled map options must be written KEY=value, not \"%s\"", parameter)
+		}
+
+		switch key {
+		case "NAME":
+			options.Name = value
+		case "LAYERS":
+			options.Layers = strings.Split(value, ":")
+		case "FIELDS":
+			options.Fields = strings.Split(value, ":")
+		case "BASE", "EMPTY", "END":
+			v, err := Raw8(nil, "", &Definitions{}, 0, value)
+			if err != nil {
+				return options, fmt.Errorf("Invalid %s value \"%s\": %w", key, value, err)
+			}
+			switch key {
+			case "BASE":
+				options.Base = v
+			case "EMPTY":
+				options.Empty = v
+			case "END":
+				options.End = v
+				options.HasEnd = true
+			}
+		default:
+			return options, fmt.Errorf(
+				"Unknown Tiled map option \"%s\" (expected NAME, LAYERS, FIELDS, BASE, EMPTY or END)",
+				parameter,
+			)
+		}
+	}
+
+	return options, nil
+}
+
+// Layers in the order they are drawn, with the layers of the groups flattened
+func flattenTiledLayers(layers []tiledLayer) []tiledLayer {
+	result := []tiledLayer{}
+	for _, layer := range layers {
+		if layer.Type == "group" {
+			result = append(result, flattenTiledLayers(layer.Layers)...)
+		} else {
+			result = append(result, layer)
+		}
+	}
+	return result
+}
+
+// Tile ids of a tile layer, stored as a JSON array or as base64 (optionally compressed)
+func (layer tiledLayer) tileIDs() ([]uint32, error) {
+	if layer.Encoding != "base64" {
+		ids := []uint32{}
+		err := json.Unmarshal(layer.Data, &ids)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read the tiles of layer \"%s\": %w", layer.Name, err)
+		}
+		return ids, nil
+	}
+
+	encoded := ""
+	err := json.Unmarshal(layer.Data, &encoded)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read the tiles of layer \"%s\": %w", layer.Name, err)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't decode the tiles of layer \"%s\": %w", layer.Name, err)
+	}
+
+	var reader io.Reader
+	switch layer.Compression {
+	case "":
+		reader = bytes.NewReader(raw)
+	case "zlib":
+		reader, err = zlib.NewReader(bytes.NewReader(raw))
+	case "gzip":
+		reader, err = gzip.NewReader(bytes.NewReader(raw))
+	default:
+		return nil, fmt.Errorf("Layer \"%s\" uses the unsupported compression \"%s\"", layer.Name, layer.Compression)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't decompress the tiles of layer \"%s\": %w", layer.Name, err)
+	}
+
+	raw, err = io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't decompress the tiles of layer \"%s\": %w", layer.Name, err)
+	}
+
+	ids := make([]uint32, len(raw)/4)
+	for i := range ids {
+		ids[i] = binary.LittleEndian.Uint32(raw[i*4:])
+	}
+	return ids, nil
+}
+
+// Value of a property or of the type of an object: numbers from 0 to 255 and booleans are used as
+// is, other strings must be the name of a constant defined with .DEFINE
+func tiledValue(defs *Definitions, value any) (uint32, error) {
+	switch v := value.(type) {
+	case float64:
+		if v < 0 || v > 0xff {
+			return 0, fmt.Errorf("%v doesn't fit in a byte", v)
+		}
+		return uint32(v), nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		name := strings.ToUpper(v)
+		if _, ok := (*defs)[name]; ok {
+			return Raw8(nil, "", defs, 0, "$"+name)
+		}
+		if n, err := strconv.ParseInt(v, 0, 32); err == nil {
+			if n < 0 || n > 0xff {
+				return 0, fmt.Errorf("%d doesn't fit in a byte", n)
+			}
+			return uint32(n), nil
+		}
+		// The constant can be defined later in the program, the layout passes will find it
+		return 0, UndefinedError(fmt.Sprintf("\"%s\" is not a number nor a defined constant", v))
+	}
+	return 0, fmt.Errorf("Unsupported value %v", value)
+}
+
+func (object tiledObject) field(defs *Definitions, tiled tiledMap, field string) (uint32, error) {
+	// The position of a tile object is its bottom left corner
+	y := object.Y
+	if object.GID != 0 {
+		y -= object.Height
+	}
+	if (field == "X" || field == "TX") && object.X < 0 || (field == "Y" || field == "TY") && y < 0 {
+		return 0, fmt.Errorf("Object %d is outside of the map", object.ID)
+	}
+
+	switch field {
+	case "TYPE":
+		objectType := object.Type
+		if objectType == "" {
+			objectType = object.Class
+		}
+		if objectType == "" {
+			return 0, fmt.Errorf("Object %d doesn't have a type", object.ID)
+		}
+		return tiledValue(defs, objectType)
+	case "ID":
+		return uint32(object.ID), nil
+	case "X":
+		return uint32(object.X), nil
+	case "Y":
+		return uint32(y), nil
+	case "TX":
+		return uint32(object.X) / uint32(max(tiled.TileWidth, 1)), nil
+	case "TY":
+		return uint32(y) / uint32(max(tiled.TileHeight, 1)), nil
+	}
+
+	for _, property := range object.Properties {
+		if strings.ToUpper(property.Name) == field {
+			return tiledValue(defs, property.Value)
+		}
+	}
+	return 0, fmt.Errorf("Object %d doesn't have a property \"%s\"", object.ID, field)
+}
+
+// Reads a Tiled map (.INCTILED) and converts each of its tile layers to one byte per tile and each
+// of its object layers to a table of objects. A label is defined at the start of each layer.
+func includeTiledMap(state *ProgramState, arguments string, currentAddress uint32, isFirstPass bool) ([]byte, error) {
+	filePath, parameters, err := parseFileArguments(arguments)
+	if err != nil {
+		return nil, err
+	}
+
+	options, err := parseTiledOptions(filePath, parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	filePath, err = resolveInclude(state, filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := state.Sources.Read(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	tiled := tiledMap{}
+	err = json.Unmarshal(content, &tiled)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read %s as a Tiled JSON map: %w", filePath, err)
+	}
+	if tiled.Infinite {
+		return nil, fmt.Errorf("%s is an infinite map, which is not supported", filePath)
+	}
+
+	firstGID := uint32(1)
+	for i, tileset := range tiled.Tilesets {
+		if i == 0 || tileset.FirstGID < firstGID {
+			firstGID = tileset.FirstGID
+		}
+	}
+
+	name := strings.ToUpper(options.Name)
+	layers := flattenTiledLayers(tiled.Layers)
+	result := []byte{}
+	for _, layer := range layers {
+		layerName := nameFromFile(layer.Name)
+		if len(options.Layers) > 0 && !slices.Contains(options.Layers, layerName) {
+			continue
+		}
+		if layer.Type != "tilelayer" && layer.Type != "objectgroup" {
+			continue
+		}
+
+		err = defineDirectiveLabel(state, name+"."+layerName, currentAddress+uint32(len(result)), isFirstPass)
+		if err != nil {
+			return nil, err
+		}
+
+		switch layer.Type {
+		case "tilelayer":
+			ids, err := layer.tileIDs()
+			if err != nil {
+				return nil, err
+			}
+
+			for _, id := range ids {
+				id &^= tiledFlagsMask
+				if id == 0 {
+					result = append(result, uint8(options.Empty))
+					continue
+				}
+
+				tile := id - firstGID + options.Base
+				if tile > 0xff {
+					return nil, fmt.Errorf("Tile %d of layer \"%s\" is out of the 256 tiles", id-firstGID, layer.Name)
+				}
+				result = append(result, uint8(tile))
+			}
+		case "objectgroup":
+			for _, object := range layer.Objects {
+				for _, field := range options.Fields {
+					v, err := object.field(&state.Defs, tiled, field)
+					if err != nil {
+						return nil, fmt.Errorf("Layer \"%s\": %w", layer.Name, err)
+					}
+					if v > 0xff {
+						return nil, fmt.Errorf(
+							"Layer \"%s\": the %s of object %d (%d) doesn't fit in a byte",
+							layer.Name,
+							field,
+							object.ID,
+							v,
+						)
+					}
+					result = append(result, uint8(v))
+				}
+			}
+			if options.HasEnd {
+				result = append(result, uint8(options.End))
+			}
+
+			err = defineConstant(state, name+"_"+layerName+"_COUNT", len(layer.Objects))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for suffix, value := range map[string]int{"WIDTH": tiled.Width, "HEIGHT": tiled.Height} {
+		err = defineConstant(state, name+"_"+suffix, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
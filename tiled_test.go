@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTiledValue(t *testing.T) {
+	defs := Definitions{"ENEMY": Raw8b(3)}
+	valid := []struct {
+		value    any
+		expected uint32
+	}{
+		{float64(0), 0},
+		{float64(255), 255},
+		{true, 1},
+		{false, 0},
+		{"enemy", 3},
+		{"0x10", 0x10},
+		{"200", 200},
+	}
+	for _, test := range valid {
+		v, err := tiledValue(&defs, test.value)
+		if err != nil || v != test.expected {
+			t.Errorf("tiledValue(%#v) = %d, %v, expected %d", test.value, v, err, test.expected)
+		}
+	}
+
+	for _, value := range []any{float64(-1), float64(256), "-1", "256", "PLAYER", nil} {
+		if v, err := tiledValue(&defs, value); err == nil {
+			t.Errorf("tiledValue(%#v) = %d, expected an error", value, v)
+		}
+	}
+}
+
+func TestTiledObjectOutsideOfTheMap(t *testing.T) {
+	defs := Definitions{}
+	object := tiledObject{ID: 1, X: -8, Y: 16}
+	if _, err := object.field(&defs, tiledMap{TileWidth: 8, TileHeight: 8}, "TX"); err == nil {
+		t.Errorf("Expected an error for an object left of the map")
+	}
+	if v, err := object.field(&defs, tiledMap{TileWidth: 8, TileHeight: 8}, "TY"); err != nil || v != 2 {
+		t.Errorf("TY = %d, %v, expected 2", v, err)
+	}
+}
+
+func TestTiledConstantsDefinedLater(t *testing.T) {
+	level := `{
+		"width": 2, "height": 1, "tilewidth": 8, "tileheight": 8,
+		"tilesets": [{"firstgid": 1}],
+		"layers": [
+			{"name": "Tiles", "type": "tilelayer", "width": 2, "height": 1, "data": [1, 0]},
+			{"name": "Objects", "type": "objectgroup", "objects": [
+				{"id": 1, "type": "Enemy", "x": 8, "y": 0},
+				{"id": 2, "type": "Coin", "x": 0, "y": 16}
+			]}
+		]
+	}`
+	source := `	LD HL, =LEVEL.OBJECTS
+.INCTILED "level.tmj", END=$ff
+.DEFINE ENEMY 3
+.DEFINE COIN 4
+`
+	files := map[string][]byte{"level.tmj": []byte(level)}
+
+	result, err := assembleTestFile(t, source, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0x21, 0x05, 0x00, 0x00, 0x00, 3, 8, 0, 4, 0, 16, 0xff}
+	if !bytes.Equal(result, expected) {
+		t.Errorf("Got % x, expected % x", result, expected)
+	}
+
+	_, err = assembleTestFile(t, ".INCTILED \"level.tmj\"\n.DEFINE ENEMY 3\n", files)
+	if err == nil || !strings.Contains(err.Error(), "\"Coin\" is not a number nor a defined constant") {
+		t.Errorf("Expected an error for the undefined Coin, got %v", err)
+	}
+}
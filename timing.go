@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Cost of instructions in M-cycles (4 clock cycles). The conditional branches cost more when they
+// are taken.
+type InstructionTiming struct {
+	Cycles      int
+	TakenCycles int
+}
+
+func (timing InstructionTiming) Add(other InstructionTiming) InstructionTiming {
+	return InstructionTiming{timing.Cycles + other.Cycles, timing.TakenCycles + other.TakenCycles}
+}
+
+// Cost of the instructions added since the total was earlier
+func (timing InstructionTiming) Since(earlier InstructionTiming) InstructionTiming {
+	return InstructionTiming{timing.Cycles - earlier.Cycles, timing.TakenCycles - earlier.TakenCycles}
+}
+
+// "3", or "2/3" when the cost depends on the branches
+func (timing InstructionTiming) String() string {
+	if timing.Cycles == timing.TakenCycles {
+		return strconv.Itoa(timing.Cycles)
+	}
+	return fmt.Sprintf("%d/%d", timing.Cycles, timing.TakenCycles)
+}
+
+// Size of the instruction starting with this opcode
+func instructionLength(opcode uint8) int {
+	switch {
+	case opcode == 0x08 || opcode == 0xc3 || opcode == 0xcd || opcode == 0xea || opcode == 0xfa:
+		return 3
+	case opcode&0xcf == 0x01 || opcode&0xe7 == 0xc2 || opcode&0xe7 == 0xc4:
+		// LD r16, n16, JP cc and CALL cc
+		return 3
+	case opcode&0xc7 == 0x06 || opcode&0xc7 == 0xc6 || opcode&0xe7 == 0x20:
+		// LD r8, n8, the operations on A with n8 and JR cc
+		return 2
+	case opcode == 0x10 || opcode == 0x18 || opcode == 0xcb || opcode == 0xe0 || opcode == 0xe8 ||
+		opcode == 0xf0 || opcode == 0xf8:
+		return 2
+	}
+	return 1
+}
+
+// The directives of NewInstructionSetMacros insert data. The other macros are defined by .MACRODEF
+// and insert code.
+var builtinMacros = NewInstructionSetMacros()
+
+type CycleBudget struct {
+	File  string
+	Line  int
+	Max   int
+	Spent InstructionTiming
+}
+
+// The .CYCLES_MAX blocks being assembled, the innermost last
+type CycleBudgets struct {
+	Open []CycleBudget
+}
+
+func (budgets *CycleBudgets) Add(timing InstructionTiming) {
+	for i := range budgets.Open {
+		budgets.Open[i].Spent = budgets.Open[i].Spent.Add(timing)
+	}
+}
+
+// .CYCLES_MAX n: the instructions until the matching .ENDCYCLES must not take more than n M-cycles
+func openCycleBudget(state *ProgramState, arguments string, lineNb int) error {
+	words := strings.Fields(arguments)
+	if len(words) != 1 {
+		return fmt.Errorf(".CYCLES_MAX takes the maximum number of M-cycles")
+	}
+
+	v, err := Raw16(&state.Labels, "", &state.Defs, 0, strings.ToUpper(words[0]))
+	if err != nil {
+		return err
+	}
+
+	state.CycleBudgets.Open = append(state.CycleBudgets.Open, CycleBudget{
+		File: state.IncludeStack[len(state.IncludeStack)-1],
+		Line: lineNb + 1,
+		Max:  int(v),
+	})
+	return nil
+}
+
+// .ENDCYCLES of a .CYCLES_MAX block. Conditional branches are counted with their highest cost and every
+// instruction is counted once, as if the code ran straight from the start to the end of the block.
+func closeCycleBudget(state *ProgramState, lineNb int) error {
+	budgets := state.CycleBudgets
+	if len(budgets.Open) == 0 {
+		return fmt.Errorf(".ENDCYCLES without a .CYCLES_MAX")
+	}
+
+	budget := budgets.Open[len(budgets.Open)-1]
+	budgets.Open = budgets.Open[:len(budgets.Open)-1]
+	if budget.File != state.IncludeStack[len(state.IncludeStack)-1] {
+		return fmt.Errorf(".ENDCYCLES closes the .CYCLES_MAX of %s, line %d, which is in another file", budget.File, budget.Line)
+	}
+
+	if budget.Spent.TakenCycles > budget.Max {
+		return fmt.Errorf(
+			"The code from line %d to line %d takes up to %d M-cycles, more than the %d of .CYCLES_MAX",
+			budget.Line,
+			lineNb+1,
+			budget.Spent.TakenCycles,
+			budget.Max,
+		)
+	}
+	return nil
+}
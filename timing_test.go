@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInstructionTiming(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected InstructionTiming
+	}{
+		{"NOP", InstructionTiming{1, 1}},
+		{"LD A, B", InstructionTiming{1, 1}},
+		{"LD A, (HL)", InstructionTiming{2, 2}},
+		{"LD (HL), $12", InstructionTiming{3, 3}},
+		{"LD A, (HL+)", InstructionTiming{2, 2}},
+		{"INC (HL)", InstructionTiming{3, 3}},
+		{"SET 3, (HL)", InstructionTiming{4, 4}},
+		{"BIT 3, (HL)", InstructionTiming{3, 3}},
+		{"SWAP A", InstructionTiming{2, 2}},
+		{"JR NZ, $12", InstructionTiming{2, 3}},
+		{"JP C, $1234", InstructionTiming{3, 4}},
+		{"CALL Z, $1234", InstructionTiming{3, 6}},
+		{"RET NC", InstructionTiming{2, 5}},
+		{"RET", InstructionTiming{4, 4}},
+		{"LD ($c000), SP", InstructionTiming{5, 5}},
+	}
+	for _, test := range tests {
+		_, timing, err := Instructions.ParseTimed(&Labels{}, &Definitions{}, false, false, 0x100, "", test.line)
+		if err != nil || timing != test.expected {
+			t.Errorf("%s: %v (%v), expected %v", test.line, timing, err, test.expected)
+		}
+	}
+}
+
+func TestCycleBudgetWithMacros(t *testing.T) {
+	program := `
+.MACRODEF WAIT3
+	NOP
+	LD A, (HL)
+.END
+.MACRODEF TWICE
+	.WAIT3
+	.WAIT3
+	JR NZ, =$loop
+	$loop:
+.END
+.CYCLES_MAX %s
+	.TWICE
+	INC (HL)
+.ENDCYCLES
+`
+	// 3 + 3 + 3 (JR taken) + 3
+	_, err := assembleTestFile(t, strings.Replace(program, "%s", "12", 1), nil)
+	if err != nil {
+		t.Errorf("Expected the block to fit in 12 M-cycles: %v", err)
+	}
+	_, err = assembleTestFile(t, strings.Replace(program, "%s", "11", 1), nil)
+	if err == nil || !strings.Contains(err.Error(), "takes up to 12 M-cycles") {
+		t.Errorf("Expected the block to take 12 M-cycles, got %v", err)
+	}
+}
+
+func TestCycleBudgetBlocks(t *testing.T) {
+	tests := []struct {
+		program string
+		err     string
+	}{
+		// The .END of the blocks inside of .CYCLES_MAX don't close it
+		{`
+.CYCLES_MAX 2
+.MACRODEF WAIT
+	NOP
+.END
+.TILE
+........
+........
+........
+........
+........
+........
+........
+........
+.END
+	.WAIT
+	.WAIT
+.ENDCYCLES
+`, ""},
+		{`
+.CYCLES_MAX 3
+	NOP
+.CYCLES_MAX 1
+	NOP
+	NOP
+.ENDCYCLES
+.ENDCYCLES
+`, "from line 4 to line 7 takes up to 2 M-cycles"},
+		{`
+.CYCLES_MAX 3
+	NOP
+.CYCLES_MAX 2
+	NOP
+	NOP
+.ENDCYCLES
+	NOP
+	NOP
+.ENDCYCLES
+`, "from line 2 to line 10 takes up to 5 M-cycles"},
+		{".CYCLES_MAX 3\n\tNOP\n", ".CYCLES_MAX is never closed by .ENDCYCLES"},
+		{"\tNOP\n.ENDCYCLES\n", ".ENDCYCLES without a .CYCLES_MAX"},
+		{".CYCLES_MAX 3\n\tNOP\n.END\n", "Unknown macro \".END\""},
+	}
+	for _, test := range tests {
+		_, err := assembleTestFile(t, test.program, nil)
+		if test.err == "" && err != nil {
+			t.Errorf("%q: %v", test.program, err)
+		} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%q: expected an error containing %q, got %v", test.program, test.err, err)
+		}
+	}
+}
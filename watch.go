@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"time"
+)
+
+const watchPollInterval = 200 * time.Millisecond
+
+type fileVersion struct {
+	exists  bool
+	modTime int64
+	size    int64
+}
+
+func currentVersions(paths []string) map[string]fileVersion {
+	versions := make(map[string]fileVersion)
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			versions[path] = fileVersion{}
+			continue
+		}
+		versions[path] = fileVersion{exists: true, modTime: info.ModTime().UnixNano(), size: info.Size()}
+	}
+	return versions
+}
+
+func watchMain(args []string) {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	options := Options{}
+	dependencyFileName := ""
+	addAssemblerFlags(flags, &options, &dependencyFileName)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gbasm watch [-relax] [-I dir]... [-M deps_file] [-list listing_file] [-map map_file] [-v] [-max-fill bank=percent]... [input_file] [output_file]\n")
+		fmt.Fprintf(os.Stderr, "Assembles the input file again every time it or one of the files it includes changes\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	watch(flags.Arg(0), flags.Arg(1), options, dependencyFileName)
+}
+
+// Polls the files used by the last assembly and assembles again when one of them changes. The
+// content of the files that didn't change is kept in memory between assemblies.
+func watch(inputFileName string, outputFileName string, options Options, dependencyFileName string) {
+	sources := &SourceFiles{cache: make(map[string]cachedFile)}
+	options.Quiet = true
+	previousWarnings := []LintWarning{}
+
+	for {
+		sources.Paths = []string{}
+		sources.Missing = []string{}
+		options.Sources = sources
+		warnings := []LintWarning{}
+		options.Warnings = &warnings
+
+		start := time.Now()
+		err := assemble(inputFileName, outputFileName, options, dependencyFileName)
+		duration := time.Since(start).Round(time.Millisecond)
+
+		if err != nil {
+			fmt.Printf("[%s] FAILED (%v)\n%s\n", start.Format("15:04:05"), duration, err.Error())
+		} else {
+			size := int64(0)
+			if info, err := os.Stat(outputFileName); err == nil {
+				size = info.Size()
+			}
+			fmt.Printf(
+				"[%s] OK %s (%d bytes, %d files, %v)\n",
+				start.Format("15:04:05"),
+				outputFileName,
+				size,
+				len(sources.Paths),
+				duration,
+			)
+
+			// The same warnings would be printed again by every assembly
+			if !slices.Equal(warnings, previousWarnings) {
+				for _, warning := range warnings {
+					fmt.Printf("Warning: File %s, line %d: %s\n", warning.File, warning.Line, warning.Message)
+				}
+				previousWarnings = warnings
+			}
+		}
+
+		for path := range sources.cache {
+			if !slices.Contains(sources.Paths, path) {
+				delete(sources.cache, path)
+			}
+		}
+
+		// The versions that were read, so a change made during the assembly isn't missed
+		versions := make(map[string]fileVersion)
+		for _, path := range sources.Paths {
+			cached, ok := sources.cache[path]
+			if !ok {
+				versions[path] = fileVersion{}
+				continue
+			}
+			versions[path] = fileVersion{exists: true, modTime: cached.modTime.UnixNano(), size: cached.size}
+		}
+
+		for _, path := range sources.Missing {
+			versions[path] = fileVersion{}
+		}
+
+		watched := append(slices.Clone(sources.Paths), sources.Missing...)
+		for maps.Equal(versions, currentVersions(watched)) {
+			time.Sleep(watchPollInterval)
+		}
+	}
+}